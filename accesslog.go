@@ -0,0 +1,128 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// Actions recorded in the access log.
+const (
+	accessSubscribe = "subscribe"
+	accessPublish   = "publish"
+	accessBroadcast = "broadcast"
+	accessDelete    = "delete"
+	accessExpire    = "expire"
+	accessPoll      = "poll"
+)
+
+// AccessLogEntry stores a single line of the access log.
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Channel    string    `json:"channel,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Status     int       `json:"status,omitempty"`
+}
+
+// LogAccess writes an entry as a JSON line to the AccessLog, if set up.
+// Lines are written one at a time, so the AccessLog doesn't need to be safe for concurrent use.
+// It's only called by the goroutines of requests, so a slow AccessLog never stalls the dispatcher.
+// Consumers are recorded once their stream ends, however they were disconnected.
+func (es *eventSource) logAccess(action, channel, remoteAddr string, status int) {
+	accessLog := es.currentSettings().AccessLog
+	if accessLog == nil {
+		return
+	}
+
+	line, err := json.Marshal(&accessLogEntry{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Channel:    channel,
+		RemoteAddr: remoteAddr,
+		Status:     status,
+	})
+	if err != nil {
+		es.errorf("Unable to encode access log entry. %s\n", err)
+		return
+	}
+
+	es.accessLogMutex.Lock()
+	defer es.accessLogMutex.Unlock()
+	if _, err := accessLog.Write(append(line, '\n')); err != nil {
+		es.errorf("Unable to write access log entry. %s\n", err)
+	}
+}
+
+// AccessRecorder records the status of a response in the access log as soon as the header is written.
+// So subscriptions are logged when the stream starts, not when the consumer leaves.
+type accessRecorder struct {
+	http.ResponseWriter
+	record   func(status int)
+	recorded bool
+}
+
+// WriteHeader records the status and writes the header.
+func (ar *accessRecorder) WriteHeader(status int) {
+	ar.recordStatus(status)
+	ar.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 OK and writes the data.
+func (ar *accessRecorder) Write(data []byte) (int, error) {
+	ar.recordStatus(http.StatusOK)
+	return ar.ResponseWriter.Write(data)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, which is used by the http.ResponseController.
+func (ar *accessRecorder) Unwrap() http.ResponseWriter {
+	return ar.ResponseWriter
+}
+
+// RecordStatus records the first status of a response.
+func (ar *accessRecorder) recordStatus(status int) {
+	if !ar.recorded {
+		ar.recorded = true
+		ar.record(status)
+	}
+}
+
+// FlushingAccessRecorder is an accessRecorder of a http.ResponseWriter, which supports streaming.
+type flushingAccessRecorder struct {
+	*accessRecorder
+	flusher http.Flusher
+}
+
+// Flush flushes the underlying http.ResponseWriter.
+func (fr *flushingAccessRecorder) Flush() {
+	fr.flusher.Flush()
+}
+
+// AccessLogged wraps a handler, so its requests are recorded in the access log with the given action.
+// Without an AccessLog, the handler is called as it is.
+func (es *eventSource) accessLogged(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if es.currentSettings().AccessLog == nil {
+			handler(rw, req)
+			return
+		}
+
+		recorder := &accessRecorder{
+			ResponseWriter: rw,
+			record: func(status int) {
+				es.logAccess(action, mux.Vars(req)["channel"], es.remoteAddr(req), status)
+			},
+		}
+		if flusher, ok := rw.(http.Flusher); ok {
+			handler(&flushingAccessRecorder{accessRecorder: recorder, flusher: flusher}, req)
+		} else {
+			handler(recorder, req)
+		}
+		recorder.recordStatus(http.StatusOK)
+	}
+}
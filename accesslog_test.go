@@ -0,0 +1,111 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Buffer which is safe for concurrent use
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(data []byte) (int, error) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+	return lb.buffer.Write(data)
+}
+
+// Helper for parsing the written access log entries
+func (lb *lockedBuffer) entries(t *testing.T) []accessLogEntry {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	var entries []accessLogEntry
+	scanner := bufio.NewScanner(bytes.NewReader(lb.buffer.Bytes()))
+	for scanner.Scan() {
+		var entry accessLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Unable to parse access log line %q. %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	accessLog := &lockedBuffer{}
+	es := setupEventSource(t, &Settings{AccessLog: accessLog, AuthToken: "secret"})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+
+	// Unauthorized publish is recorded with its status
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("POST", es.testServer.URL+"/default", buildMessageData(ModeAll))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Auth-Token", "secret")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	expectResponse(t, conn, "data: bar\n\n")
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	expected := []accessLogEntry{
+		{Action: accessSubscribe, Channel: "default", Status: http.StatusOK},
+		{Action: accessPublish, Channel: "default", Status: http.StatusForbidden},
+		{Action: accessPublish, Channel: "default", Status: http.StatusCreated},
+		{Action: accessExpire, Channel: "default"},
+	}
+
+	entries := accessLog.entries(t)
+	if len(entries) != len(expected) {
+		t.Fatal("Expected 4 access log entries, got", entries)
+	}
+	for i, entry := range entries {
+		if entry.Action != expected[i].Action || entry.Channel != expected[i].Channel || entry.Status != expected[i].Status {
+			t.Errorf("Expected access log entry %+v, got %+v", expected[i], entry)
+		}
+		if entry.Time.IsZero() || len(entry.RemoteAddr) == 0 {
+			t.Error("Expected the time and remote address to be logged, got", entry)
+		}
+	}
+}
+
+func TestAccessLogClose(t *testing.T) {
+	accessLog := &lockedBuffer{}
+	es := setupEventSource(t, &Settings{AccessLog: accessLog})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Consumers disconnected by the service are recorded as well
+	if err := es.eventSource.Close("default"); err != nil {
+		t.Fatal("Unable to close channel", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	entries := accessLog.entries(t)
+	if len(entries) != 2 || entries[1].Action != accessExpire || entries[1].Channel != "default" {
+		t.Error("Expected the disconnect of the consumer to be logged, got", entries)
+	}
+}
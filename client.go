@@ -0,0 +1,278 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default client settings.
+const (
+	defaultReconnectDelay = 3 * time.Second
+	defaultMaxLineSize    = 1024 * 1024
+	clientBufferSize      = 16
+)
+
+// Client consumes the events of an EventSource stream.
+// Lost connections are reestablished automatically, using the Last-Event-ID header
+// to resume the stream after the last received event.
+// The ReconnectDelay is used until the server sends a 'retry' field, lines of the stream may be up to MaxLineSize bytes long.
+type Client struct {
+	HTTPClient     *http.Client
+	ReconnectDelay time.Duration
+	MaxLineSize    int
+
+	lastEventId string
+	retry       int64
+	err         error
+	errMutex    sync.Mutex
+	stop        chan struct{}
+	stopOnce    sync.Once
+	closeOnce   sync.Once
+}
+
+// NewClient builds and returns a new Client with default settings.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:     http.DefaultClient,
+		ReconnectDelay: defaultReconnectDelay,
+	}
+}
+
+// Connect connects to the stream of the given URL and returns a channel, which receives all events.
+// An error is returned if the initial connection fails, later connection losses trigger a reconnect.
+// Reconnects are retried as long as the server responds with '429 Too Many Requests' or a server error,
+// after the delay of its Retry-After header, if any. The channel is closed when the client is closed,
+// the server refuses a reconnect otherwise or a line exceeds the MaxLineSize. Err returns the cause then.
+func (c *Client) Connect(url string) (<-chan Event, error) {
+	c.stopped()
+
+	body, err := c.request(url)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan Event, clientBufferSize)
+	go c.receive(url, body, events)
+	return events, nil
+}
+
+// Close stops receiving events and closes the event channel.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stopped())
+	})
+}
+
+// Err returns the error, which ended the stream, e.g. the status code of a refused reconnect.
+// It's nil while the stream is running or if the client was closed.
+func (c *Client) Err() error {
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	return c.err
+}
+
+// SetErr records the error, which ended the stream.
+func (c *Client) setErr(err error) {
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	c.err = err
+}
+
+// Stopped returns the channel, which is closed when the client is closed.
+func (c *Client) stopped() chan struct{} {
+	c.stopOnce.Do(func() {
+		c.stop = make(chan struct{})
+	})
+	return c.stop
+}
+
+// StatusError is returned if the server responds with an unexpected status code.
+// The delay of a Retry-After header is kept, so reconnects wait as long as requested.
+type statusError struct {
+	statusCode int
+	retryAfter time.Duration
+}
+
+// Error returns the description of a statusError.
+func (e *statusError) Error() string {
+	return fmt.Sprintf("eventsource: unexpected status code %d", e.statusCode)
+}
+
+// Retryable checks whether the server may accept a later reconnect, i.e. for '429 Too Many Requests' and server errors.
+func (e *statusError) retryable() bool {
+	return e.statusCode == http.StatusTooManyRequests || e.statusCode >= http.StatusInternalServerError
+}
+
+// Request opens the stream of the given URL, resuming it after the last received event.
+func (c *Client) request(url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if len(c.lastEventId) > 0 {
+		req.Header.Set("Last-Event-ID", c.lastEventId)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		statusErr := &statusError{statusCode: resp.StatusCode}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			statusErr.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, statusErr
+	}
+
+	return resp.Body, nil
+}
+
+// Receive forwards the events of the stream and reconnects whenever the stream ends.
+func (c *Client) receive(url string, body io.ReadCloser, events chan<- Event) {
+	defer close(events)
+
+	for {
+		streamEnded := make(chan struct{})
+		go func() {
+			select {
+			case <-c.stop:
+				body.Close()
+			case <-streamEnded:
+			}
+		}()
+
+		err := c.parse(body, events)
+		close(streamEnded)
+		body.Close()
+		if errors.Is(err, bufio.ErrTooLong) {
+			c.setErr(err)
+			return
+		}
+
+		delay := c.reconnectDelay()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(delay):
+			}
+
+			if body, err = c.request(url); err == nil {
+				break
+			}
+
+			delay = c.reconnectDelay()
+			var statusErr *statusError
+			if errors.As(err, &statusErr) {
+				if !statusErr.retryable() {
+					c.setErr(err)
+					return
+				}
+				if statusErr.retryAfter > delay {
+					delay = statusErr.retryAfter
+				}
+			}
+		}
+	}
+}
+
+// Parse reads the text/event-stream from the given reader and dispatches each complete event.
+// Like in browsers, only events with at least one 'data' line are dispatched. Blocks without data
+// still update the last event ID, but their event name is discarded. A leading byte order mark is skipped.
+// It returns the error which ended the stream, e.g. bufio.ErrTooLong for lines exceeding the MaxLineSize.
+func (c *Client) parse(r io.Reader, events chan<- Event) error {
+	var (
+		event Event
+		data  []string
+	)
+
+	maxLineSize := c.MaxLineSize
+	if maxLineSize <= 0 {
+		maxLineSize = defaultMaxLineSize
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineSize)
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, byteOrderMark)
+		}
+
+		// An empty line dispatches the event
+		if len(line) == 0 {
+			if data != nil {
+				event.Data = strings.Join(data, "\n")
+				select {
+				case events <- event:
+				case <-c.stop:
+					return nil
+				}
+			}
+			event, data = Event{}, nil
+			continue
+		}
+
+		// Lines starting with a colon are comments
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "id":
+			c.lastEventId = value
+			if id, err := strconv.ParseUint(value, 10, 0); err == nil {
+				event.Id = uint(id)
+			}
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil && retry > 0 {
+				atomic.StoreInt64(&c.retry, int64(time.Duration(retry)*time.Millisecond))
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// ReconnectDelay returns the delay before reconnecting to a stream.
+// The reconnection time sent by the server takes precedence over the ReconnectDelay.
+func (c *Client) reconnectDelay() time.Duration {
+	if retry := atomic.LoadInt64(&c.retry); retry > 0 {
+		return time.Duration(retry)
+	}
+	if c.ReconnectDelay <= 0 {
+		return defaultReconnectDelay
+	}
+	return c.ReconnectDelay
+}
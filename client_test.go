@@ -0,0 +1,221 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Helper to receive an event from a client within a second
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Event channel closed unexpectedly")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("Timeout while waiting for an event")
+	}
+	return Event{}
+}
+
+func TestClient(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	client := NewClient()
+	defer client.Close()
+
+	events, err := client.Connect(es.testServer.URL + "/default")
+	if err != nil {
+		t.Fatal("Unable to connect client", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := es.eventSource.SendEvent(Event{Id: 1, Event: "foo", Data: "bar\nbaz"}, "default"); err != nil {
+		t.Fatal("Unable to send event", err)
+	}
+
+	if e := receiveEvent(t, events); e.Id != 1 || e.Event != "foo" || e.Data != "bar\nbaz" {
+		t.Errorf("Expected event 'foo' with id 1 and multiline data, got %+v", e)
+	}
+
+	// Connecting to an invalid channel fails
+	if _, err := NewClient().Connect(es.testServer.URL + "/invalid$channel"); err == nil {
+		t.Error("Expected an error when connecting to an invalid channel")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	lastEventIds := make(chan string, 2)
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case lastEventIds <- req.Header.Get("Last-Event-ID"):
+		default:
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		if req.Header.Get("Last-Event-ID") == "" {
+			fmt.Fprint(rw, ": comment\nretry: 10\nid: 5\r\nevent: first\ndata:a\ndata: b\n\n")
+		} else {
+			fmt.Fprint(rw, "id: 6\ndata: second\n\n")
+		}
+	}))
+	defer testServer.Close()
+
+	client := &Client{}
+	defer client.Close()
+
+	events, err := client.Connect(testServer.URL)
+	if err != nil {
+		t.Fatal("Unable to connect client", err)
+	}
+
+	if e := receiveEvent(t, events); e.Id != 5 || e.Event != "first" || e.Data != "a\nb" {
+		t.Errorf("Expected event 'first' with id 5 and data 'a\\nb', got %+v", e)
+	}
+
+	if e := receiveEvent(t, events); e.Id != 6 || e.Data != "second" {
+		t.Errorf("Expected event with id 6 and data 'second' after reconnect, got %+v", e)
+	}
+
+	if reconnectDelay := client.reconnectDelay(); reconnectDelay != 10*time.Millisecond {
+		t.Error("Expected reconnect delay of 10 milliseconds, got", reconnectDelay)
+	}
+
+	if lastEventId := <-lastEventIds; lastEventId != "" {
+		t.Error("Expected no Last-Event-ID on first connect, got", lastEventId)
+	}
+
+	if lastEventId := <-lastEventIds; lastEventId != "5" {
+		t.Error("Expected Last-Event-ID '5' on reconnect, got", lastEventId)
+	}
+
+	client.Close()
+	for range events {
+	}
+}
+
+func TestClientRetryStatus(t *testing.T) {
+	var requests int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			rw.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(rw, "retry: 10\nid: 1\ndata: first\n\n")
+		case 2:
+			rw.Header().Set("Retry-After", "1")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			rw.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(rw, "id: 2\ndata: second\n\n")
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	client := &Client{}
+	defer client.Close()
+
+	events, err := client.Connect(testServer.URL)
+	if err != nil {
+		t.Fatal("Unable to connect client", err)
+	}
+	receiveEvent(t, events)
+
+	// 503 is retried after the Retry-After delay
+	start := time.Now()
+	select {
+	case e := <-events:
+		if e.Id != 2 || time.Since(start) < time.Second {
+			t.Errorf("Expected event 2 after the Retry-After delay, got %+v after %s", e, time.Since(start))
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout while waiting for the event after a 503")
+	}
+
+	// 404 ends the stream
+	for range events {
+	}
+	var statusErr *statusError
+	if err := client.Err(); !errors.As(err, &statusErr) || statusErr.statusCode != http.StatusNotFound {
+		t.Error("Expected the status error of the refused reconnect, got", err)
+	}
+}
+
+func TestClientMaxLineSize(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(rw, "data: %s\n\n", strings.Repeat("x", 100*1024))
+	}))
+	defer testServer.Close()
+
+	client := &Client{MaxLineSize: 200 * 1024}
+	events, err := client.Connect(testServer.URL)
+	if err != nil {
+		t.Fatal("Unable to connect client", err)
+	}
+	if e := receiveEvent(t, events); len(e.Data) != 100*1024 {
+		t.Error("Expected lines beyond 64 KiB up to the MaxLineSize, got", len(e.Data))
+	}
+	client.Close()
+
+	// Lines exceeding the MaxLineSize end the stream instead of reconnecting
+	client = &Client{MaxLineSize: 1024}
+	defer client.Close()
+	if events, err = client.Connect(testServer.URL); err != nil {
+		t.Fatal("Unable to connect client", err)
+	}
+	for range events {
+	}
+	if err := client.Err(); !errors.Is(err, bufio.ErrTooLong) {
+		t.Error("Expected bufio.ErrTooLong, got", err)
+	}
+}
+
+func TestClientParse(t *testing.T) {
+	client := NewClient()
+	events := make(chan Event, 8)
+
+	stream := byteOrderMark + "data: first\n\nid: 1\n\nevent: ping\n\nid: 2\nevent: update\ndata: a\ndata: b\n\ndata:\n\nid: 3\n\n"
+	if err := client.parse(strings.NewReader(stream), events); err != nil {
+		t.Fatal("Unable to parse stream", err)
+	}
+	close(events)
+
+	// Blocks with only an 'id' or an 'event' line dispatch nothing
+	var received []Event
+	for e := range events {
+		received = append(received, e)
+	}
+	if len(received) != 3 {
+		t.Fatal("Expected 3 events, got", received)
+	}
+
+	// The leading byte order mark is skipped
+	if e := received[0]; e.Data != "first" {
+		t.Error("Expected the first event, got", e)
+	}
+	if e := received[1]; e.Id != 2 || e.Event != "update" || e.Data != "a\nb" {
+		t.Error("Expected the event with data, got", e)
+	}
+	if e := received[2]; e.Id != 0 || e.Event != "" || e.Data != "" {
+		t.Error("Expected an event with empty data, got", e)
+	}
+
+	// The 'id' of a block without data still updates the last event ID
+	if client.lastEventId != "3" {
+		t.Error("Expected the last event ID 3, got", client.lastEventId)
+	}
+}
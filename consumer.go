@@ -6,81 +6,741 @@ package eventsource
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/rand"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Remote address and buffer size of in-process consumers.
+const (
+	localRemoteAddr = "in-process"
+	localBufferSize = 16
+)
+
+// Size of buffered messages, which causes a write before the flush interval elapses.
+const flushThreshold = 32 * 1024
+
+// Connection is the writable connection to a consumer.
+type connection interface {
+	Write(data []byte) (int, error)
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Stream is a connection which writes to a http.ResponseWriter and flushes after each write.
+// Using the standard net/http machinery keeps EventSource compatible with middleware, HTTP/2 and graceful shutdowns.
+// If a compressor is set up, data is compressed and the compressor is flushed after each write as well.
+type stream struct {
+	rw         http.ResponseWriter
+	flusher    http.Flusher
+	controller *http.ResponseController
+	compressor *gzip.Writer
+}
+
+// Write writes data to the ResponseWriter and flushes it to the consumer.
+func (st *stream) Write(data []byte) (int, error) {
+	if st.compressor != nil {
+		n, err := st.compressor.Write(data)
+		if err != nil {
+			return n, err
+		}
+		if err := st.compressor.Flush(); err != nil {
+			return n, err
+		}
+		st.flusher.Flush()
+		return n, nil
+	}
+
+	n, err := st.rw.Write(data)
+	if err != nil {
+		return n, err
+	}
+	st.flusher.Flush()
+	return n, nil
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection, if supported.
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	return st.controller.SetWriteDeadline(t)
+}
+
+// Close finishes a compressed stream, otherwise it's a no-op.
+// The response itself is finished when the handler returns.
+func (st *stream) Close() error {
+	if st.compressor != nil {
+		return st.compressor.Close()
+	}
+	return nil
+}
+
 // Consumer stores information of a connected consumer.
 type consumer struct {
-	connection net.Conn
-	es         *eventSource
-	inbox      chan *eventMessage
-	channel    string
-	expired    bool
+	id            string
+	connection    connection
+	es            *eventSource
+	inbox         chan *eventMessage
+	channel       string
+	remoteAddr    string
+	ip            string
+	origin        string
+	compress      bool
+	replayRequest *replayRequest
+	replay        []*eventMessage
+	disconnected  <-chan struct{}
+	finished      chan struct{}
+	closeMessage  *eventMessage
+	connectedAt   time.Time
+	idleTimer     *time.Timer
+	expired       atomic.Bool
+	dropped       uint64
+	written       uint64
+	channelBytes  *uint64
+	writeStarted  int64
+	pending       int64
+	events        map[string]bool
+	limiter       *rateLimiter
+	webSocket     bool
+	local         bool
+}
+
+// NewConsumer builds and returns a new, not yet connected consumer based on the given attributes.
+func newConsumer(req *http.Request, es *eventSource, channel string) *consumer {
+	return &consumer{
+		id:            newConsumerId(),
+		es:            es,
+		inbox:         make(chan *eventMessage),
+		channel:       channel,
+		remoteAddr:    es.remoteAddr(req),
+		ip:            remoteIP(es.remoteAddr(req)),
+		origin:        req.Header.Get("Origin"),
+		compress:      es.currentSettings().EnableCompression && acceptsGzip(req.Header.Get("Accept-Encoding")),
+		replayRequest: newReplayRequest(req, es.replayWindow),
+		events:        newEventFilter(req),
+		limiter:       newRateLimiter(es.currentSettings().GetMaxEventsPerSecondPerConsumer()),
+		finished:      make(chan struct{}),
+		connectedAt:   time.Now(),
+	}
 }
 
-// NewConsumer builds and returns a new consumer based on the given attributes.
-// A goroutine is started for handling incoming messages.
-func newConsumer(resp http.ResponseWriter, req *http.Request, es *eventSource, channel string) (*consumer, error) {
-	connection, _, err := resp.(http.Hijacker).Hijack()
+// NewLocalConsumer builds and returns a new in-process consumer of a channel.
+func newLocalConsumer(es *eventSource, channel string) *consumer {
+	return &consumer{
+		id:          newConsumerId(),
+		es:          es,
+		inbox:       make(chan *eventMessage, localBufferSize),
+		channel:     channel,
+		remoteAddr:  localRemoteAddr,
+		finished:    make(chan struct{}),
+		connectedAt: time.Now(),
+		local:       true,
+	}
+}
+
+// NewConsumerId returns a random version 4 UUID, which identifies a consumer.
+func newConsumerId() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// Meta returns the information of a consumer, which is exposed to operators.
+func (cr *consumer) meta() ConsumerMeta {
+	return ConsumerMeta{
+		Id:             cr.id,
+		Channel:        cr.channel,
+		RemoteAddr:     cr.remoteAddr,
+		ConnectedAt:    cr.connectedAt,
+		Dropped:        atomic.LoadUint64(&cr.dropped),
+		Written:        atomic.LoadUint64(&cr.written),
+		Unacknowledged: atomic.LoadInt64(&cr.pending),
+	}
+}
+
+// Stream sets up the consumer for receiving events via the http.ResponseWriter.
+// It blocks and processes incoming messages until the consumer is removed.
+// If a DefaultRetry is set up, it's advertised right after the headers.
+// If an OnConnectMessage is set up, its event is sent right after the headers, followed by replayed messages.
+// Disconnects are detected by the cancellation of the request context.
+func (cr *consumer) stream(resp http.ResponseWriter, req *http.Request) error {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		return errStreamingUnsupported
+	}
+
+	for key, values := range cr.responseHeader() {
+		resp.Header()[key] = values
+	}
+	resp.WriteHeader(http.StatusOK)
+
+	st := &stream{
+		rw:         resp,
+		flusher:    flusher,
+		controller: http.NewResponseController(resp),
+	}
+	if cr.compress {
+		st.compressor = gzip.NewWriter(resp)
+		defer st.Close()
+	}
+	cr.connection = st
+	cr.disconnected = req.Context().Done()
+
+	lineEnding := cr.es.currentSettings().GetLineEnding()
+	n, err := cr.connection.Write(frameLines(append(cr.retryMessage(), cr.connectMessage()...), lineEnding))
+	cr.countWritten(n)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	cr := &consumer{
-		connection: connection,
-		es:         es,
-		inbox:      make(chan *eventMessage),
-		channel:    channel,
-		expired:    false,
+	for _, em := range cr.replay {
+		if em = cr.filter(em); em != nil && !cr.write(em.Message()) {
+			return nil
+		}
 	}
+	cr.replay = nil
+
+	idle := cr.startIdleTimer()
+	defer cr.stopIdleTimer()
 
-	if err := cr.setupConnection(); err != nil {
-		return nil, err
+	var lifetime <-chan time.Time
+	if maxConnectionLifetime := cr.es.currentSettings().GetMaxConnectionLifetime(); maxConnectionLifetime > 0 {
+		lifetimeTimer := time.NewTimer(maxConnectionLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
 	}
 
-	go cr.inboxDispatcher()
+	cr.inboxDispatcher(idle, lifetime)
 
-	return cr, nil
+	return nil
 }
 
-// SetupConnection is responsible to setup a usable connection to a consumer.
-// If an unexpected error (timeout,...) occurs, the connection gets closed.
-func (cr *consumer) setupConnection() error {
-	headers := [][]byte{
-		[]byte("HTTP/1.1 200 OK"),
-		[]byte("Content-Type: text/event-stream"),
-		[]byte("Cache-Control: no-cache"),
-		[]byte("Connection: keep-alive"),
-		[]byte(fmt.Sprintf("Access-Control-Allow-Origin: %s", cr.es.settings.GetCorsAllowOrigin())),
-		[]byte(fmt.Sprintf("Access-Control-Allow-Method: %s", cr.es.settings.GetCorsAllowMethod())),
+// NewEventFilter builds the set of event names a consumer asked for via the 'events' parameter, e.g. '?events=created,updated'.
+// Without the parameter, nil is returned, so the consumer receives all events.
+func newEventFilter(req *http.Request) map[string]bool {
+	var events map[string]bool
+	for _, name := range strings.Split(req.URL.Query().Get("events"), ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			if events == nil {
+				events = make(map[string]bool)
+			}
+			events[name] = true
+		}
 	}
+	return events
+}
 
-	headersData := append(bytes.Join(headers, []byte("\n")), []byte("\n\n")...)
+// Filter returns the part of a message which passes the event filter of the consumer, or nil if nothing passes.
+// Events without a name are of the type 'message', like in browsers. Raw messages are relayed verbatim,
+// so they can't be filtered and pass as a whole. Batches are reduced to the events passing the filter.
+func (cr *consumer) filter(em *eventMessage) *eventMessage {
+	if cr.events == nil || (em.raw != nil && em.batch == nil) {
+		return em
+	}
 
-	if _, err := cr.connection.Write(headersData); err != nil {
-		cr.connection.Close()
-		return err
+	if em.batch == nil {
+		if cr.events[eventType(em.Event)] {
+			return em
+		}
+		return nil
+	}
+
+	var batch []*eventMessage
+	var messageData bytes.Buffer
+	for _, bm := range em.batch {
+		if cr.events[eventType(bm.Event)] {
+			batch = append(batch, bm)
+			messageData.Write(bm.Message())
+		}
 	}
 
+	switch len(batch) {
+	case 0:
+		return nil
+	case len(em.batch):
+		return em
+	}
+	return &eventMessage{Channel: em.Channel, raw: messageData.Bytes(), batch: batch}
+}
+
+// EventType returns the type of an event, which is 'message' for events without a name.
+func eventType(event string) string {
+	if len(event) == 0 {
+		return "message"
+	}
+	return event
+}
+
+// Enqueue passes a message to the inbox of the consumer without blocking and returns whether it was enqueued.
+// Messages which don't pass the event filter are skipped. Like messages which don't fit into the inbox,
+// messages exceeding the rate limit of the consumer are counted as dropped, so the newest messages are dropped.
+// The consumer becomes a reader of streamed messages, before they're enqueued.
+func (cr *consumer) enqueue(em *eventMessage) bool {
+	if em = cr.filter(em); em == nil {
+		return false
+	}
+
+	events := 1
+	if em.batch != nil {
+		events = len(em.batch)
+	}
+	if !cr.limiter.allow(events, time.Now()) {
+		atomic.AddUint64(&cr.dropped, 1)
+		return false
+	}
+
+	if em.stream != nil {
+		em.stream.addReader(cr)
+	}
+
+	select {
+	case cr.inbox <- em:
+		return true
+	default:
+		if em.stream != nil {
+			em.stream.release(cr)
+		}
+		atomic.AddUint64(&cr.dropped, 1)
+		return false
+	}
+}
+
+// Lagging checks whether the consumer falls behind by the given threshold, e.g. 0.75 for three quarters.
+// In-process consumers lag if their inbox is filled up to the threshold. Inboxes of consumers connected via HTTP or WebSocket
+// are unbuffered, so they lag if their current write is blocked for the threshold of the WriteTimeout, before they're disconnected.
+func (cr *consumer) lagging(threshold float64) bool {
+	if cap(cr.inbox) > 0 {
+		return float64(len(cr.inbox)) >= threshold*float64(cap(cr.inbox))
+	}
+	started := atomic.LoadInt64(&cr.writeStarted)
+	return started > 0 && time.Since(time.Unix(0, started)) >= time.Duration(threshold*float64(cr.es.currentSettings().GetWriteTimeout()))
+}
+
+// ResponseHeader returns the headers sent to a consumer.
+func (cr *consumer) responseHeader() http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", "text/event-stream; charset=utf-8")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Consumer-ID", cr.id)
+
+	if cr.compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if !cr.es.currentSettings().OmitAccelBuffering {
+		header.Set("X-Accel-Buffering", "no")
+	}
+
+	cr.es.currentSettings().setCorsOriginHeaders(header, cr.origin)
+
+	header.Set("Access-Control-Allow-Method", cr.es.currentSettings().GetCorsAllowMethod())
+	header.Set("Access-Control-Allow-Headers", cr.es.currentSettings().GetCorsAllowHeaders())
+
+	return header
+}
+
+// RemoteIP returns the IP address of a remote address in the form 'host:port'.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// AcceptsGzip checks whether the given Accept-Encoding header allows gzip compressed responses.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(strings.ToLower(name)) != "gzip" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// RetryMessage returns the 'retry' field advertising the DefaultRetry or the adaptive retry, which is sent right after the headers.
+// WebSockets have no reconnection delay, so nothing is returned for WebSocket consumers.
+func (cr *consumer) retryMessage() []byte {
+	if cr.webSocket {
+		return nil
+	}
+	if retry := cr.es.retry(); retry > 0 {
+		return []byte(fmt.Sprintf("retry: %d\n\n", retry.Milliseconds()))
+	}
+	return nil
+}
+
+// ConnectMessage returns the message of the OnConnectMessage callback, which is sent right after the headers.
+func (cr *consumer) connectMessage() []byte {
+	if onConnectMessage := cr.es.currentSettings().OnConnectMessage; onConnectMessage != nil {
+		if e := onConnectMessage(cr.channel); e != nil {
+			return eventMessageFromEvent(e, cr.channel).Message()
+		}
+	}
 	return nil
 }
 
 // InboxDispatcher processes incoming eventMessages.
-// It disconnects timed out consumers and initiates the removal from the consumer pool.
-func (cr *consumer) inboxDispatcher() {
-	for message := range cr.inbox {
-		cr.connection.SetWriteDeadline(time.Now().Add(cr.es.settings.GetTimeout()))
-		if _, err := cr.connection.Write(message.Message()); err != nil {
-			if netErr, ok := err.(net.Error); !ok || netErr.Timeout() {
-				cr.expired = true
+// It disconnects timed out, idle, outlived or disconnected consumers and initiates the removal from the consumer pool.
+// If a FlushInterval is set up, messages are coalesced and written in batches, except for WebSocket consumers.
+func (cr *consumer) inboxDispatcher(idle, lifetime <-chan time.Time) {
+	if flushInterval := cr.es.currentSettings().GetFlushInterval(); flushInterval > 0 && !cr.webSocket {
+		cr.bufferedInboxDispatcher(flushInterval, idle, lifetime)
+		return
+	}
+
+	for {
+		select {
+		case message, ok := <-cr.inbox:
+			if !ok {
+				if cr.closeMessage != nil && !cr.send(cr.closeMessage) {
+					return
+				}
 				cr.connection.Close()
-				cr.es.expireConsumer <- cr
 				return
 			}
+			if !cr.send(message) {
+				return
+			}
+
+		case <-cr.disconnected:
+			cr.es.removeConsumer(cr)
+			return
+
+		case <-idle:
+			cr.es.removeConsumer(cr)
+			return
+
+		case <-lifetime:
+			cr.endLifetime(nil)
+			return
+		}
+	}
+}
+
+// BufferedInboxDispatcher processes incoming eventMessages by collecting them in a buffer.
+// The buffer is written when the flush interval elapses or when it reaches the flush threshold.
+func (cr *consumer) bufferedInboxDispatcher(flushInterval time.Duration, idle, lifetime <-chan time.Time) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var buffer bytes.Buffer
+	for {
+		select {
+		case message, ok := <-cr.inbox:
+			if !ok {
+				if cr.closeMessage != nil {
+					buffer.Write(cr.closeMessage.Message())
+				}
+				if buffer.Len() > 0 && !cr.write(buffer.Bytes()) {
+					return
+				}
+				cr.connection.Close()
+				return
+			}
+
+			// Streamed messages are written as they're read, after the buffered messages.
+			if message.stream != nil {
+				if buffer.Len() > 0 && !cr.write(buffer.Bytes()) {
+					return
+				}
+				buffer.Reset()
+				if !cr.send(message) {
+					return
+				}
+				continue
+			}
+
+			buffer.Write(message.Message())
+			if buffer.Len() >= flushThreshold {
+				if !cr.write(buffer.Bytes()) {
+					return
+				}
+				buffer.Reset()
+			}
+
+		case <-ticker.C:
+			if buffer.Len() > 0 {
+				if !cr.write(buffer.Bytes()) {
+					return
+				}
+				buffer.Reset()
+			}
+
+		case <-cr.disconnected:
+			cr.es.removeConsumer(cr)
+			return
+
+		case <-idle:
+			cr.es.removeConsumer(cr)
+			return
+
+		case <-lifetime:
+			cr.endLifetime(buffer.Bytes())
+			return
+		}
+	}
+}
+
+// EndLifetime disconnects a consumer, which reached the MaxConnectionLifetime, and initiates its removal.
+// Pending data and the 'retry' field are written beforehand, so the client reconnects after the advertised delay.
+func (cr *consumer) endLifetime(pending []byte) {
+	cr.es.debugf("Consumer %s reached the maximum connection lifetime on channel '%s'\n", cr.remoteAddr, cr.channel)
+	if data := append(pending, cr.retryMessage()...); len(data) > 0 && !cr.write(data) {
+		return
+	}
+	cr.es.removeConsumer(cr)
+}
+
+// Send writes a message to the consumer. WebSocket consumers receive each of its events as JSON encoded text frame.
+func (cr *consumer) send(em *eventMessage) bool {
+	if em.stream != nil {
+		return cr.sendStream(em)
+	}
+	if !cr.webSocket {
+		return cr.write(em.Message())
+	}
+	for _, e := range em.events() {
+		if !cr.write(encodeWebSocketEvent(e)) {
+			return false
+		}
+	}
+	return true
+}
+
+// SendStream writes the chunks of a streamed message to the consumer, as soon as they're published.
+// Consumers connected via HTTP receive a single event, whose 'data:' lines are flushed chunk by chunk
+// and which ends with the stream. A line, which was cut at the end of a chunk, continues with the next chunk.
+// WebSocket consumers receive each chunk as its own event. Consumers, which received chunks of an aborted stream, are disconnected.
+func (cr *consumer) sendStream(em *eventMessage) bool {
+	eventName := sanitizeEventName(em.Event)
+	started, open := false, false
+	ok := em.stream.read(cr, func(chunk string) bool {
+		if cr.webSocket {
+			started = true
+			return cr.write(encodeWebSocketEvent(chunkEvent(em.Event, chunk)))
+		}
+
+		var frame bytes.Buffer
+		if !started && len(eventName) > 0 {
+			frame.WriteString(fmt.Sprintf("event: %s\n", eventName))
+		}
+		started = true
+		for len(chunk) > 0 {
+			line, rest, complete := strings.Cut(chunk, "\n")
+			if !open {
+				frame.WriteString("data: ")
+			}
+			frame.WriteString(line)
+			if open = !complete; complete {
+				frame.WriteString("\n")
+			}
+			chunk = rest
+		}
+		return cr.write(frame.Bytes())
+	})
+
+	if ok && em.stream.isAborted() {
+		// An event can't be ended without being dispatched, so the response is ended instead. Clients discard the unfinished event and reconnect.
+		if started {
+			cr.expired.Store(true)
+			cr.connection.Close()
+			cr.es.removeConsumer(cr)
+			return false
+		}
+		return true
+	}
+	if ok && open {
+		ok = cr.write([]byte("\n"))
+	}
+	if ok && started && !cr.webSocket {
+		return cr.write([]byte("\n"))
+	}
+	return ok
+}
+
+// ReadStream reads a streamed message to its end and returns it as a single event, for consumers which can't receive
+// it chunk by chunk, like long polling consumers. Aborted streams and streams exceeding the maxDataBytes result in nil.
+func (cr *consumer) readStream(em *eventMessage, maxDataBytes int) *Event {
+	var data strings.Builder
+	complete := em.stream.read(cr, func(chunk string) bool {
+		if maxDataBytes > 0 && data.Len()+len(chunk) > maxDataBytes {
+			return false
+		}
+		data.WriteString(chunk)
+		return true
+	})
+	if !complete || em.stream.isAborted() {
+		return nil
+	}
+	return chunkEvent(em.Event, data.String())
+}
+
+// ReleaseStreams releases the streamed messages left in the inbox of a consumer, so they don't hold back their publishers.
+// It's called once the consumer was removed, so no further messages are enqueued.
+func (cr *consumer) releaseStreams() {
+	for {
+		select {
+		case em, ok := <-cr.inbox:
+			if !ok {
+				return
+			}
+			if em.stream != nil {
+				em.stream.release(cr)
+			}
+		default:
+			return
 		}
 	}
-	cr.connection.Close()
+}
+
+// CountWritten adds the bytes written to the consumer to its own, its channel's and the overall count.
+// The counters are updated without locking, even after the consumer was removed, e.g. while it's drained.
+func (cr *consumer) countWritten(n int) {
+	atomic.AddUint64(&cr.written, uint64(n))
+	atomic.AddUint64(&cr.es.bytesWritten, uint64(n))
+	if cr.channelBytes != nil {
+		atomic.AddUint64(cr.channelBytes, uint64(n))
+	}
+}
+
+// Write sends data to the consumer, framed with the LineEnding, and returns whether the consumer is still usable.
+// Any write error, e.g. a timeout or a broken pipe, disconnects the consumer and removes it from the consumer pool,
+// as an event stream can't recover from a partially written message.
+// If an OnError callback is set up, it's called in its own goroutine for the failed write.
+func (cr *consumer) write(data []byte) bool {
+	cr.connection.SetWriteDeadline(time.Now().Add(cr.es.currentSettings().GetWriteTimeout()))
+	atomic.StoreInt64(&cr.writeStarted, time.Now().UnixNano())
+	n, err := cr.connection.Write(frameLines(data, cr.es.currentSettings().GetLineEnding()))
+	atomic.StoreInt64(&cr.writeStarted, 0)
+	cr.countWritten(n)
+	if err != nil {
+		cr.expired.Store(true)
+		cr.connection.Close()
+		if onError := cr.es.currentSettings().OnError; onError != nil {
+			go onError(cr.channel, cr.remoteAddr, err)
+		}
+		cr.es.removeConsumer(cr)
+		return false
+	}
+	cr.resetIdleTimer()
+	return true
+}
+
+// StartIdleTimer starts the timer for the idle timeout and returns its channel.
+// Without an idle timeout, a nil channel is returned, which never fires.
+func (cr *consumer) startIdleTimer() <-chan time.Time {
+	idleTimeout := cr.es.currentSettings().GetIdleTimeout()
+	if idleTimeout <= 0 {
+		return nil
+	}
+	cr.idleTimer = time.NewTimer(idleTimeout)
+	return cr.idleTimer.C
+}
+
+// ResetIdleTimer restarts the idle timeout after data was written successfully.
+func (cr *consumer) resetIdleTimer() {
+	if cr.idleTimer == nil {
+		return
+	}
+	if !cr.idleTimer.Stop() {
+		select {
+		case <-cr.idleTimer.C:
+		default:
+		}
+	}
+	cr.idleTimer.Reset(cr.es.currentSettings().GetIdleTimeout())
+}
+
+// StopIdleTimer stops the timer for the idle timeout.
+func (cr *consumer) stopIdleTimer() {
+	if cr.idleTimer != nil {
+		cr.idleTimer.Stop()
+	}
+}
+
+// EventDispatcher forwards incoming eventMessages as events to an in-process consumer.
+// Events are dropped if the consumer doesn't keep up, like for consumers connected via HTTP.
+func (cr *consumer) eventDispatcher(events chan<- *Event) {
+	defer close(cr.finished)
+	cr.dispatchEvents(func(e *Event) bool {
+		select {
+		case events <- e:
+			return true
+		default:
+			return false
+		}
+	})
+	close(events)
+}
+
+// AckEventDispatcher forwards incoming eventMessages as acknowledgeable events to an in-process consumer.
+// Forwarded events are pending until they are acknowledged.
+func (cr *consumer) ackEventDispatcher(events chan<- *AckableEvent) {
+	defer close(cr.finished)
+	cr.dispatchEvents(func(e *Event) bool {
+		atomic.AddInt64(&cr.pending, 1)
+		select {
+		case events <- &AckableEvent{Event: e, consumer: cr}:
+			return true
+		default:
+			atomic.AddInt64(&cr.pending, -1)
+			return false
+		}
+	})
+	close(events)
+}
+
+// DispatchEvents passes the events of incoming eventMessages to the given send function until the inbox is closed.
+// Each chunk of a streamed message is passed as its own event. Events which can't be sent are counted as dropped.
+func (cr *consumer) dispatchEvents(send func(e *Event) bool) {
+	for message := range cr.inbox {
+		if message.stream != nil {
+			message.stream.read(cr, func(chunk string) bool {
+				if !send(chunkEvent(message.Event, chunk)) {
+					atomic.AddUint64(&cr.dropped, 1)
+				}
+				return true
+			})
+			continue
+		}
+
+		for _, e := range message.events() {
+			if !send(e) {
+				atomic.AddUint64(&cr.dropped, 1)
+			}
+		}
+	}
+	if cr.closeMessage != nil {
+		send(cr.closeMessage.event())
+	}
+}
+
+// AckableEvent is an event received by an acknowledging in-process consumer.
+// Until it's acknowledged, it's listed as pending in the ConsumerMeta of its consumer.
+type AckableEvent struct {
+	*Event
+	consumer *consumer
+	acked    int32
+}
+
+// Ack acknowledges that the event has been processed. Repeated calls are ignored.
+func (ae *AckableEvent) Ack() {
+	if atomic.CompareAndSwapInt32(&ae.acked, 0, 1) {
+		atomic.AddInt64(&ae.consumer.pending, -1)
+	}
 }
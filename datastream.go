@@ -0,0 +1,231 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Maximum size of a chunk, in which the data of a streamed message is read and sent.
+const streamChunkSize = 16 * 1024
+
+// Number of chunks a streamed message holds for consumers, which are still writing earlier chunks.
+const streamWindow = 4
+
+// Maximum time, in which the payload of a streamed message is read. While a stream is sent, the HTTP consumers
+// of its channel are busy with it and other messages of the channel are dropped for them, so streams can't run forever.
+const maxStreamDuration = 5 * time.Minute
+
+// DataStream passes the chunks of a streamed message from the publisher to the consumers it was enqueued to.
+// The publisher is held back while the slowest consumer is streamWindow chunks behind, so at most streamWindow
+// chunks are held in memory. Consumers which are done with the stream release their position.
+type dataStream struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	chunks  []string
+	offset  int
+	readers map[*consumer]int
+	done    bool
+	aborted bool
+}
+
+// NewDataStream builds and returns a new dataStream without readers.
+func newDataStream() *dataStream {
+	ds := &dataStream{readers: make(map[*consumer]int)}
+	ds.cond = sync.NewCond(&ds.mutex)
+	return ds
+}
+
+// AddReader registers a consumer, which reads the stream from its first chunk.
+// It's called by the dispatcher, before any chunk is published.
+func (ds *dataStream) addReader(cr *consumer) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.readers[cr] = ds.offset
+}
+
+// Release removes a consumer from the readers, so it no longer holds back the publisher.
+func (ds *dataStream) release(cr *consumer) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	delete(ds.readers, cr)
+	ds.trim()
+	ds.cond.Broadcast()
+}
+
+// Publish appends a chunk to the stream. It blocks while the window of held chunks is full.
+func (ds *dataStream) publish(chunk string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	for len(ds.chunks) >= streamWindow {
+		ds.cond.Wait()
+	}
+	ds.chunks = append(ds.chunks, chunk)
+	ds.trim()
+	ds.cond.Broadcast()
+}
+
+// Close ends the stream, so its readers finish after the last chunk.
+func (ds *dataStream) close() {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.done = true
+	ds.cond.Broadcast()
+}
+
+// Abort ends the stream early, e.g. when reading the payload failed, so its readers don't end the event normally.
+func (ds *dataStream) abort() {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.done = true
+	ds.aborted = true
+	ds.cond.Broadcast()
+}
+
+// IsAborted returns whether the stream was ended early.
+func (ds *dataStream) isAborted() bool {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.aborted
+}
+
+// Read passes the chunks of the stream to the given function as soon as they're published, until the stream ends
+// or the function returns false. Afterwards, the consumer is released. It returns whether all chunks were passed.
+func (ds *dataStream) read(cr *consumer, fn func(chunk string) bool) bool {
+	defer ds.release(cr)
+	for {
+		chunk, ok := ds.next(cr)
+		if !ok {
+			return true
+		}
+		if !fn(chunk) {
+			return false
+		}
+	}
+}
+
+// Next waits for the next chunk of a consumer and advances its position.
+// It returns false, when the stream has ended or the consumer isn't a reader of the stream.
+func (ds *dataStream) next(cr *consumer) (string, bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	position, ok := ds.readers[cr]
+	if !ok {
+		return "", false
+	}
+	for position >= ds.offset+len(ds.chunks) && !ds.done {
+		ds.cond.Wait()
+	}
+	if position >= ds.offset+len(ds.chunks) {
+		return "", false
+	}
+
+	chunk := ds.chunks[position-ds.offset]
+	ds.readers[cr] = position + 1
+	ds.trim()
+	ds.cond.Broadcast()
+	return chunk, true
+}
+
+// Trim drops the chunks, which were read by all readers. Without readers, all chunks are dropped.
+func (ds *dataStream) trim() {
+	read := ds.offset + len(ds.chunks)
+	for _, position := range ds.readers {
+		if position < read {
+			read = position
+		}
+	}
+	for i := 0; i < read-ds.offset; i++ {
+		ds.chunks[i] = ""
+	}
+	ds.chunks = ds.chunks[read-ds.offset:]
+	ds.offset = read
+}
+
+// ChunkEvent returns a chunk of a streamed message as its own event, without the trailing line break of the chunk.
+func chunkEvent(event, chunk string) *Event {
+	return &Event{Event: event, Data: strings.TrimSuffix(chunk, "\n")}
+}
+
+// ReadDataChunks reads a plain text stream and calls publish with chunks of about streamChunkSize bytes.
+// A chunk is published as soon as no more data is buffered, so slowly written streams, like log tails, are sent line by line.
+// Chunks keep their line breaks and are cut at line boundaries, only lines exceeding the chunk size continue in the next chunk.
+// Line endings are normalized to '\n' and a trailing '\r' or partial rune is carried over to the next chunk, so runes are never split.
+// A leading byte order mark is skipped. Reading stops with errInvalidEncoding for data, which isn't valid UTF-8,
+// and with errDataTooLarge, before the data exceeds the maxDataBytes.
+func readDataChunks(messageStream io.Reader, maxDataBytes int, publish func(chunk string)) error {
+	reader := bufio.NewReaderSize(messageStream, streamChunkSize)
+	if prefix, err := reader.Peek(len(byteOrderMark)); err == nil && string(prefix) == byteOrderMark {
+		reader.Discard(len(byteOrderMark))
+	}
+
+	var chunk []byte
+	var size int
+	flush := func(final bool) error {
+		data, carry := chunk, []byte(nil)
+		if !final {
+			data, carry = splitIncomplete(chunk)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		if !utf8.Valid(data) {
+			return errInvalidEncoding
+		}
+		data = bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\r"), []byte("\n"))
+		if size += len(data); maxDataBytes > 0 && size > maxDataBytes {
+			return errDataTooLarge
+		}
+		publish(string(data))
+		chunk = append(chunk[:0], carry...)
+		return nil
+	}
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return err
+		}
+
+		if len(chunk) > 0 && len(chunk)+len(line) > streamChunkSize {
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+		chunk = append(chunk, line...)
+
+		if err == io.EOF {
+			return flush(true)
+		}
+		if reader.Buffered() == 0 {
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SplitIncomplete splits a trailing '\r', which might be followed by a '\n', or a trailing partial rune off the chunk.
+func splitIncomplete(chunk []byte) ([]byte, []byte) {
+	if n := len(chunk); n > 0 && chunk[n-1] == '\r' {
+		return chunk[:n-1], chunk[n-1:]
+	}
+	for i := len(chunk) - 1; i >= 0 && i >= len(chunk)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(chunk[i]) {
+			if !utf8.FullRune(chunk[i:]) {
+				return chunk[:i], chunk[i:]
+			}
+			break
+		}
+	}
+	return chunk, nil
+}
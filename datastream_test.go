@@ -0,0 +1,151 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDataChunks(t *testing.T) {
+	var chunks []string
+	collect := func(chunk string) {
+		chunks = append(chunks, chunk)
+	}
+
+	// Small payloads result in a single chunk with normalized line endings and without a byte order mark
+	if err := readDataChunks(strings.NewReader(byteOrderMark+"first\r\nsecond\rthird\n"), 0, collect); err != nil {
+		t.Fatal("Unable to read chunks", err)
+	}
+	if len(chunks) != 1 || chunks[0] != "first\nsecond\nthird\n" {
+		t.Errorf("Expected a single chunk 'first\\nsecond\\nthird\\n', got %q", chunks)
+	}
+
+	// Large payloads are split at line boundaries
+	chunks = nil
+	line := strings.Repeat("x", streamChunkSize/4-1) + "\n"
+	if err := readDataChunks(strings.NewReader(strings.Repeat(line, 6)), 0, collect); err != nil {
+		t.Fatal("Unable to read chunks", err)
+	}
+	if len(chunks) != 2 || chunks[0] != strings.Repeat(line, 4) || chunks[1] != strings.Repeat(line, 2) {
+		t.Error("Expected chunks of 4 and 2 lines, got", len(chunks))
+	}
+
+	// Lines exceeding the chunk size continue in the next chunk
+	chunks = nil
+	if err := readDataChunks(strings.NewReader(strings.Repeat("y", streamChunkSize+10)), 0, collect); err != nil {
+		t.Fatal("Unable to read chunks", err)
+	}
+	if len(chunks) != 2 || len(chunks[0]) != streamChunkSize || len(chunks[1]) != 10 {
+		t.Error("Expected chunks of", streamChunkSize, "and 10 bytes, got", len(chunks))
+	}
+
+	// Partial runes and line endings at the end of a chunk are carried over to the next chunk
+	for _, ending := range []string{"€\n", "\r\n"} {
+		chunks = nil
+		cut := strings.Repeat("z", streamChunkSize-1)
+		if err := readDataChunks(strings.NewReader(cut+ending), 0, collect); err != nil {
+			t.Fatal("Unable to read chunks", err)
+		}
+		if expected := strings.ReplaceAll(ending, "\r", ""); len(chunks) != 2 || chunks[0] != cut || chunks[1] != expected {
+			t.Errorf("Expected chunks of %d bytes and %q, got %d chunks", len(cut), expected, len(chunks))
+		}
+	}
+
+	// Reading stops at invalid UTF-8
+	chunks = nil
+	if err := readDataChunks(strings.NewReader("valid\n\xff\n"), 0, collect); err != errInvalidEncoding {
+		t.Error("Expected errInvalidEncoding, got", err)
+	}
+
+	// Reading stops before the data exceeds the maximum data size
+	chunks = nil
+	if err := readDataChunks(strings.NewReader(strings.Repeat(line, 6)), 2*len(line), collect); err != errDataTooLarge {
+		t.Error("Expected errDataTooLarge, got", err)
+	}
+	if len(chunks) != 0 {
+		t.Error("Expected no chunks, got", len(chunks))
+	}
+}
+
+func TestDataStream(t *testing.T) {
+	ds := newDataStream()
+	fast, slow := &consumer{}, &consumer{}
+	ds.addReader(fast)
+	ds.addReader(slow)
+
+	for i := 0; i < streamWindow; i++ {
+		ds.publish("chunk")
+	}
+
+	// The publisher is held back while the window of the slowest reader is full
+	published := make(chan struct{})
+	go func() {
+		ds.publish("last")
+		ds.close()
+		close(published)
+	}()
+
+	fastChunks := make(chan string, streamWindow+1)
+	fastDone := make(chan struct{})
+	go func() {
+		ds.read(fast, func(chunk string) bool {
+			fastChunks <- chunk
+			return true
+		})
+		close(fastDone)
+	}()
+
+	select {
+	case <-published:
+		t.Fatal("Expected the publisher to wait for the slow reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(fastChunks) != streamWindow {
+		t.Error("Expected", streamWindow, "chunks for the fast reader, got", len(fastChunks))
+	}
+
+	// Reading a chunk releases the publisher
+	if chunk, ok := ds.next(slow); !ok || chunk != "chunk" {
+		t.Error("Expected the first chunk, got", chunk, ok)
+	}
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the publisher to continue")
+	}
+
+	// Readers finish after the last chunk and released readers no longer hold chunks
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fast reader to finish")
+	}
+	if len(fastChunks) != streamWindow+1 {
+		t.Error("Expected", streamWindow+1, "chunks for the fast reader, got", len(fastChunks))
+	}
+	ds.release(slow)
+	if len(ds.chunks) != 0 {
+		t.Error("Expected no held chunks, got", len(ds.chunks))
+	}
+
+	// Consumers, which aren't readers of the stream, receive no chunks
+	if _, ok := ds.next(&consumer{}); ok {
+		t.Error("Expected no chunk for an unknown reader")
+	}
+
+	// Aborted streams end for their readers as well, but are marked as aborted
+	aborted := newDataStream()
+	aborted.addReader(fast)
+	aborted.publish("partial")
+	aborted.abort()
+	if !aborted.read(fast, func(chunk string) bool { return true }) || !aborted.isAborted() {
+		t.Error("Expected the aborted stream to end and to be marked as aborted")
+	}
+	if ds.isAborted() {
+		t.Error("Expected the closed stream not to be marked as aborted")
+	}
+}
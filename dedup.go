@@ -0,0 +1,67 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"time"
+)
+
+// RecentId stores an event ID and the time it was published.
+type recentId struct {
+	id        uint
+	timestamp time.Time
+}
+
+// RecentIds stores the event IDs published to a channel within the dedup window, oldest first.
+type recentIds struct {
+	ids     map[uint]bool
+	entries []recentId
+}
+
+// Expire forgets all IDs published before the given time.
+func (ri *recentIds) expire(before time.Time) {
+	n := 0
+	for n < len(ri.entries) && ri.entries[n].timestamp.Before(before) {
+		delete(ri.ids, ri.entries[n].id)
+		n++
+	}
+	ri.entries = ri.entries[n:]
+}
+
+// IsDuplicate checks whether a message with the same ID was already published to its channel within the DedupWindow.
+// Otherwise, the ID of the message is remembered. Messages without an ID are never duplicates.
+func (es *eventSource) isDuplicate(em *eventMessage) bool {
+	dedupWindow := es.currentSettings().GetDedupWindow()
+	if dedupWindow <= 0 || em.Id == 0 {
+		return false
+	}
+
+	now := time.Now()
+	recent, ok := es.recentIds[em.Channel]
+	if !ok {
+		recent = &recentIds{ids: make(map[uint]bool)}
+		es.recentIds[em.Channel] = recent
+	}
+	recent.expire(now.Add(-dedupWindow))
+
+	if recent.ids[em.Id] {
+		return true
+	}
+	recent.ids[em.Id] = true
+	recent.entries = append(recent.entries, recentId{id: em.Id, timestamp: now})
+	return false
+}
+
+// PruneRecentIds forgets the IDs published before the DedupWindow and removes channels without recent IDs,
+// so channels which are published to only once or never closed don't keep their IDs.
+func (es *eventSource) pruneRecentIds() {
+	before := time.Now().Add(-es.currentSettings().GetDedupWindow())
+	for channel, recent := range es.recentIds {
+		recent.expire(before)
+		if len(recent.entries) == 0 {
+			delete(es.recentIds, channel)
+		}
+	}
+}
@@ -5,62 +5,585 @@
 package eventsource
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Byte order mark, which is stripped from the beginning of incoming data.
+const byteOrderMark = "\uFEFF"
+
+// Suffix of the event name of messages with base64 encoded data, so clients know to decode the data.
+const base64EventSuffix = "base64"
+
+// Event stores the fields of an event, which can be sent to consumers.
+type Event struct {
+	Id       uint     `json:"id"`
+	Event    string   `json:"event"`
+	Data     string   `json:"data"`
+	Comments []string `json:"comment"`
+	TTL      uint     `json:"ttl"`
+}
+
 // EventMessage stores information of a message.
 type eventMessage struct {
-	Id      uint   `json:"id"`
-	Event   string `json:"event"`
-	Data    string `json:"data"`
-	Channel string `json:"-"`
+	Id        uint      `json:"id"`
+	Event     string    `json:"event"`
+	Data      eventData `json:"data"`
+	Comments  comments  `json:"comment"`
+	TTL       uint      `json:"ttl"`
+	Base64    string    `json:"data_base64"`
+	DeliverAt deliverAt `json:"deliver_at"`
+	Signature string    `json:"-"`
+	Channel   string    `json:"-"`
+	raw       []byte
+	rawEvents []*Event
+	batch     []*eventMessage
+	stream    *dataStream
+}
+
+// EventData stores the data of a message. Besides strings, any JSON value is accepted
+// and stored in its compact JSON representation.
+type eventData string
+
+// UnmarshalJSON decodes a string as is and any other JSON value into its compact representation.
+func (d *eventData) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*d = eventData(str)
+		return nil
+	}
+
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		*d = ""
+		return nil
+	}
+
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, data); err != nil {
+		return err
+	}
+	*d = eventData(compacted.String())
+	return nil
+}
+
+// Comments stores the comment lines of a message, which can be given as a single string or as an array.
+type comments []string
+
+// UnmarshalJSON decodes a single comment string or an array of comment strings.
+func (c *comments) UnmarshalJSON(data []byte) error {
+	var comment string
+	if err := json.Unmarshal(data, &comment); err == nil {
+		*c = comments{comment}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*c = comments(list)
+	return nil
+}
+
+// SkipByteOrderMark returns a reader, which skips a leading UTF-8 byte order mark of the given stream.
+func skipByteOrderMark(messageStream io.Reader) io.Reader {
+	reader := bufio.NewReader(messageStream)
+	if prefix, err := reader.Peek(len(byteOrderMark)); err == nil && string(prefix) == byteOrderMark {
+		reader.Discard(len(byteOrderMark))
+	}
+	return reader
+}
+
+// Validate strips a leading byte order mark from the data and ensures that the event name, data and comments
+// are valid UTF-8, as event streams are always decoded as UTF-8. Base64 encoded data is decoded as well.
+func (em *eventMessage) validate() error {
+	if err := em.decodeBase64(); err != nil {
+		return err
+	}
+
+	em.Data = eventData(strings.TrimPrefix(string(em.Data), byteOrderMark))
+
+	if !utf8.ValidString(em.Event) || !utf8.ValidString(string(em.Data)) {
+		return errInvalidEncoding
+	}
+	for _, comment := range em.Comments {
+		if !utf8.ValidString(comment) {
+			return errInvalidEncoding
+		}
+	}
+	return nil
+}
+
+// DecodeBase64 validates binary data given as 'data_base64' and turns it into the data of the message.
+// The data is sent in its standard base64 encoding and the event name is suffixed with '+base64', or named 'base64'
+// if it's omitted, so clients know to decode the data. Messages can't contain both, 'data' and 'data_base64'.
+func (em *eventMessage) decodeBase64() error {
+	if len(em.Base64) == 0 {
+		return nil
+	}
+
+	if len(em.Data) > 0 {
+		return errInvalidBase64
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(em.Base64)
+	if err != nil {
+		return errInvalidBase64
+	}
+
+	em.Data = eventData(base64.StdEncoding.EncodeToString(decoded))
+	em.Base64 = ""
+	if len(em.Event) > 0 {
+		em.Event += "+" + base64EventSuffix
+	} else {
+		em.Event = base64EventSuffix
+	}
+	return nil
+}
+
+// ExceedsDataSize checks whether the data of a message, or of any message of a batch, is larger than maxDataBytes.
+// Pre-formatted event streams are checked as a whole. A maxDataBytes of 0 means that the size is unlimited.
+func (em *eventMessage) exceedsDataSize(maxDataBytes int) bool {
+	if maxDataBytes <= 0 {
+		return false
+	}
+
+	if em.raw != nil {
+		return len(em.raw) > maxDataBytes
+	}
+
+	for _, bm := range em.batch {
+		if bm.exceedsDataSize(maxDataBytes) {
+			return true
+		}
+	}
+	return len(em.Data) > maxDataBytes
+}
+
+// JSONDecoding stores how strictly published JSON is decoded.
+type jsonDecoding struct {
+	disallowUnknownFields bool
+}
+
+// Decoder returns a JSON decoder for the given stream, which is set up according to the jsonDecoding.
+func (jd jsonDecoding) decoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if jd.disallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	return dec
+}
+
+// DecodeError turns an error of the JSON decoder into an error wrapping ErrParse.
+// Other errors than unknown fields are located within the decoded data by a jsonError.
+func decodeError(err error, data []byte) error {
+	// encoding/json has no error type for unknown fields, its message is the only signal.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fmt.Errorf("%w %s", errUnknownField, field)
+	}
+
+	offset := int64(len(data))
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) {
+		offset = syntaxError.Offset
+	} else if errors.As(err, &typeError) {
+		offset = typeError.Offset
+	}
+	return newJSONError(err, data, offset)
+}
+
+// JSONError is returned if the JSON of an event can't be parsed. Like for the errors of encoding/json,
+// the offset is the number of bytes read when the problem was detected. Line and column, both counted from 1,
+// locate the last byte read, which is the invalid character for syntax errors.
+type jsonError struct {
+	Message string `json:"error"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Offset  int64  `json:"offset"`
+	err     error
+}
+
+// NewJSONError builds and returns a jsonError for the error at the given offset of the data.
+func newJSONError(err error, data []byte, offset int64) *jsonError {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:max(offset-1, 0)]
+	return &jsonError{
+		Message: err.Error(),
+		Line:    bytes.Count(before, []byte("\n")) + 1,
+		Column:  len(before) - bytes.LastIndexByte(before, '\n'),
+		Offset:  offset,
+		err:     err,
+	}
+}
+
+// Error returns the description of a jsonError.
+func (e *jsonError) Error() string {
+	return fmt.Sprintf("invalid JSON at line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Unwrap returns ErrParse and the cause of a jsonError.
+func (e *jsonError) Unwrap() []error {
+	return []error{ErrParse, e.err}
 }
 
 // NewEventMessage builds and returns a new eventMessage based on the given JSON data stream.
+// A leading byte order mark is skipped, invalid UTF-8 causes an error.
 func newEventMessage(messageStream io.Reader, channel string) (*eventMessage, error) {
+	return decodeEventMessage(messageStream, channel, jsonDecoding{})
+}
+
+// DecodeEventMessage builds and returns a new eventMessage based on the given JSON data stream, decoded as strict as requested.
+// The stream contains a single event, so any data after the first JSON object causes an error,
+// instead of merging several objects into one event. Several events are published as JSON lines batch.
+func decodeEventMessage(messageStream io.Reader, channel string, jd jsonDecoding) (*eventMessage, error) {
 	var em eventMessage
-	dec := json.NewDecoder(messageStream)
+	var consumed bytes.Buffer
+	dec := jd.decoder(io.TeeReader(skipByteOrderMark(messageStream), &consumed))
+	if err := dec.Decode(&em); err != nil && err != io.EOF {
+		return nil, decodeError(err, consumed.Bytes())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errTrailingData
+	}
+
+	// Invalid UTF-8 within strings is replaced by encoding/json, so it's only detected in the raw body.
+	if !utf8.Valid(consumed.Bytes()) {
+		return nil, errInvalidEncoding
+	}
+
+	if err := em.validate(); err != nil {
+		return nil, err
+	}
+
+	em.Channel = channelOrDefault(channel)
+
+	return &em, nil
+}
+
+// RemapFields renames the keys of the JSON objects of a stream according to the given field mapping,
+// e.g. {"type": "event", "payload": "data"}, so producers with other field names can publish events.
+// Mapped keys take precedence over keys of the same name. Each object is written on its own line,
+// so single events and JSON lines batches are remapped alike. Without a field mapping, the stream is returned as it is.
+// If the stream can't be parsed, it's returned unchanged, so it fails with the usual errors.
+func remapFields(messageStream io.Reader, fieldMapping map[string]string) (io.Reader, error) {
+	if len(fieldMapping) == 0 {
+		return messageStream, nil
+	}
+
+	data, err := io.ReadAll(messageStream)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) {
+		return bytes.NewReader(data), nil
+	}
+
+	var remapped bytes.Buffer
+	dec := json.NewDecoder(skipByteOrderMark(bytes.NewReader(data)))
 	for {
-		if err := dec.Decode(&em); err == io.EOF {
+		var fields map[string]json.RawMessage
+		if err := dec.Decode(&fields); err == io.EOF {
 			break
 		} else if err != nil {
+			return bytes.NewReader(data), nil
+		}
+
+		mapped := make(map[string]json.RawMessage, len(fields))
+		for key, value := range fields {
+			if _, ok := fieldMapping[key]; !ok {
+				mapped[key] = value
+			}
+		}
+		for key, value := range fields {
+			if target, ok := fieldMapping[key]; ok {
+				mapped[target] = value
+			}
+		}
+
+		line, err := json.Marshal(mapped)
+		if err != nil {
 			return nil, err
 		}
+		remapped.Write(line)
+		remapped.WriteByte('\n')
+	}
+	return &remapped, nil
+}
+
+// NewRawEventMessage builds and returns a new eventMessage based on a pre-formatted event stream.
+// The event stream is relayed verbatim and needs to end with a blank line.
+// A leading byte order mark is skipped, invalid UTF-8 causes an error.
+func newRawEventMessage(messageStream io.Reader, channel string) (*eventMessage, error) {
+	raw, err := io.ReadAll(skipByteOrderMark(messageStream))
+	if err != nil {
+		return nil, err
+	}
+
+	if !utf8.Valid(raw) {
+		return nil, errInvalidEncoding
+	}
+
+	if len(bytes.TrimSpace(raw)) == 0 || !(bytes.HasSuffix(raw, []byte("\n\n")) || bytes.HasSuffix(raw, []byte("\r\n\r\n")) || bytes.HasSuffix(raw, []byte("\r\r"))) {
+		return nil, errInvalidRawMessage
+	}
+
+	return &eventMessage{
+		Channel:   channelOrDefault(channel),
+		raw:       raw,
+		rawEvents: parseEventStream(raw),
+	}, nil
+}
+
+// ParseEventStream parses the events of a pre-formatted event stream like browsers do, so the events of raw messages
+// can be passed to in-process, WebSocket and long polling consumers. Only blocks with at least one 'data' line
+// result in an event. IDs which aren't numeric are ignored, as well as 'retry' fields.
+func parseEventStream(raw []byte) []*Event {
+	var events []*Event
+	var e Event
+	var data []string
+	for _, line := range splitLines(string(raw)) {
+		if len(line) == 0 {
+			if data != nil {
+				dispatched := e
+				dispatched.Data = strings.Join(data, "\n")
+				events = append(events, &dispatched)
+			}
+			e, data = Event{}, nil
+			continue
+		}
+
+		if comment, ok := strings.CutPrefix(line, ":"); ok {
+			e.Comments = append(e.Comments, strings.TrimPrefix(comment, " "))
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			if id, err := strconv.ParseUint(value, 10, 0); err == nil {
+				e.Id = uint(id)
+			}
+		case "event":
+			e.Event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return events
+}
+
+// LineError is returned if a line of a JSON lines batch can't be parsed.
+type lineError struct {
+	line int
+	err  error
+}
+
+// Error returns the description of a lineError.
+func (e *lineError) Error() string {
+	return fmt.Sprintf("invalid event on line %d: %s", e.line, e.err)
+}
+
+// Unwrap returns ErrParse and the cause of a lineError.
+func (e *lineError) Unwrap() []error {
+	return []error{ErrParse, e.err}
+}
+
+// NewEventMessages builds and returns eventMessages based on the given JSON lines stream, one event per line.
+// Empty lines are skipped. If any line can't be parsed, a lineError is returned and no message at all,
+// so a batch is either published completely or not at all.
+func newEventMessages(messageStream io.Reader, channel string) ([]*eventMessage, error) {
+	return decodeEventMessages(messageStream, channel, jsonDecoding{})
+}
+
+// DecodeEventMessages builds and returns eventMessages based on the given JSON lines stream, decoded as strict as requested.
+// Each line contains a single object anyway, so only unknown fields are subject to the jsonDecoding.
+func decodeEventMessages(messageStream io.Reader, channel string, jd jsonDecoding) ([]*eventMessage, error) {
+	var messages []*eventMessage
+
+	reader := bufio.NewReader(skipByteOrderMark(messageStream))
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(data)) > 0 {
+			if !utf8.Valid(data) {
+				return nil, &lineError{line: line, err: errInvalidEncoding}
+			}
+
+			var em eventMessage
+			if err := jd.decoder(bytes.NewReader(data)).Decode(&em); err != nil {
+				return nil, &lineError{line: line, err: decodeError(err, data)}
+			}
+			if err := em.validate(); err != nil {
+				return nil, &lineError{line: line, err: err}
+			}
+			if !em.DeliverAt.IsZero() {
+				return nil, &lineError{line: line, err: errDeliverAtInBatch}
+			}
+			em.Channel = channelOrDefault(channel)
+			messages = append(messages, &em)
+		}
+
+		if err == io.EOF {
+			return messages, nil
+		}
 	}
+}
 
+// EventMessageFromEvent builds and returns a new eventMessage based on the given event.
+func eventMessageFromEvent(e *Event, channel string) *eventMessage {
+	return &eventMessage{
+		Id:       e.Id,
+		Event:    e.Event,
+		Data:     eventData(e.Data),
+		Comments: comments(e.Comments),
+		TTL:      e.TTL,
+		Channel:  channelOrDefault(channel),
+	}
+}
+
+// Event returns the event of an eventMessage.
+func (em *eventMessage) event() *Event {
+	return &Event{
+		Id:       em.Id,
+		Event:    em.Event,
+		Data:     string(em.Data),
+		Comments: []string(em.Comments),
+		TTL:      em.TTL,
+	}
+}
+
+// Events returns the events of an eventMessage, which are several for a batch.
+// Raw messages return the events parsed from their event stream, which may be none.
+func (em *eventMessage) events() []*Event {
+	if em.batch == nil {
+		if em.raw != nil {
+			return em.rawEvents
+		}
+		return []*Event{em.event()}
+	}
+
+	events := make([]*Event, 0, len(em.batch))
+	for _, bm := range em.batch {
+		events = append(events, bm.event())
+	}
+	return events
+}
+
+// ChannelOrDefault returns the given channel name or 'default' if it's omitted.
+func channelOrDefault(channel string) string {
 	if channel == "" {
-		em.Channel = "default"
-	} else {
-		em.Channel = channel
+		return "default"
 	}
+	return channel
+}
 
-	return &em, nil
+// Sign computes the HMAC-SHA256 signature of a message with the given key.
+// The signature covers the ID (empty if omitted), the sanitized event name and the data, each separated by a newline.
+func (em *eventMessage) sign(key string) {
+	var id string
+	if em.Id > 0 {
+		id = strconv.FormatUint(uint64(em.Id), 10)
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(id + "\n" + sanitizeEventName(em.Event) + "\n" + string(em.Data)))
+	em.Signature = hex.EncodeToString(mac.Sum(nil))
+}
+
+// SanitizeEventName removes control characters, like carriage returns and newlines, and colons from an event name,
+// which would break the framing of the event stream. Surrounding whitespace is trimmed.
+func sanitizeEventName(eventName string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == ':' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, eventName))
+}
+
+// SplitLines splits a field value at all line endings, i.e. '\r\n', '\r' and '\n',
+// as consumers treat each of them as the end of a field.
+func splitLines(value string) []string {
+	return strings.Split(strings.ReplaceAll(strings.ReplaceAll(value, "\r\n", "\n"), "\r", "\n"), "\n")
+}
+
+// FrameLines returns the data with all line endings, i.e. '\r\n', '\r' and '\n', replaced by the given line ending.
+// The default line ending '\n' leaves the data as it is.
+func frameLines(data []byte, lineEnding string) []byte {
+	if lineEnding == "\n" {
+		return data
+	}
+
+	var framed bytes.Buffer
+	framed.Grow(len(data) + len(data)/16)
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\r':
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+			framed.WriteString(lineEnding)
+		case '\n':
+			framed.WriteString(lineEnding)
+		default:
+			framed.WriteByte(data[i])
+		}
+	}
+	return framed.Bytes()
 }
 
 // Message formats a []byte message which is finally sent to the consumers of a channel.
 // Empty fields or fields that does not match the standard are removed.
+// The ID is always numeric, the event name is sanitized.
+// Pre-formatted event streams are returned as they are.
 func (em *eventMessage) Message() []byte {
+	if em.raw != nil {
+		return em.raw
+	}
+
 	var messageData bytes.Buffer
 
+	for _, comment := range em.Comments {
+		for _, line := range splitLines(comment) {
+			messageData.WriteString(fmt.Sprintf(": %s\n", line))
+		}
+	}
+
 	if em.Id > 0 {
 		messageData.WriteString(fmt.Sprintf("id: %d\n", em.Id))
 	}
 
-	if len(em.Event) > 0 {
-		messageData.WriteString(fmt.Sprintf("event: %s\n", strings.Replace(em.Event, "\n", "", -1)))
+	if eventName := sanitizeEventName(em.Event); len(eventName) > 0 {
+		messageData.WriteString(fmt.Sprintf("event: %s\n", eventName))
 	}
 
 	if len(em.Data) > 0 {
-		lines := strings.Split(em.Data, "\n")
-		for _, line := range lines {
+		for _, line := range splitLines(string(em.Data)) {
 			messageData.WriteString(fmt.Sprintf("data: %s\n", line))
 		}
 	}
 
+	if len(em.Signature) > 0 {
+		messageData.WriteString(fmt.Sprintf("signature: %s\n", em.Signature))
+	}
+
 	messageData.WriteString("\n")
 	return messageData.Bytes()
 }
@@ -6,6 +6,11 @@ package eventsource
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io"
 	"strings"
 	"testing"
@@ -155,3 +160,413 @@ func TestByteMesssage(t *testing.T) {
 		}
 	}
 }
+
+func TestEventMessageFromEvent(t *testing.T) {
+	em, _ := buildEventMessage(ModeAll, "my-channel")
+	ev := eventMessageFromEvent(&Event{Id: 1, Event: "foo", Data: "bar"}, "my-channel")
+
+	if !bytes.Equal(em.Message(), ev.Message()) {
+		t.Error("Byte Message of an Event differs from the one of JSON data")
+	}
+
+	if ev := eventMessageFromEvent(&Event{Data: "bar"}, ""); ev.Channel != "default" {
+		t.Error("Expected 'default' on empty channel argument, got", ev.Channel)
+	}
+}
+
+func TestCommentMessage(t *testing.T) {
+	em, err := newEventMessage(strings.NewReader("{\"comment\":\"keepalive\"}"), "my-channel")
+	if err != nil {
+		t.Fatal("Unable build EventMessage with a single comment", err)
+	}
+
+	if !bytes.Equal(em.Message(), []byte(": keepalive\n\n")) {
+		t.Errorf("Comment-only Byte Message is malformed: %q", em.Message())
+	}
+
+	em, err = newEventMessage(strings.NewReader("{\"id\":1,\"data\":\"bar\",\"comment\":[\"foo\",\"baz\"]}"), "my-channel")
+	if err != nil {
+		t.Fatal("Unable build EventMessage with a list of comments", err)
+	}
+
+	if !bytes.Equal(em.Message(), []byte(": foo\n: baz\nid: 1\ndata: bar\n\n")) {
+		t.Errorf("Byte Message with comments is malformed: %q", em.Message())
+	}
+
+	if _, err := newEventMessage(strings.NewReader("{\"comment\":1}"), "my-channel"); err == nil {
+		t.Error("Expected an error on a non-string comment")
+	}
+
+	ev := eventMessageFromEvent(&Event{Comments: []string{"line1\nline2"}}, "my-channel")
+	if !bytes.Equal(ev.Message(), []byte(": line1\n: line2\n\n")) {
+		t.Errorf("Multiline comment of an Event is malformed: %q", ev.Message())
+	}
+
+	// Carriage returns end lines as well, so they can't inject fields
+	em, err = newEventMessage(strings.NewReader("{\"comment\":\"x\\rdata: evil\",\"data\":\"a\\rid: 5\\r\\nb\"}"), "my-channel")
+	if err != nil {
+		t.Fatal("Unable build EventMessage with carriage returns", err)
+	}
+
+	if !bytes.Equal(em.Message(), []byte(": x\n: data: evil\ndata: a\ndata: id: 5\ndata: b\n\n")) {
+		t.Errorf("Byte Message with carriage returns is malformed: %q", em.Message())
+	}
+}
+
+func TestStructuredData(t *testing.T) {
+	structuredData := map[string]string{
+		"{\"data\":{\"key\": \"value\"}}": "{\"key\":\"value\"}",
+		"{\"data\":[1, 2, 3]}":            "[1,2,3]",
+		"{\"data\":42}":                   "42",
+		"{\"data\":true}":                 "true",
+		"{\"data\":null}":                 "",
+		"{\"data\":\"{\\\"key\\\":1}\"}":  "{\"key\":1}",
+	}
+
+	for messageStream, expectedData := range structuredData {
+		em, err := newEventMessage(strings.NewReader(messageStream), "my-channel")
+		if err != nil {
+			t.Error("Unable build EventMessage from", messageStream, err)
+			continue
+		}
+
+		if string(em.Data) != expectedData {
+			t.Errorf("Expected '%s' got '%s'", expectedData, em.Data)
+		}
+	}
+
+	em, _ := newEventMessage(strings.NewReader("{\"data\":{\"key\":\"value\"}}"), "my-channel")
+	if !bytes.Equal(em.Message(), []byte("data: {\"key\":\"value\"}\n\n")) {
+		t.Errorf("Byte Message with structured data is malformed: %q", em.Message())
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	em := eventMessageFromEvent(&Event{Id: 1, Event: "foo", Data: "bar\nbaz"}, "my-channel")
+	em.sign("secret")
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1\nfoo\nbar\nbaz"))
+	expectedSignature := hex.EncodeToString(mac.Sum(nil))
+
+	if em.Signature != expectedSignature {
+		t.Errorf("Expected signature '%s', got '%s'", expectedSignature, em.Signature)
+	}
+
+	if !bytes.Contains(em.Message(), []byte("data: baz\nsignature: "+expectedSignature+"\n\n")) {
+		t.Errorf("Byte Message of a signed message is malformed: %q", em.Message())
+	}
+
+	// Messages without an ID use an empty ID
+	em = eventMessageFromEvent(&Event{Data: "bar"}, "my-channel")
+	em.sign("secret")
+
+	mac = hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("\n\nbar"))
+	if expectedSignature := hex.EncodeToString(mac.Sum(nil)); em.Signature != expectedSignature {
+		t.Errorf("Expected signature '%s', got '%s'", expectedSignature, em.Signature)
+	}
+}
+
+func TestRawEventMessage(t *testing.T) {
+	raw := "id: 7\nevent: foo\ndata: bar\n\nretry: 1000\n\n"
+	em, err := newRawEventMessage(strings.NewReader(raw), "my-channel")
+	if err != nil {
+		t.Fatal("Unable build raw EventMessage", err)
+	}
+
+	if !bytes.Equal(em.Message(), []byte(raw)) {
+		t.Errorf("Expected raw message to be relayed verbatim, got %q", em.Message())
+	}
+
+	if em.Channel != "my-channel" {
+		t.Error("Expected 'my-channel' got", em.Channel)
+	}
+
+	// The events are parsed for consumers, which don't receive the event stream, blocks without data result in none
+	if events := em.events(); len(events) != 1 || events[0].Id != 7 || events[0].Event != "foo" || events[0].Data != "bar" {
+		t.Error("Expected the parsed event, got", events)
+	}
+
+	for _, invalid := range []string{"", "\n\n", "data: bar\n", "data: bar"} {
+		if _, err := newRawEventMessage(strings.NewReader(invalid), "my-channel"); err != errInvalidRawMessage {
+			t.Errorf("Expected errInvalidRawMessage for %q, got %v", invalid, err)
+		}
+	}
+
+	if _, err := newRawEventMessage(strings.NewReader("data: bar\r\n\r\n"), "my-channel"); err != nil {
+		t.Error("Expected CRLF line endings to be accepted, got", err)
+	}
+}
+
+func TestParseEventStream(t *testing.T) {
+	raw := ": note\nid: 3\nevent: update\ndata: first\ndata:second\n\nid: 4\n\nid: x\ndata\r\n\r\n"
+	events := parseEventStream([]byte(raw))
+	if len(events) != 2 {
+		t.Fatal("Expected 2 events, got", len(events))
+	}
+
+	if e := events[0]; e.Id != 3 || e.Event != "update" || e.Data != "first\nsecond" || len(e.Comments) != 1 || e.Comments[0] != "note" {
+		t.Error("Expected the first event, got", e)
+	}
+
+	// Non-numeric IDs are ignored, a 'data' line without colon adds an empty line
+	if e := events[1]; e.Id != 0 || e.Event != "" || e.Data != "" {
+		t.Error("Expected an event with empty data, got", e)
+	}
+}
+
+func TestSanitizeEventName(t *testing.T) {
+	eventNames := map[string]string{
+		"foo":                   "foo",
+		" foo ":                 "foo",
+		"\tfoo\n":               "foo",
+		"foo\r\ndata: injected": "foodata injected",
+		"foo\rid: 42":           "fooid 42",
+		"foo:bar":               "foobar",
+		"foo\x00\x1b[31mbar":    "foo[31mbar",
+		" \r\n ":                "",
+	}
+
+	for eventName, expected := range eventNames {
+		if sanitized := sanitizeEventName(eventName); sanitized != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, eventName, sanitized)
+		}
+	}
+
+	// Adversarial event names can't inject additional fields
+	em := eventMessageFromEvent(&Event{Id: 1, Event: " foo\r\ndata: injected\r\n\r\n", Data: "bar"}, "my-channel")
+	if !bytes.Equal(em.Message(), []byte("id: 1\nevent: foodata injected\ndata: bar\n\n")) {
+		t.Errorf("Byte Message with an adversarial event name is malformed: %q", em.Message())
+	}
+
+	// Event names which consist of whitespace only are omitted
+	em = eventMessageFromEvent(&Event{Event: " \n ", Data: "bar"}, "my-channel")
+	if !bytes.Equal(em.Message(), []byte("data: bar\n\n")) {
+		t.Errorf("Byte Message with a blank event name is malformed: %q", em.Message())
+	}
+}
+
+func TestByteOrderMark(t *testing.T) {
+	em, err := newEventMessage(strings.NewReader("\uFEFF{\"data\":\"\uFEFFhello\"}"), "default")
+	if err != nil {
+		t.Fatal("Unable to create event message with byte order mark", err)
+	}
+
+	if em.Data != "hello" {
+		t.Error("Expected the byte order mark to be stripped, got", []byte(em.Data))
+	}
+
+	em, err = newRawEventMessage(strings.NewReader("\uFEFFdata: hello\n\n"), "default")
+	if err != nil {
+		t.Fatal("Unable to create raw event message with byte order mark", err)
+	}
+
+	if string(em.Message()) != "data: hello\n\n" {
+		t.Error("Expected the byte order mark to be stripped, got", em.Message())
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	for _, invalid := range []string{
+		"{\"data\":{\"key\":\"\xff\xfe\"}}",
+		"{\"data\":[\"\xc3\x28\"]}",
+		"{\"data\":\"valid\xff\"}",
+		"{\"event\":\"\xc0\xaf\",\"data\":\"valid\"}",
+	} {
+		if _, err := newEventMessage(strings.NewReader(invalid), "default"); err != errInvalidEncoding {
+			t.Errorf("Expected errInvalidEncoding for %q, got %v", invalid, err)
+		}
+	}
+
+	for _, em := range []*eventMessage{
+		{Event: "\xff"},
+		{Data: "valid\xe2\x82"},
+		{Comments: comments{"\xc0\xaf"}},
+	} {
+		if err := em.validate(); err != errInvalidEncoding {
+			t.Errorf("Expected errInvalidEncoding for %+v, got %v", em, err)
+		}
+	}
+
+	if _, err := newRawEventMessage(strings.NewReader("data: \xff\n\n"), "default"); err != errInvalidEncoding {
+		t.Error("Expected errInvalidEncoding for raw event stream, got", err)
+	}
+
+	if _, err := newEventMessages(strings.NewReader("{\"data\":\"valid\"}\n{\"data\":{\"key\":\"\xff\"}}\n"), "default"); err == nil {
+		t.Error("Expected an error for invalid UTF-8 in a batch")
+	}
+
+	if _, err := newEventMessages(strings.NewReader("{\"data\":\"valid\"}\n{\"data\":\"\xff\"}\n"), "default"); !errors.Is(err, errInvalidEncoding) {
+		t.Error("Expected errInvalidEncoding for invalid UTF-8 in string data of a batch, got", err)
+	}
+}
+
+func TestExceedsDataSize(t *testing.T) {
+	em := &eventMessage{Data: "12345"}
+	if em.exceedsDataSize(0) || em.exceedsDataSize(5) || !em.exceedsDataSize(4) {
+		t.Error("Unexpected data size check of", em.Data)
+	}
+
+	batch := &eventMessage{batch: []*eventMessage{{Data: "1"}, {Data: "12345"}}}
+	if !batch.exceedsDataSize(4) {
+		t.Error("Expected a batch with an oversized message to exceed the data size")
+	}
+
+	raw := &eventMessage{raw: []byte("data: 1\n\n")}
+	if !raw.exceedsDataSize(4) {
+		t.Error("Expected an oversized event stream to exceed the data size")
+	}
+}
+
+func TestBase64Data(t *testing.T) {
+	blob := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, '\n', 0xfe}
+	encoded := base64.StdEncoding.EncodeToString(blob)
+
+	em, err := newEventMessage(strings.NewReader(`{"event":"thumbnail","data_base64":"`+encoded+`"}`), "default")
+	if err != nil {
+		t.Fatal("Unable to create event message", err)
+	}
+
+	message := string(em.Message())
+	if message != "event: thumbnail+base64\ndata: "+encoded+"\n\n" {
+		t.Error("Expected the encoded data and the marked event name, got", message)
+	}
+
+	// The data line decodes to the original bytes
+	data := strings.TrimSuffix(strings.TrimPrefix(message[strings.Index(message, "data: "):], "data: "), "\n\n")
+	if decoded, err := base64.StdEncoding.DecodeString(data); err != nil || !bytes.Equal(decoded, blob) {
+		t.Error("Expected the data to round-trip, got", decoded, err)
+	}
+
+	// Without an event name, the event is named after the encoding
+	messages, err := newEventMessages(strings.NewReader(`{"data_base64":"`+encoded+`"}`), "default")
+	if err != nil || len(messages) != 1 || messages[0].Event != "base64" {
+		t.Error("Expected a batch event named 'base64', got", messages, err)
+	}
+
+	for _, invalid := range []string{
+		`{"data_base64":"not base64!"}`,
+		`{"data":"text","data_base64":"` + encoded + `"}`,
+	} {
+		if _, err := newEventMessage(strings.NewReader(invalid), "default"); err != errInvalidBase64 {
+			t.Errorf("Expected errInvalidBase64 for %s, got %v", invalid, err)
+		}
+	}
+}
+
+func TestRemapFields(t *testing.T) {
+	fieldMapping := map[string]string{"type": "event", "payload": "data"}
+
+	messageStream, err := remapFields(strings.NewReader(`{"id":1,"type":"x","payload":{"key":"y"},"event":"ignored"}`), fieldMapping)
+	if err != nil {
+		t.Fatal("Unable to remap fields", err)
+	}
+
+	em, err := newEventMessage(messageStream, "default")
+	if err != nil {
+		t.Fatal("Unable to create event message", err)
+	}
+	if em.Id != 1 || em.Event != "x" || em.Data != `{"key":"y"}` {
+		t.Error("Expected mapped fields to take precedence, got", em)
+	}
+
+	// Batches are remapped line by line
+	messageStream, _ = remapFields(strings.NewReader("{\"type\":\"a\"}\n\n{\"type\":\"b\"}\n"), fieldMapping)
+	if messages, err := newEventMessages(messageStream, "default"); err != nil || len(messages) != 2 || messages[1].Event != "b" {
+		t.Error("Expected 2 remapped messages, got", messages, err)
+	}
+
+	// Streams which can't be parsed are left unchanged
+	messageStream, _ = remapFields(strings.NewReader("{\"type\":\"a\"}\n{\"type\":\n"), fieldMapping)
+	if _, err := newEventMessages(messageStream, "default"); err == nil {
+		t.Error("Expected an invalid batch to be rejected")
+	} else if lineErr, ok := err.(*lineError); !ok || lineErr.line != 2 {
+		t.Error("Expected an error on line 2, got", err)
+	}
+}
+
+func TestFrameLines(t *testing.T) {
+	data := []byte("id: 1\ndata: a\r\ndata: b\r\n\n")
+
+	if framed := frameLines(data, "\n"); string(framed) != string(data) {
+		t.Error("Expected the default line ending to leave the data unchanged, got", framed)
+	}
+	if framed := frameLines(data, "\r\n"); string(framed) != "id: 1\r\ndata: a\r\ndata: b\r\n\r\n" {
+		t.Errorf("Expected all lines to end with CRLF, got %q", framed)
+	}
+	if framed := frameLines(data, "\r"); string(framed) != "id: 1\rdata: a\rdata: b\r\r" {
+		t.Errorf("Expected all lines to end with CR, got %q", framed)
+	}
+}
+
+func TestDecodeEventMessageStrictness(t *testing.T) {
+	// By default, unknown fields are ignored
+	if _, err := newEventMessage(strings.NewReader(`{"data":"a","unknown":1}`), "default"); err != nil {
+		t.Error("Expected unknown fields to be ignored, got", err)
+	}
+
+	strict := jsonDecoding{disallowUnknownFields: true}
+	if _, err := decodeEventMessage(strings.NewReader(`{"data":"a","unknown":1}`), "default", strict); !errors.Is(err, errUnknownField) {
+		t.Error("Expected errUnknownField, got", err)
+	}
+	if _, err := decodeEventMessages(strings.NewReader("{\"data\":\"a\"}\n{\"unknown\":1}\n"), "default", strict); !errors.Is(err, errUnknownField) {
+		t.Error("Expected errUnknownField for a batch, got", err)
+	} else if lineErr, ok := err.(*lineError); !ok || lineErr.line != 2 {
+		t.Error("Expected an error on line 2, got", err)
+	}
+
+}
+
+func TestNewEventMessageSingleObject(t *testing.T) {
+	// Several objects aren't merged into a single event
+	for _, invalid := range []string{`{"id":1,"data":"a"}{"id":2,"event":"b"}`, "{\"data\":\"a\"}\n{\"data\":\"b\"}\n", `{"data":"a"} trailing`, "{\"data\":\"a\"}\n[]"} {
+		if em, err := newEventMessage(strings.NewReader(invalid), "default"); err != errTrailingData {
+			t.Errorf("Expected errTrailingData for %q, got %v and %+v", invalid, err, em)
+		}
+	}
+
+	if em, err := newEventMessage(strings.NewReader("{\"data\":\"a\"}\n \n"), "default"); err != nil || em.Data != "a" {
+		t.Error("Expected trailing whitespace to be accepted, got", em, err)
+	}
+	if em, err := newEventMessage(strings.NewReader(""), "default"); err != nil || em.Channel != "default" {
+		t.Error("Expected an empty body to be accepted as before, got", em, err)
+	}
+}
+
+func TestNewEventMessages(t *testing.T) {
+	messages, err := newEventMessages(strings.NewReader("{\"id\":1,\"data\":\"first\"}\n\n{\"id\":2,\"data\":\"second\"}"), "")
+	if err != nil {
+		t.Fatal("Unable to create event messages", err)
+	}
+
+	if len(messages) != 2 || messages[0].Id != 1 || messages[1].Data != "second" || messages[1].Channel != "default" {
+		t.Error("Expected 2 messages in order, got", messages)
+	}
+
+	// Invalid lines are reported with their line number
+	_, err = newEventMessages(strings.NewReader("{\"id\":1}\n{\"id\":\n{\"id\":3}\n"), "default")
+	if lineErr, ok := err.(*lineError); !ok || lineErr.line != 2 {
+		t.Error("Expected an error on line 2, got", err)
+	}
+}
+
+func TestJSONError(t *testing.T) {
+	for data, expected := range map[string]jsonError{
+		`{"data":}`:               {Line: 1, Column: 9, Offset: 9},
+		"{\n  \"id\": \"one\"\n}": {Line: 2, Column: 13, Offset: 15},
+		`{"event":"foo"`:          {Line: 1, Column: 14, Offset: 14},
+		"{\"data\":\"a\",\n\n!}":  {Line: 3, Column: 1, Offset: 15},
+	} {
+		_, err := newEventMessage(strings.NewReader(data), "default")
+
+		var jsonErr *jsonError
+		if !errors.As(err, &jsonErr) || !errors.Is(err, ErrParse) {
+			t.Errorf("Expected jsonError for %q, got %v", data, err)
+			continue
+		}
+		if jsonErr.Line != expected.Line || jsonErr.Column != expected.Column || jsonErr.Offset != expected.Offset {
+			t.Errorf("Expected line %d, column %d, offset %d for %q, got %v", expected.Line, expected.Column, expected.Offset, data, jsonErr)
+		}
+	}
+}
@@ -5,43 +5,261 @@
 package eventsource
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
-	globalChannel = "all"
+	channelPattern = "[a-z0-9-_]+"
+	channelRoute   = "/{channel:" + channelPattern + "}"
+	healthRoute    = "/healthz"
+	broadcastRoute = "/broadcast"
+)
+
+// Maximum interval in which the history and the recent event IDs are pruned.
+const maxPruneInterval = time.Minute
+
+// Format of the timestamps injected into messages, which is RFC3339 with milliseconds.
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// ChannelNameRegexp matches valid channel names.
+var channelNameRegexp = regexp.MustCompile("^" + channelPattern + "$")
+
+// Names of routes besides channels, which are reserved and can't be used as channel names.
+var reservedChannelNames = map[string]bool{
+	strings.TrimPrefix(healthRoute, "/"):    true,
+	strings.TrimPrefix(broadcastRoute, "/"): true,
+}
+
+// Errors returned by EventSource, which callers are able to check via errors.Is.
+var (
+	// ErrStopped is returned when the EventSource service has already been stopped.
+	ErrStopped = errors.New("eventsource: service stopped")
+
+	// ErrInvalidChannel is returned for invalid channel names and for the global channel, where it's not allowed.
+	ErrInvalidChannel = errors.New("eventsource: invalid channel name")
+
+	// ErrParse is returned when a message can't be parsed. The returned errors wrap it along with the cause.
+	ErrParse = errors.New("eventsource: unable to parse message")
+
+	// ErrUnknownConsumer is returned when an event is sent to a consumer, which isn't connected (anymore).
+	ErrUnknownConsumer = errors.New("eventsource: unknown consumer")
+)
+
+// Errors returned by the dispatcher when a consumer gets rejected.
+var (
+	errMaxConsumersReached  = errors.New("maximum number of consumers reached")
+	errStreamingUnsupported = errors.New("streaming unsupported")
+	errChannelDraining      = errors.New("channel is draining")
+	errUnknownChannel       = errors.New("unknown channel")
+	errTooManyConnections   = errors.New("too many connections")
+	errInvalidRawMessage    = fmt.Errorf("%w: invalid event stream", ErrParse)
+	errInvalidEncoding      = fmt.Errorf("%w: invalid UTF-8", ErrParse)
+	errDataTooLarge         = errors.New("data too large")
+	errInvalidBase64        = fmt.Errorf("%w: invalid base64 data", ErrParse)
+	errUnknownField         = fmt.Errorf("%w: unknown field", ErrParse)
+	errTrailingData         = fmt.Errorf("%w: data after the JSON object", ErrParse)
+	errConsumerBusy         = errors.New("consumer doesn't keep up")
 )
 
 // Interface of EventSource
 type EventSource interface {
 	Router() *mux.Router
-	SendMessage(io.Reader, string)
+	SendMessage(io.Reader, string) error
+	SendMessageCount(messageStream io.Reader, channel string) (int, error)
+	SendEvent(e Event, channel string) error
+	SendToConsumer(id string, e Event) error
+	Broadcast(messageStream io.Reader, channels []string) error
+	Subscribe(channel string) (<-chan *Event, func())
+	SubscribeAck(channel string) (<-chan *AckableEvent, func())
 	ChannelExists(channel string) bool
 	ConsumerCount(channel string) int
 	ConsumerCountAll() int
+	ConsumerInfo(channel string) []ConsumerMeta
 	Channels() []string
-	Close(channel string)
-	CloseAll()
+	Stats() Stats
+	CreateChannel(channel string) error
+	Close(channel string) error
+	CloseChannels(channels []string) error
+	CloseNamespace(namespace string) error
+	CloseAll() error
+	DrainChannel(channel string) error
+	PauseChannel(channel string) error
+	ResumeChannel(channel string) error
+	UpdateSettings(settings *Settings)
 	Run()
 	Stop()
 }
 
+// Registration stores a consumer which should be added to a channel
+// and receives the result of the registration.
+type registration struct {
+	consumer *consumer
+	result   chan error
+}
+
+// ChannelStats stores the statistics of channels returned by the stats endpoint.
+type channelStats struct {
+	ConsumerCount int                       `json:"consumer_count"`
+	Channels      []string                  `json:"channels"`
+	Consumers     map[string]int            `json:"consumers"`
+	ConsumerInfo  map[string][]ConsumerMeta `json:"consumer_info,omitempty"`
+	Lagging       int                       `json:"consumers_lagging,omitempty"`
+	Dropped       uint64                    `json:"messages_dropped,omitempty"`
+	BytesWritten  uint64                    `json:"bytes_written,omitempty"`
+}
+
+// ConsumerMeta stores information of a connected consumer.
+type ConsumerMeta struct {
+	Id             string    `json:"id"`
+	Channel        string    `json:"channel"`
+	RemoteAddr     string    `json:"remote_addr"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	Dropped        uint64    `json:"dropped,omitempty"`
+	Written        uint64    `json:"bytes_written,omitempty"`
+	Unacknowledged int64     `json:"unacknowledged,omitempty"`
+}
+
+// Stats stores a consistent snapshot of the service, which is taken by the dispatcher in a single step.
+type Stats struct {
+	TotalConsumers    int               `json:"total_consumers"`
+	Channels          map[string]int    `json:"channels"`
+	MessagesPublished uint64            `json:"messages_published"`
+	MessagesDropped   uint64            `json:"messages_dropped"`
+	ConsumersLagging  int               `json:"consumers_lagging"`
+	BytesWritten      uint64            `json:"bytes_written"`
+	ChannelBytes      map[string]uint64 `json:"channel_bytes_written"`
+}
+
+// ChannelNames returns the sorted names of the channels of a snapshot.
+func (s Stats) channelNames() []string {
+	channels := make([]string, 0, len(s.Channels))
+	for channel := range s.Channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// ConsumerInfoRequest stores a channel whose consumers should be listed and receives the list.
+type consumerInfoRequest struct {
+	channel string
+	result  chan []ConsumerMeta
+}
+
+// Delivery stores a message which should be delivered to the consumers of its channel.
+// If a result channel is given, it receives the result of the delivery,
+// after the number of consumers the message was enqueued to and the ID of the message are stored.
+type delivery struct {
+	message       *eventMessage
+	consumerCount int
+	id            uint
+	result        chan error
+}
+
+// PublishResult stores the result of a publish request, which is returned to clients accepting JSON.
+type publishResult struct {
+	Id        uint `json:"id"`
+	Consumers int  `json:"consumers"`
+}
+
+// ErrorResult stores the message of an error response in the JSON ErrorFormat.
+type errorResult struct {
+	Error string `json:"error"`
+}
+
+// Drain stores a channel which should be drained.
+// The result channel receives the finished channels of the disconnected consumers,
+// a drain which is completed has no result channel.
+type drain struct {
+	channel string
+	result  chan []<-chan struct{}
+}
+
+// Pause stores a channel whose delivery should be paused or resumed.
+type pause struct {
+	channel string
+	paused  bool
+}
+
+// TargetedDelivery stores a message which should be delivered to a single consumer and receives the result.
+type targetedDelivery struct {
+	consumerId string
+	message    *eventMessage
+	result     chan error
+}
+
+// Broadcast stores a message which should be delivered to several channels.
+// If a result channel is given, it receives the result of the delivery.
+type broadcast struct {
+	message  *eventMessage
+	channels []string
+	result   chan error
+}
+
 // EventSource stores information required by the event source service.
 type eventSource struct {
-	messageRouter   chan *eventMessage
+	messageRouter   chan *delivery
+	broadcastRouter chan *broadcast
+	targetRouter    chan *targetedDelivery
+	scheduledRouter chan *scheduled
 	expireConsumer  chan *consumer
-	addConsumer     chan *consumer
-	closeChannel    chan string
+	addConsumer     chan *registration
+	createChannel   chan string
+	closeChannel    chan []string
+	closeAll        chan bool
+	closeNamespace  chan string
+	drainChannel    chan *drain
+	pauseChannel    chan *pause
+	consumerInfo    chan *consumerInfoRequest
+	collectStats    chan chan Stats
+	forwardQueue    chan *forwarding
+	forwardClient   *http.Client
+	streamDuration  time.Duration
 	stopApplication chan bool
+	done            chan struct{}
 	settings        *Settings
+	replayWindow    time.Duration
+	settingsMutex   sync.RWMutex
+	accessLogMutex  sync.Mutex
 	consumers       map[string][]*consumer
+	history         map[string][]*historyEntry
+	historyBytes    int
+	recentIds       map[string]*recentIds
+	sequences       map[string]uint
+	draining        map[string]bool
+	paused          map[string][]*eventMessage
+	scheduled       map[*scheduled]bool
+	created         map[string]bool
+	connections     map[string]int
+	messageCount    uint64
+	droppedCount    uint64
+	bytesWritten    uint64
+	channelBytes    map[string]*uint64
+	adaptedRetry    int64
+	shutdownStarted int32
+	mirrors         map[string]bool
 }
 
 // New builds and returns a configured EventSource instance.
@@ -52,304 +270,2121 @@ func New(settings *Settings) EventSource {
 		settings = &Settings{}
 	}
 
+	logInvalidSettings(settings)
+
 	es := &eventSource{
-		messageRouter:   make(chan *eventMessage),
+		messageRouter:   make(chan *delivery),
+		broadcastRouter: make(chan *broadcast),
+		targetRouter:    make(chan *targetedDelivery),
+		scheduledRouter: make(chan *scheduled),
 		expireConsumer:  make(chan *consumer),
-		addConsumer:     make(chan *consumer),
-		closeChannel:    make(chan string),
+		addConsumer:     make(chan *registration),
+		createChannel:   make(chan string),
+		closeChannel:    make(chan []string),
+		closeAll:        make(chan bool),
+		closeNamespace:  make(chan string),
+		drainChannel:    make(chan *drain),
+		pauseChannel:    make(chan *pause),
+		consumerInfo:    make(chan *consumerInfoRequest),
+		collectStats:    make(chan chan Stats),
+		forwardQueue:    make(chan *forwarding, forwardQueueSize),
+		forwardClient:   &http.Client{Timeout: forwardTimeout},
+		streamDuration:  maxStreamDuration,
 		stopApplication: make(chan bool),
+		done:            make(chan struct{}),
 		settings:        settings,
+		replayWindow:    settings.GetReplayWindow(),
 		consumers:       make(map[string][]*consumer),
+		history:         make(map[string][]*historyEntry),
+		recentIds:       make(map[string]*recentIds),
+		sequences:       make(map[string]uint),
+		draining:        make(map[string]bool),
+		paused:          make(map[string][]*eventMessage),
+		channelBytes:    make(map[string]*uint64),
+		scheduled:       make(map[*scheduled]bool),
+		created:         make(map[string]bool),
+		connections:     make(map[string]int),
+	}
+
+	for _, channel := range settings.PreregisteredChannels {
+		if !validChannelName(channel) || es.isGlobalChannel(channel) {
+			es.errorf("Invalid preregistered channel name '%s' ignored\n", channel)
+			continue
+		}
+		es.consumers[channel] = []*consumer{}
+		es.created[channel] = true
 	}
 
 	go es.actionDispatcher()
+	go es.forwardDispatcher()
+	es.startMirrors()
 
 	return es
 }
 
+// LogInvalidSettings logs settings which are replaced by their defaults.
+func logInvalidSettings(settings *Settings) {
+	if len(settings.GlobalChannelName) > 0 && !validChannelName(settings.GlobalChannelName) {
+		settings.errorf("Invalid global channel name '%s'. Using '%s' instead\n", settings.GlobalChannelName, defaultGlobalChannelName)
+	}
+
+	if len(settings.BasePath) > 0 && !validBasePath(settings.BasePath) {
+		settings.errorf("Invalid base path '%s'. Using '/' instead\n", settings.BasePath)
+	}
+
+	if len(settings.NamespaceSeparator) > 0 && len(settings.GetNamespaceSeparator()) == 0 {
+		settings.errorf("Invalid namespace separator '%s'. Channels have no namespaces\n", settings.NamespaceSeparator)
+	}
+
+	if settings.CorsAllowCredentials && !settings.corsAllowCredentials(settings.corsOrigin("")) {
+		settings.errorf("CorsAllowCredentials can't be combined with the origin '*'. Credentials are not allowed\n")
+	}
+}
+
+// UpdateSettings replaces the settings of a running service without disconnecting consumers.
+// The new settings apply to all following operations, e.g. authentication, timeouts and CORS headers.
+// Settings which are only used on startup are ignored: Host, Port, UnixSocket, TCPKeepAlive, BasePath,
+// PreregisteredChannels, ReplayWindow, AdaptiveRetryInterval and MirrorSources.
+func (es *eventSource) UpdateSettings(settings *Settings) {
+	if settings == nil {
+		settings = &Settings{}
+	}
+
+	logInvalidSettings(settings)
+
+	es.settingsMutex.Lock()
+	defer es.settingsMutex.Unlock()
+	es.settings = settings
+}
+
+// CurrentSettings returns the active settings, which may be replaced at runtime.
+func (es *eventSource) currentSettings() *Settings {
+	es.settingsMutex.RLock()
+	defer es.settingsMutex.RUnlock()
+	return es.settings
+}
+
 // Router returns a router that can be used to integrate EventSource in already existing servers
+// All routes are registered below the configured base path.
+// The Middleware is applied around all routes in the given order, so the first one is the outermost.
+// It also wraps the responses to unknown routes and unsupported methods, which bypass the middleware of the router.
+// Subscriptions, publishes, broadcasts and deletes are recorded in the AccessLog, if set up.
 func (es *eventSource) Router() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/{channel:[a-z0-9-_]+}", es.subscribeHandler).Methods("GET")
-	router.HandleFunc("/{channel:[a-z0-9-_]+}", es.publishHandler).Methods("POST")
-	router.HandleFunc("/{channel:[a-z0-9-_]+}", es.closeHandler).Methods("DELETE")
-	router.HandleFunc("/{channel:[a-z0-9-_]+}", es.informationHandler).Methods("HEAD")
-	router.NotFoundHandler = http.HandlerFunc(channelNotFoundHandler)
+	basePath := es.currentSettings().GetBasePath()
+	router.HandleFunc(basePath+healthRoute, es.healthHandler).Methods("GET")
+	router.HandleFunc(basePath+broadcastRoute, es.accessLogged(accessBroadcast, es.broadcastHandler)).Methods("POST")
+
+	route := basePath + channelRoute
+	unreserved := unreservedChannel(basePath)
+	router.HandleFunc(route, es.accessLogged(accessSubscribe, es.subscribeHandler)).Methods("GET").MatcherFunc(unreserved)
+	router.HandleFunc(route, es.accessLogged(accessPublish, es.publishHandler)).Methods("POST").MatcherFunc(unreserved)
+	router.HandleFunc(route, es.accessLogged(accessDelete, es.closeHandler)).Methods("DELETE").MatcherFunc(unreserved)
+	router.HandleFunc(route, es.informationHandler).Methods("HEAD").MatcherFunc(unreserved)
+	router.HandleFunc(route, es.preflightHandler).Methods("OPTIONS").MatcherFunc(unreserved)
+	router.HandleFunc(route+"/stats", es.statsHandler).Methods("GET").MatcherFunc(unreserved)
+	if es.currentSettings().EnableLongPoll {
+		router.HandleFunc(route+"/poll", es.accessLogged(accessPoll, es.longPollHandler)).Methods("GET").MatcherFunc(unreserved)
+	}
+
+	middleware := es.currentSettings().Middleware
+	router.NotFoundHandler = chainMiddleware(http.HandlerFunc(es.channelNotFoundHandler), middleware)
+	router.MethodNotAllowedHandler = chainMiddleware(es.methodNotAllowedHandler(router), middleware)
+	for _, mw := range middleware {
+		router.Use(mw)
+	}
 	return router
 }
 
+// ChainMiddleware wraps a handler in the given middleware, so the first one is the outermost.
+func chainMiddleware(handler http.Handler, middleware []func(http.Handler) http.Handler) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
 // SendMessage sends a message to the consumers of a channel.
 // It is also used for sending messages to 'all' consumers.
-func (es *eventSource) SendMessage(messageStream io.Reader, channel string) {
-	em, err := newEventMessage(messageStream, channel)
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) SendMessage(messageStream io.Reader, channel string) error {
+	span := es.startPublishSpan(context.Background(), channel)
+	dl, err := es.sendMessage(messageStream, channel, es.tracing())
+	endPublishSpan(span, dl, err)
+	return err
+}
+
+// SendMessageCount sends a message to the consumers of a channel and returns the number of consumers
+// the message was enqueued to. The number is determined by the dispatcher while delivering the message.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) SendMessageCount(messageStream io.Reader, channel string) (int, error) {
+	span := es.startPublishSpan(context.Background(), channel)
+	dl, err := es.sendMessage(messageStream, channel, true)
+	endPublishSpan(span, dl, err)
 	if err != nil {
-		log.Printf("[E] Unable to create event message for channel '%s'. %s", channel, err)
-		return
+		return 0, err
 	}
-	es.messageRouter <- em
+	return dl.consumerCount, nil
 }
 
-// ChannelExists checks whether a channel exits.
-func (es *eventSource) ChannelExists(channel string) bool {
-	_, ok := es.consumers[channel]
-	return ok
-}
+// SendMessage builds a message based on the given JSON data stream and hands it over to the dispatcher.
+func (es *eventSource) sendMessage(messageStream io.Reader, channel string, waitForResult bool) (*delivery, error) {
+	messageStream, err := remapFields(messageStream, es.currentSettings().FieldMapping)
+	if err != nil {
+		return nil, err
+	}
 
-// ConsumerCount returns the amount of consumers subscribed to a channel.
-func (es *eventSource) ConsumerCount(channel string) int {
-	if consumers, ok := es.consumers[channel]; ok {
-		return len(consumers)
+	em, err := decodeEventMessage(messageStream, channel, es.currentSettings().jsonDecoding())
+	if err != nil {
+		es.errorf("Unable to create event message for channel '%s'. %s", channel, err)
+		return nil, err
 	}
-	return 0
+
+	return es.deliver(em, waitForResult)
 }
 
-// ConsumerCountAll returns the overall amount of consumers.
-func (es *eventSource) ConsumerCountAll() int {
-	var consumerCount int
-	for _, consumers := range es.consumers {
-		consumerCount += len(consumers)
+// SendEvent sends an event to the consumers of a channel, without the need of building JSON data.
+// It is also used for sending events to 'all' consumers.
+func (es *eventSource) SendEvent(e Event, channel string) error {
+	em := eventMessageFromEvent(&e, channel)
+	if !validChannelName(em.Channel) {
+		return ErrInvalidChannel
 	}
-	return consumerCount
-}
 
-// Channel returns all available channels.
-func (es *eventSource) Channels() []string {
-	channels := make([]string, 0)
-	for channel, _ := range es.consumers {
-		channels = append(channels, channel)
+	if err := em.validate(); err != nil {
+		return err
 	}
-	sort.Strings(channels)
-	return channels
-}
 
-// Close closes a single, specified channel
-// Consumers gets disconnected.
-func (es *eventSource) Close(channel string) {
-	es.closeChannel <- channel
+	_, err := es.deliver(em, false)
+	return err
 }
 
-// CloseAll closes all available channels
-// Consumers gets disconnected.
-func (es *eventSource) CloseAll() {
-	es.closeChannel <- globalChannel
+// SendToConsumer sends an event to a single consumer, identified by the ID of its ConsumerMeta.
+// Consumers connected via HTTP receive their ID in the 'X-Consumer-ID' header when subscribing.
+// The event is private, so it's neither stored for replaying nor forwarded. ErrUnknownConsumer is returned
+// if the consumer isn't connected, an error is returned as well if the consumer doesn't keep up.
+func (es *eventSource) SendToConsumer(id string, e Event) error {
+	em := eventMessageFromEvent(&e, "")
+	if err := em.validate(); err != nil {
+		return err
+	}
+
+	if em.exceedsDataSize(es.currentSettings().GetMaxDataBytes()) {
+		return errDataTooLarge
+	}
+
+	td := &targetedDelivery{
+		consumerId: id,
+		message:    em,
+		result:     make(chan error, 1),
+	}
+
+	select {
+	case es.targetRouter <- td:
+		return <-td.result
+	case <-es.done:
+		return ErrStopped
+	}
 }
 
-// Run starts the EventSource service
-func (es *eventSource) Run() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	router := es.Router()
-	log.Printf("[I] Starting EventSource service on %s:%d\n", es.settings.GetHost(), es.settings.GetPort())
-	log.Fatal("[E]", http.ListenAndServe(fmt.Sprintf("%s:%d", es.settings.GetHost(), es.settings.GetPort()), router))
+// SendRawMessage relays a pre-formatted event stream verbatim to the consumers of a channel.
+func (es *eventSource) sendRawMessage(messageStream io.Reader, channel string, waitForResult bool) (*delivery, error) {
+	em, err := newRawEventMessage(messageStream, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	return es.deliver(em, waitForResult)
 }
 
-// Stop stops the EventSource service
-func (es *eventSource) Stop() {
-	es.stopApplication <- true
+// SendBatchMessage sends each event of a JSON lines stream in order to the consumers of a channel.
+// The events are delivered in a single step, so consumers receive all of them or none.
+func (es *eventSource) sendBatchMessage(messageStream io.Reader, channel string, waitForResult bool) (*delivery, error) {
+	messageStream, err := remapFields(messageStream, es.currentSettings().FieldMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := decodeEventMessages(messageStream, channel, es.currentSettings().jsonDecoding())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return &delivery{}, nil
+	}
+
+	return es.deliver(&eventMessage{Channel: channelOrDefault(channel), batch: messages}, waitForResult)
 }
 
-// SubscribeHandler handels new, incoming connections of consumers.
-// Allowed request type: [GET]
-//
-// Subscriptions to channel 'all' are rejected, because this is an reserved channel name.
-func (es *eventSource) subscribeHandler(rw http.ResponseWriter, req *http.Request) {
-	params := mux.Vars(req)
-	if channel := params["channel"]; len(channel) > 0 {
-		if channel == globalChannel {
-			log.Printf("[E] Subscribing consumer on %s to global notification channel 'all' rejected\n", req.RemoteAddr)
-			http.Error(rw, "Error: Channel 'all' is reserved for global notifications. Please choose another channel name.", http.StatusBadRequest)
-			return
-		}
+// SendStreamedMessage sends a plain text stream as a single event to the consumers of a channel, while it's read.
+// The message is delivered first, then the stream is read in bounded chunks and each chunk is passed to the consumers
+// as soon as it's read, so large payloads are never held in memory as a whole.
+// Meanwhile, HTTP and WebSocket consumers are busy with the stream, so other messages of the channel are dropped for them.
+// If reading fails, e.g. once the data exceeds the MaxDataBytes, the stream is aborted, so consumers don't receive
+// the data sent so far as a complete event.
+func (es *eventSource) sendStreamedMessage(messageStream io.Reader, channel, event string, waitForResult bool) (*delivery, error) {
+	ds := newDataStream()
+	dl, err := es.deliver(&eventMessage{Event: event, Channel: channelOrDefault(channel), stream: ds}, waitForResult)
+	if err != nil {
+		return nil, err
+	}
 
-		cr, err := newConsumer(rw, req, es, channel)
-		if err != nil {
-			log.Printf("[E] Subscribing consumer on %s to channel '%s' failed\n", req.RemoteAddr, channel)
-			http.Error(rw, fmt.Sprintf("[E] Unable to connect to channel '%s'.", channel), http.StatusInternalServerError)
-			return
-		}
-		es.addConsumer <- cr
+	if err := readDataChunks(messageStream, es.currentSettings().GetMaxDataBytes(), ds.publish); err != nil {
+		ds.abort()
+		return nil, err
 	}
+	ds.close()
+	return dl, nil
 }
 
-// PublishHandler is responsible for publishing messages to channels.
-// Allowed request type: [POST]
-//
-// The Content-Type of this handler need to be 'application/json'.
-// If an Auth-Token is set up, only authenticated users can publish messages to channels.
-func (es *eventSource) publishHandler(rw http.ResponseWriter, req *http.Request) {
-	if !es.Authenticated(req) {
-		log.Printf("[E] Authentication of %s failed. Publishing to channel rejected\n", req.RemoteAddr)
-		http.Error(rw, "Error: Authentication failed. Publishing to channel rejected.", http.StatusForbidden)
-		return
+// Deliver hands a message over to the dispatcher.
+// Messages exceeding the MaxDataBytes or the MaxScheduleDelay are rejected.
+// If the result is requested, unknown channels are rejected, the message is scheduled or streamed, it waits until the message is delivered.
+// Only then, the delivery contains the number of consumers and the ID of the message. Streamed messages always wait,
+// so their consumers are known before the first chunk is published.
+func (es *eventSource) deliver(em *eventMessage, waitForResult bool) (*delivery, error) {
+	if em.exceedsDataSize(es.currentSettings().GetMaxDataBytes()) {
+		return nil, errDataTooLarge
 	}
 
-	if !validContentType(req.Header.Get("Content-Type")) {
-		log.Printf("[E] Invalid Content-Type sent by %s. Expecting application/json\n", req.RemoteAddr)
-		http.Error(rw, "Error: Invalid Content-Type. Expecting application/json.", http.StatusBadRequest)
-		return
+	if err := es.currentSettings().checkSchedule(em); err != nil {
+		return nil, err
 	}
 
-	params := mux.Vars(req)
-	if channel := params["channel"]; len(channel) > 0 {
-		es.SendMessage(req.Body, channel)
-		defer req.Body.Close()
+	dl := &delivery{message: em}
+	if waitForResult || es.currentSettings().RejectUnknownChannels || em.deferred() || em.stream != nil {
+		dl.result = make(chan error, 1)
 	}
-	rw.WriteHeader(http.StatusCreated)
-}
 
-// CloseHandler is responsible for the closing channels
-// Allowed request type: [DELETE]
-//
-// Consumers are disconnected.
-// If an Auth-Token is set up, only authenticated users can delete a channel.
-func (es *eventSource) closeHandler(rw http.ResponseWriter, req *http.Request) {
-	if !es.Authenticated(req) {
-		log.Printf("[E] Authentication of %s failed. Closing of channel rejected\n", req.RemoteAddr)
-		http.Error(rw, "Error: Authentication failed. Closing of channel rejected.", http.StatusForbidden)
-		return
+	select {
+	case es.messageRouter <- dl:
+	case <-es.done:
+		return nil, ErrStopped
 	}
 
-	params := mux.Vars(req)
-	if channel := params["channel"]; len(channel) > 0 {
-		es.Close(channel)
+	if dl.result == nil {
+		return dl, nil
 	}
-	rw.WriteHeader(http.StatusOK)
+
+	if err := <-dl.result; err != nil {
+		return nil, err
+	}
+	return dl, nil
 }
 
-// InformationHandler is responsible for the closing channels
-// Allowed request type: [HEAD]
-//
-// If an Auth-Token is set up, only authenticated users can view information of channels.
-func (es *eventSource) informationHandler(rw http.ResponseWriter, req *http.Request) {
-	if !es.Authenticated(req) {
-		log.Printf("[E] Authentication of %s failed. Gettings stats for channel rejected\n", req.RemoteAddr)
-		http.Error(rw, "Error: Authentication failed. Gettings stats for channel rejected.", http.StatusForbidden)
-		return
+// Broadcast sends a message to the consumers of several channels.
+// The message is parsed only once and delivered to all channels in a single step.
+// All channel names are validated, before the global channel takes precedence: if it's listed,
+// the message is sent to 'all' consumers only once. If RejectUnknownChannels is set up,
+// the message is delivered to none of the channels, unless all of them are known.
+func (es *eventSource) Broadcast(messageStream io.Reader, channels []string) error {
+	messageStream, err := remapFields(messageStream, es.currentSettings().FieldMapping)
+	if err != nil {
+		return err
 	}
 
-	params := mux.Vars(req)
-	if channel := params["channel"]; len(channel) > 0 {
+	em, err := decodeEventMessage(messageStream, "", es.currentSettings().jsonDecoding())
+	if err != nil {
+		return err
+	}
 
-		if channel == globalChannel {
-			rw.Header().Add("X-Consumer-Count", fmt.Sprint(es.ConsumerCountAll()))
-			rw.Header().Add("X-Available-Channels", fmt.Sprintf("[%s]", strings.Join(es.Channels(), ",")))
-		} else {
-			rw.Header().Add("X-Consumer-Count", fmt.Sprint(es.ConsumerCount(channel)))
-			rw.Header().Add("X-Channel-Exists", fmt.Sprint(es.ChannelExists(channel)))
+	if em.exceedsDataSize(es.currentSettings().GetMaxDataBytes()) {
+		return errDataTooLarge
+	}
+
+	if err := es.currentSettings().checkSchedule(em); err != nil {
+		return err
+	}
+
+	bc := &broadcast{
+		message:  em,
+		channels: make([]string, 0, len(channels)),
+	}
+
+	for _, channel := range channels {
+		if !validChannelName(channel) {
+			return ErrInvalidChannel
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, channel := range channels {
+		if es.isGlobalChannel(channel) {
+			bc.channels = []string{channel}
+			break
 		}
 
+		if !seen[channel] {
+			seen[channel] = true
+			bc.channels = append(bc.channels, channel)
+		}
 	}
-	rw.WriteHeader(http.StatusOK)
+
+	if es.currentSettings().RejectUnknownChannels {
+		bc.result = make(chan error, 1)
+	}
+
+	select {
+	case es.broadcastRouter <- bc:
+	case <-es.done:
+		return ErrStopped
+	}
+
+	if bc.result == nil {
+		return nil
+	}
+	return <-bc.result
 }
 
-// ChannelNotFoundHandler is responsible for unknown channels.
-// When a consumer wants to connect to an unknown endpoint, an error message is returned.
-func channelNotFoundHandler(rw http.ResponseWriter, req *http.Request) {
-	log.Printf("[E] Consumer %s tries to join invalid channel", req.RemoteAddr)
-	http.Error(rw, "Error: Invalid channel name.", http.StatusNotFound)
+// Subscribe registers an in-process consumer of a channel.
+// It returns a channel receiving the events of the channel (including global notifications)
+// and a function to unsubscribe. The returned channel gets closed when the consumer is removed.
+// Subscriptions to the global channel or rejected consumers receive an already closed channel.
+func (es *eventSource) Subscribe(channel string) (<-chan *Event, func()) {
+	events := make(chan *Event, localBufferSize)
+
+	cr, err := es.registerLocalConsumer(channel)
+	if err != nil {
+		close(events)
+		return events, func() {}
+	}
+
+	go cr.eventDispatcher(events)
+	return events, es.unsubscribe(cr)
 }
 
-// Authenticated validates the user submitted AUTH Token.
-func (es eventSource) Authenticated(req *http.Request) bool {
-	authToken := strings.TrimSpace(req.Header.Get("Auth-Token"))
-	if len(es.settings.GetAuthToken()) == 0 && len(authToken) == 0 {
-		return true
+// SubscribeAck registers an acknowledging in-process consumer of a channel. It works like Subscribe,
+// but each event needs to be acknowledged via Ack once it's processed. The events which are not yet acknowledged
+// and the events dropped because the consumer didn't keep up are listed in the ConsumerMeta of the consumer.
+// Consumers connected via HTTP can't acknowledge events.
+func (es *eventSource) SubscribeAck(channel string) (<-chan *AckableEvent, func()) {
+	events := make(chan *AckableEvent, localBufferSize)
+
+	cr, err := es.registerLocalConsumer(channel)
+	if err != nil {
+		close(events)
+		return events, func() {}
 	}
-	return len(es.settings.GetAuthToken()) > 0 && authToken == es.settings.GetAuthToken()
+
+	go cr.ackEventDispatcher(events)
+	return events, es.unsubscribe(cr)
 }
 
-// ValidContentType validates the submitted Content-Type.
-func validContentType(contentType string) bool {
-	if strings.Contains(strings.ToLower(contentType), "application/json") {
-		return true
+// RegisterLocalConsumer adds a new in-process consumer to a channel.
+func (es *eventSource) registerLocalConsumer(channel string) (*consumer, error) {
+	channel = channelOrDefault(channel)
+	if !validChannelName(channel) || es.isGlobalChannel(channel) {
+		es.errorf("Subscribing in-process consumer to channel '%s' rejected, %s\n", channel, ErrInvalidChannel)
+		return nil, ErrInvalidChannel
 	}
-	return false
+
+	cr := newLocalConsumer(es, channel)
+	if err := es.registerConsumer(cr); err != nil {
+		es.errorf("Subscribing in-process consumer to channel '%s' rejected, %s\n", channel, err)
+		return nil, err
+	}
+	return cr, nil
 }
 
-// ActionDispatcher is the central hub of the EventSource service.
-func (es *eventSource) actionDispatcher() {
-	for {
-		select {
+// Unsubscribe returns a function, which removes an in-process consumer once.
+func (es *eventSource) unsubscribe(cr *consumer) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			es.removeConsumer(cr)
+		})
+	}
+}
 
-		// em.messageRouter is responsible for delivering messages to consumers of channels.
-		case em := <-es.messageRouter:
-			switch em.Channel {
-			default:
-				if channelConsumers, ok := es.consumers[em.Channel]; ok {
-					for _, channelConsumer := range channelConsumers {
-						if cr := channelConsumer; !cr.expired {
-							select {
-							case cr.inbox <- em:
-							default:
-							}
-						}
-					}
-				}
-			case globalChannel:
-				log.Println("[I] Sending global notification to all consumers")
-				for _, channelConsumers := range es.consumers {
-					for _, channelConsumer := range channelConsumers {
-						if cr := channelConsumer; !cr.expired {
-							select {
-							case cr.inbox <- em:
-							default:
-							}
-						}
-					}
-				}
-			}
+// Stats returns a consistent snapshot of the channels, their consumers and the amount of published messages.
+// The snapshot is taken by the dispatcher, so it doesn't change while it's collected.
+// An empty snapshot is returned when the service has already been stopped.
+func (es *eventSource) Stats() Stats {
+	result := make(chan Stats, 1)
+	select {
+	case es.collectStats <- result:
+		return <-result
+	case <-es.done:
+		return Stats{Channels: make(map[string]int), ChannelBytes: make(map[string]uint64)}
+	}
+}
 
-		// em.closeChannel is responsible for closing seleted or all channels.
-		case channel := <-es.closeChannel:
-			switch channel {
-			default:
-				if channelConsumers, ok := es.consumers[channel]; ok {
-					log.Printf("[I] Closing channel '%s' and disconnecting consumers\n", channel)
-					for _, channelConsumer := range channelConsumers {
-						close(channelConsumer.inbox)
-					}
-					delete(es.consumers, channel)
-				}
-			case globalChannel:
-				log.Println("[I] Closing all channels and disconnecting consumers")
-				for channelName, channelConsumers := range es.consumers {
-					for _, channelConsumer := range channelConsumers {
-						close(channelConsumer.inbox)
-					}
-					delete(es.consumers, channelName)
-				}
-			}
+// ChannelExists checks whether a channel exits.
+// It's a thin wrapper of Stats, use Stats for several values at once.
+func (es *eventSource) ChannelExists(channel string) bool {
+	_, ok := es.Stats().Channels[channel]
+	return ok
+}
 
-		// em.stopApplication is responsible for shutting down the service properly.
-		case <-es.stopApplication:
-			log.Println("[I] Halting EventSource server")
-			es.closeChannel <- globalChannel
-			close(es.messageRouter)
-			close(es.addConsumer)
-			close(es.expireConsumer)
-			close(es.closeChannel)
-			close(es.stopApplication)
-			return
+// ConsumerCount returns the amount of consumers subscribed to a channel.
+// It's a thin wrapper of Stats, use Stats for several values at once.
+func (es *eventSource) ConsumerCount(channel string) int {
+	return es.Stats().Channels[channel]
+}
 
-		// em.addConsumer is responsible for adding consumers to channels.
-		case cr := <-es.addConsumer:
-			log.Printf("[I] Consumer %s joined channel '%s'\n", cr.connection.RemoteAddr(), cr.channel)
-			es.consumers[cr.channel] = append(es.consumers[cr.channel], cr)
+// ConsumerCountAll returns the overall amount of consumers.
+// It's a thin wrapper of Stats, use Stats for several values at once.
+func (es *eventSource) ConsumerCountAll() int {
+	return es.Stats().TotalConsumers
+}
 
-		// em.expireConsumer is responsible disconnecting and removing staled consumers.
-		case expiredConsumer := <-es.expireConsumer:
-			log.Printf("[I] Consumer %s expired and gets removed from channel '%s'\n", expiredConsumer.connection.RemoteAddr(), expiredConsumer.channel)
-			if consumers, ok := es.consumers[expiredConsumer.channel]; ok {
-				consumerSlice := make([]*consumer, 0)
+// ConsumerInfo returns information of the consumers connected to a channel.
+// Requesting the global channel returns the consumers of all channels.
+// The consumers are listed by the dispatcher, so the list is consistent with deliveries.
+func (es *eventSource) ConsumerInfo(channel string) []ConsumerMeta {
+	cir := &consumerInfoRequest{
+		channel: channel,
+		result:  make(chan []ConsumerMeta, 1),
+	}
 
-				for _, cr := range consumers {
-					if cr != expiredConsumer {
-						consumerSlice = append(consumerSlice, cr)
+	select {
+	case es.consumerInfo <- cir:
+		return <-cir.result
+	case <-es.done:
+		return []ConsumerMeta{}
+	}
+}
+
+// Channel returns all available channels.
+// It's a thin wrapper of Stats, use Stats for several values at once.
+func (es *eventSource) Channels() []string {
+	return es.Stats().channelNames()
+}
+
+// CreateChannel registers a channel without consumers, so it's listed as available channel.
+// Creating an already existing channel has no effect.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) CreateChannel(channel string) error {
+	if !validChannelName(channel) || es.isGlobalChannel(channel) {
+		return ErrInvalidChannel
+	}
+
+	select {
+	case es.createChannel <- channel:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// Close closes a single, specified channel
+// Consumers gets disconnected. The global channel can't be closed, use CloseAll instead.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) Close(channel string) error {
+	if !validChannelName(channel) || es.isGlobalChannel(channel) {
+		return ErrInvalidChannel
+	}
+
+	select {
+	case es.closeChannel <- []string{channel}:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// DrainChannel closes a single, specified channel after delivering all queued messages.
+// While draining, new consumers are rejected. New messages to the channel are rejected as well,
+// if their result is requested, like for publishes via HTTP, and dropped otherwise.
+// It returns when all consumers of the channel have been disconnected.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) DrainChannel(channel string) error {
+	if !validChannelName(channel) || es.isGlobalChannel(channel) {
+		return ErrInvalidChannel
+	}
+
+	dr := &drain{
+		channel: channel,
+		result:  make(chan []<-chan struct{}, 1),
+	}
+
+	select {
+	case es.drainChannel <- dr:
+	case <-es.done:
+		return ErrStopped
+	}
+
+	for _, finished := range <-dr.result {
+		select {
+		case <-finished:
+		case <-es.done:
+			return ErrStopped
+		}
+	}
+
+	select {
+	case es.drainChannel <- &drain{channel: channel}:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// PauseChannel holds the messages of a channel instead of delivering them, e.g. during the maintenance of a downstream consumer.
+// Consumers stay connected, held messages are delivered in publish order by ResumeChannel.
+// Up to MaxPausedMessages are held, further messages are dropped. Global notifications and messages sent to single consumers are not held.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) PauseChannel(channel string) error {
+	return es.setPaused(channel, true)
+}
+
+// ResumeChannel delivers the messages held while a channel was paused and resumes its delivery.
+// Resuming a channel which isn't paused has no effect.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) ResumeChannel(channel string) error {
+	return es.setPaused(channel, false)
+}
+
+// SetPaused passes the pausing or resuming of a channel to the dispatcher.
+func (es *eventSource) setPaused(channel string, paused bool) error {
+	if !validChannelName(channel) || es.isGlobalChannel(channel) {
+		return ErrInvalidChannel
+	}
+
+	select {
+	case es.pauseChannel <- &pause{channel: channel, paused: paused}:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// CloseChannels closes several channels in a single step, so no consumer joins or messages interleave.
+// Consumers gets disconnected. If any channel name is invalid or the global channel is listed, no channel is closed.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) CloseChannels(channels []string) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	for _, channel := range channels {
+		if !validChannelName(channel) || es.isGlobalChannel(channel) {
+			return ErrInvalidChannel
+		}
+	}
+
+	select {
+	case es.closeChannel <- channels:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// CloseNamespace closes all channels of a namespace in a single step, e.g. when tearing down a tenant.
+// Consumers gets disconnected. Without a NamespaceSeparator, channels have no namespace and nothing is closed.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) CloseNamespace(namespace string) error {
+	if len(namespace) == 0 || len(es.currentSettings().GetNamespaceSeparator()) == 0 {
+		return nil
+	}
+
+	select {
+	case es.closeNamespace <- namespace:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// CloseAll closes all available channels
+// Consumers gets disconnected.
+// ErrStopped is returned when the service has already been stopped.
+func (es *eventSource) CloseAll() error {
+	select {
+	case es.closeAll <- true:
+		return nil
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// Run starts the EventSource service
+// If a UnixSocket is set up, the service listens on the Unix domain socket instead of host and port.
+func (es *eventSource) Run() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	router := es.Router()
+
+	if unixSocket := es.currentSettings().UnixSocket; len(unixSocket) > 0 {
+		es.runUnixSocket(unixSocket, router)
+		return
+	}
+
+	listener, err := es.listenTCP(fmt.Sprintf("%s:%d", es.currentSettings().GetHost(), es.currentSettings().GetPort()))
+	if err != nil {
+		log.Fatal("[E]", err)
+	}
+
+	defer es.watchSignals(listener)()
+
+	es.infof("Starting EventSource service on %s:%d\n", es.currentSettings().GetHost(), es.currentSettings().GetPort())
+	es.serve(listener, router)
+}
+
+// Serve serves the router on the listener. Errors are fatal, unless the listener was closed as the service stopped.
+func (es *eventSource) serve(listener net.Listener, router http.Handler) {
+	if err := http.Serve(listener, router); err != nil {
+		select {
+		case <-es.done:
+		default:
+			log.Fatal("[E]", err)
+		}
+	}
+}
+
+// WatchSignals shuts the service down gracefully on SIGINT or SIGTERM, if HandleSignals is set up.
+// It returns the function, which stops watching the signals.
+func (es *eventSource) watchSignals(listener net.Listener) func() {
+	if !es.currentSettings().HandleSignals {
+		return func() {}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go es.handleSignals(signals, listener)
+	return func() {
+		signal.Stop(signals)
+	}
+}
+
+// HandleSignals shuts the service down gracefully, once one of the given signals is received.
+// Afterwards, the listener is closed, so Run returns.
+func (es *eventSource) handleSignals(signals <-chan os.Signal, listener net.Listener) {
+	select {
+	case sig := <-signals:
+		es.infof("Received signal %s. Shutting down EventSource service\n", sig)
+		es.shutdown(es.currentSettings().GetShutdownGracePeriod())
+		listener.Close()
+	case <-es.done:
+	}
+}
+
+// Shutdown drains all channels, so consumers receive their queued messages before they're disconnected,
+// and stops the service. Consumers which aren't disconnected within the grace period are cut off by stopping the service.
+// New subscriptions and publishes are declined from the start, so no channel outlives the grace period.
+func (es *eventSource) shutdown(gracePeriod time.Duration) {
+	atomic.StoreInt32(&es.shutdownStarted, 1)
+
+	drained := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, channel := range es.Channels() {
+			wg.Add(1)
+			go func(channel string) {
+				defer wg.Done()
+				es.DrainChannel(channel)
+			}(channel)
+		}
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(gracePeriod):
+		es.errorf("Consumers weren't disconnected within the grace period of %s\n", gracePeriod)
+	}
+	es.Stop()
+}
+
+// ListenTCP listens on the given address. Accepted connections use TCP keep-alives with the configured period,
+// so consumers which vanished without closing their connection are detected, even if no events are written.
+func (es *eventSource) listenTCP(address string) (net.Listener, error) {
+	listenConfig := net.ListenConfig{KeepAlive: es.currentSettings().GetTCPKeepAlive()}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
+
+// RunUnixSocket serves the router on a Unix domain socket until the service is stopped.
+// Stale socket files are removed on startup, the socket file is removed on shutdown.
+func (es *eventSource) runUnixSocket(unixSocket string, router http.Handler) {
+	if err := os.Remove(unixSocket); err != nil && !os.IsNotExist(err) {
+		log.Fatal("[E]", err)
+	}
+
+	listener, err := net.Listen("unix", unixSocket)
+	if err != nil {
+		log.Fatal("[E]", err)
+	}
+
+	go func() {
+		<-es.done
+		listener.Close()
+	}()
+
+	defer es.watchSignals(listener)()
+
+	es.infof("Starting EventSource service on unix socket %s\n", unixSocket)
+	es.serve(listener, router)
+}
+
+// Stop stops the EventSource service
+// All channels are closed and consumers gets disconnected.
+// Afterwards, sending messages or closing channels returns ErrStopped.
+func (es *eventSource) Stop() {
+	select {
+	case es.stopApplication <- true:
+		<-es.done
+	case <-es.done:
+	}
+}
+
+// SubscribeHandler handels new, incoming connections of consumers.
+// Allowed request type: [GET]
+//
+// The handler blocks and streams events to the consumer until it's removed from its channel.
+// With StrictAccept, clients which don't accept 'text/event-stream' are rejected with 406 Not Acceptable.
+// Subscriptions to the global channel ('all' by default) are rejected, because this is an reserved channel name.
+func (es *eventSource) subscribeHandler(rw http.ResponseWriter, req *http.Request) {
+	if es.shuttingDown() {
+		es.errorf("Subscribing consumer on %s rejected, %s\n", es.remoteAddr(req), ErrStopped)
+		es.serviceStopped(rw)
+		return
+	}
+
+	params := mux.Vars(req)
+	if channel := params["channel"]; len(channel) > 0 {
+		if es.isGlobalChannel(channel) {
+			es.errorf("Subscribing consumer on %s to global notification channel '%s' rejected\n", es.remoteAddr(req), channel)
+			http.Error(rw, fmt.Sprintf("Error: Channel '%s' is reserved for global notifications. Please choose another channel name.", channel), http.StatusBadRequest)
+			return
+		}
+
+		if !es.channelAllowed(channel) {
+			es.errorf("Subscribing consumer on %s to channel '%s' rejected, the channel isn't allowed\n", es.remoteAddr(req), channel)
+			es.httpError(rw, "Error: Invalid channel name.", http.StatusNotFound)
+			return
+		}
+
+		webSocket := es.currentSettings().EnableWebSocket && isWebSocketUpgrade(req)
+		if webSocket {
+			if err := es.currentSettings().validateWebSocketUpgrade(req); err != nil {
+				es.errorf("Subscribing consumer on %s to channel '%s' via WebSocket rejected, %s\n", es.remoteAddr(req), channel, err)
+				if err == errOriginNotAllowed {
+					es.httpError(rw, "Error: Origin not allowed.", http.StatusForbidden)
+				} else {
+					http.Error(rw, "Error: Invalid WebSocket handshake.", http.StatusBadRequest)
+				}
+				return
+			}
+		} else if es.currentSettings().StrictAccept && !acceptsEventStream(req.Header.Get("Accept")) {
+			es.errorf("Subscribing consumer on %s to channel '%s' rejected, event streams aren't accepted\n", es.remoteAddr(req), channel)
+			http.Error(rw, fmt.Sprintf("Error: Channel '%s' is an event stream. Please send 'Accept: text/event-stream' to subscribe.", channel), http.StatusNotAcceptable)
+			return
+		}
+
+		cr := newConsumer(req, es, channel)
+		cr.webSocket = webSocket
+		span := es.startSubscribeSpan(req.Context(), cr)
+		defer span.End()
+
+		if err := es.registerConsumer(cr); err != nil {
+			span.RecordError(err)
+			es.errorf("Subscribing consumer on %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			es.registrationFailed(rw, channel, err)
+			return
+		}
+		defer close(cr.finished)
+		defer es.logAccess(accessExpire, cr.channel, cr.remoteAddr, 0)
+		span.AddEvent("subscribed")
+		defer span.AddEvent("unsubscribed")
+
+		stream := cr.stream
+		if webSocket {
+			stream = cr.streamWebSocket
+		}
+		if err := stream(rw, req); err != nil {
+			span.RecordError(err)
+			es.errorf("Subscribing consumer on %s to channel '%s' failed, %s\n", es.remoteAddr(req), channel, err)
+			switch err {
+			case errStreamingUnsupported:
+				http.Error(rw, fmt.Sprintf("Error: Unable to connect to channel '%s'. The server doesn't support streaming responses.", channel), http.StatusInternalServerError)
+			case errHijackUnsupported:
+				http.Error(rw, fmt.Sprintf("Error: Unable to connect to channel '%s'. The server doesn't support WebSockets.", channel), http.StatusInternalServerError)
+			}
+			es.removeConsumer(cr)
+		}
+	}
+}
+
+// LongPollHandler is a fallback for clients without EventSource support, e.g. for a client-side polyfill.
+// Allowed request type: [GET]
+//
+// The request is held open until the next message of the channel arrives, which is returned as JSON array of its events.
+// Streamed messages are read to their end and returned as a single event.
+// If a ReplayWindow is set up, messages published after the 'lastId' parameter are returned immediately.
+// When the LongPollTimeout elapses without a message, '204 No Content' is returned.
+func (es *eventSource) longPollHandler(rw http.ResponseWriter, req *http.Request) {
+	if es.shuttingDown() {
+		es.errorf("Long polling consumer on %s rejected, %s\n", es.remoteAddr(req), ErrStopped)
+		es.serviceStopped(rw)
+		return
+	}
+
+	params := mux.Vars(req)
+	channel := params["channel"]
+	if es.isGlobalChannel(channel) {
+		es.errorf("Long polling consumer on %s of global notification channel '%s' rejected\n", es.remoteAddr(req), channel)
+		http.Error(rw, fmt.Sprintf("Error: Channel '%s' is reserved for global notifications. Please choose another channel name.", channel), http.StatusBadRequest)
+		return
+	}
+
+	if !es.channelAllowed(channel) {
+		es.errorf("Long polling consumer on %s of channel '%s' rejected, the channel isn't allowed\n", es.remoteAddr(req), channel)
+		es.httpError(rw, "Error: Invalid channel name.", http.StatusNotFound)
+		return
+	}
+
+	cr := newLocalConsumer(es, channel)
+	cr.remoteAddr = es.remoteAddr(req)
+	cr.ip = remoteIP(cr.remoteAddr)
+	if lastId := req.URL.Query().Get("lastId"); len(lastId) > 0 {
+		if es.replayWindow > 0 {
+			cr.replayRequest = &replayRequest{lastEventId: lastId, since: time.Now().Add(-es.replayWindow)}
+		}
+	}
+
+	if err := es.registerConsumer(cr); err != nil {
+		es.errorf("Long polling consumer on %s of channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+		es.registrationFailed(rw, channel, err)
+		return
+	}
+	defer close(cr.finished)
+	defer cr.releaseStreams()
+	defer es.removeConsumer(cr)
+
+	// Messages without events, like raw messages without data or aborted streams, are skipped.
+	var events []*Event
+	for _, em := range cr.replay {
+		if events = em.events(); len(events) > 0 {
+			break
+		}
+	}
+
+	if len(events) == 0 {
+		timeout := time.NewTimer(es.currentSettings().GetLongPollTimeout())
+		defer timeout.Stop()
+
+	wait:
+		for len(events) == 0 {
+			select {
+			case message, ok := <-cr.inbox:
+				if !ok {
+					if cr.closeMessage != nil {
+						events = cr.closeMessage.events()
+					}
+					break wait
+				}
+				if message.stream != nil {
+					if e := cr.readStream(message, es.currentSettings().GetMaxDataBytes()); e != nil {
+						events = []*Event{e}
+					}
+					continue
+				}
+				events = message.events()
+			case <-timeout.C:
+				break wait
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+
+	if len(events) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(rw).Encode(events); err != nil {
+		es.errorf("Unable to encode events for long polling consumer on %s. %s\n", es.remoteAddr(req), err)
+	}
+}
+
+// RegistrationFailed responds with the error, why a consumer wasn't accepted for a channel.
+func (es *eventSource) registrationFailed(rw http.ResponseWriter, channel string, err error) {
+	switch err {
+	case ErrStopped:
+		es.serviceStopped(rw)
+	case errTooManyConnections:
+		http.Error(rw, "Error: Too many connections. Please try again later.", http.StatusTooManyRequests)
+	case errChannelDraining:
+		es.retryLater(rw, fmt.Sprintf("Error: Channel '%s' is closing. Please try again later.", channel))
+	default:
+		http.Error(rw, "Error: Maximum number of consumers reached. Please try again later.", http.StatusServiceUnavailable)
+	}
+}
+
+// ChannelAllowed checks whether a channel is listed in the AllowedChannels. Without a list, all channels are allowed.
+// The global channel is always allowed, as it addresses the consumers of all channels.
+func (es *eventSource) channelAllowed(channel string) bool {
+	allowedChannels := es.currentSettings().AllowedChannels
+	if len(allowedChannels) == 0 || es.isGlobalChannel(channel) {
+		return true
+	}
+
+	for _, allowedChannel := range allowedChannels {
+		if allowedChannel == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Stopped checks whether the service has been stopped.
+func (es *eventSource) stopped() bool {
+	select {
+	case <-es.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ShuttingDown checks whether a graceful shutdown has begun or the service has been stopped.
+func (es *eventSource) shuttingDown() bool {
+	return atomic.LoadInt32(&es.shutdownStarted) == 1 || es.stopped()
+}
+
+// ServiceStopped declines a request, because the service has been stopped.
+func (es *eventSource) serviceStopped(rw http.ResponseWriter) {
+	es.retryLater(rw, "Error: EventSource service stopped.")
+}
+
+// RetryLater declines a request with 503 Service Unavailable, e.g. because the service is stopped or the channel is draining.
+// The Retry-After header, taken from the ShutdownRetryAfter, lets clients back off, e.g. until another instance took over.
+func (es *eventSource) retryLater(rw http.ResponseWriter, message string) {
+	retryAfter := es.currentSettings().GetShutdownRetryAfter()
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(rw, message, http.StatusServiceUnavailable)
+}
+
+// RegisterConsumer adds a consumer to its channel.
+// The dispatcher decides whether the consumer is accepted, so limits are checked without races.
+func (es *eventSource) registerConsumer(cr *consumer) error {
+	reg := &registration{
+		consumer: cr,
+		result:   make(chan error),
+	}
+
+	select {
+	case es.addConsumer <- reg:
+		return <-reg.result
+	case <-es.done:
+		return ErrStopped
+	}
+}
+
+// RemoveConsumer initiates the removal of a consumer from its channel.
+func (es *eventSource) removeConsumer(cr *consumer) {
+	select {
+	case es.expireConsumer <- cr:
+	case <-es.done:
+	}
+}
+
+// PublishHandler is responsible for publishing messages to channels.
+// Allowed request type: [POST]
+//
+// The Content-Type of this handler need to be 'application/json'.
+// Pre-formatted events of Content-Type 'text/event-stream' are relayed verbatim.
+// Plain text of Content-Type 'text/plain' is streamed in chunks, named by the parameter 'event'.
+// Batches of Content-Type 'application/x-ndjson' contain one JSON event per line and are published in order.
+// Clients sending 'Accept: application/json' receive the ID of the event and the number of consumers it reached.
+// If an Auth-Token is set up, only authenticated users can publish messages to channels.
+func (es *eventSource) publishHandler(rw http.ResponseWriter, req *http.Request) {
+	if !es.Authenticated(req) {
+		es.errorf("Authentication of %s failed. Publishing to channel rejected\n", es.remoteAddr(req))
+		es.authenticationFailed(rw, "Error: Authentication failed. Publishing to channel rejected.")
+		return
+	}
+
+	if es.shuttingDown() {
+		es.errorf("Publishing of %s rejected, %s\n", es.remoteAddr(req), ErrStopped)
+		es.serviceStopped(rw)
+		return
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	rawMessage := isEventStream(contentType)
+	streamedMessage := isPlainText(contentType)
+	batchMessage := isJSONLines(contentType)
+	if !rawMessage && !streamedMessage && !batchMessage && !validContentType(contentType) {
+		es.errorf("Invalid Content-Type sent by %s. Expecting application/json, application/x-ndjson, text/event-stream or text/plain\n", es.remoteAddr(req))
+		http.Error(rw, "Error: Invalid Content-Type. Expecting application/json, application/x-ndjson, text/event-stream or text/plain.", http.StatusBadRequest)
+		return
+	}
+
+	// Clients accepting JSON receive the ID of the published event and the number of consumers it reached.
+	status := es.currentSettings().GetPublishSuccessStatus()
+	returnResult := status != http.StatusNoContent && acceptsJSON(req.Header.Get("Accept"))
+
+	// Publishes wait for the dispatcher, so messages to draining channels are declined instead of being dropped.
+	const waitForResult = true
+
+	params := mux.Vars(req)
+	if channel := params["channel"]; len(channel) > 0 {
+		defer req.Body.Close()
+
+		if !es.channelAllowed(channel) {
+			es.errorf("Publishing of %s to channel '%s' rejected, the channel isn't allowed\n", es.remoteAddr(req), channel)
+			es.httpError(rw, "Error: Invalid channel name.", http.StatusNotFound)
+			return
+		}
+
+		if es.mirrored(channel) {
+			es.errorf("Publishing of %s to channel '%s' rejected, the channel is a read-only mirror\n", es.remoteAddr(req), channel)
+			http.Error(rw, fmt.Sprintf("Error: Channel '%s' mirrors another stream and is read-only.", channel), http.StatusConflict)
+			return
+		}
+
+		span := es.startPublishSpan(req.Context(), channel)
+		var dl *delivery
+		var err error
+		if rawMessage {
+			dl, err = es.sendRawMessage(req.Body, channel, waitForResult)
+		} else if streamedMessage {
+			if err := http.NewResponseController(rw).SetReadDeadline(time.Now().Add(es.streamDuration)); err != nil {
+				es.debugf("Unable to limit the stream of %s to channel '%s', %s\n", es.remoteAddr(req), channel, err)
+			}
+			dl, err = es.sendStreamedMessage(req.Body, channel, req.URL.Query().Get("event"), waitForResult)
+		} else if batchMessage {
+			dl, err = es.sendBatchMessage(req.Body, channel, waitForResult)
+		} else {
+			dl, err = es.sendMessage(req.Body, channel, waitForResult)
+		}
+		endPublishSpan(span, dl, err)
+
+		if lineErr, ok := err.(*lineError); ok {
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, fmt.Sprintf("Error: Invalid event on line %d. No events were published.", lineErr.line), http.StatusBadRequest)
+			return
+		}
+
+		if errors.Is(err, errUnknownField) {
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, "Error: Invalid JSON. Events can't contain unknown fields.", http.StatusBadRequest)
+			return
+		}
+
+		var jsonErr *jsonError
+		if errors.As(err, &jsonErr) {
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadRequest)
+			if err := json.NewEncoder(rw).Encode(jsonErr); err != nil {
+				es.errorf("Unable to encode JSON error for %s. %s\n", es.remoteAddr(req), err)
+			}
+			return
+		}
+
+		switch err {
+		case errTrailingData:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, "Error: Invalid JSON. Events need to be a single JSON object, several events are published as JSON lines of Content-Type 'application/x-ndjson'.", http.StatusBadRequest)
+			return
+		case errInvalidEncoding:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, "Error: Invalid encoding. Events need to be valid UTF-8.", http.StatusBadRequest)
+			return
+		case errInvalidBase64:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, "Error: Invalid base64 data. The field 'data_base64' needs to be standard base64 and can't be combined with 'data'.", http.StatusBadRequest)
+			return
+		case errDataTooLarge:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, fmt.Sprintf("Error: Data too large. Events may contain up to %d bytes of data.", es.currentSettings().GetMaxDataBytes()), http.StatusRequestEntityTooLarge)
+			return
+		case errInvalidRawMessage:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, "Error: Invalid event stream. Events need to end with a blank line.", http.StatusBadRequest)
+			return
+		case ErrStopped:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			es.serviceStopped(rw)
+			return
+		case errChannelDraining:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			es.retryLater(rw, fmt.Sprintf("Error: Channel '%s' is closing. Please try again later.", channel))
+			return
+		case errUnknownChannel:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, fmt.Sprintf("Error: Channel '%s' doesn't exist.", channel), http.StatusConflict)
+			return
+		case errScheduleTooFar:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, fmt.Sprintf("Error: Invalid deliver_at. Events may be scheduled up to %s ahead.", es.currentSettings().GetMaxScheduleDelay()), http.StatusBadRequest)
+			return
+		case errTooManyScheduled:
+			es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+			http.Error(rw, "Error: Too many scheduled events. Try again later.", http.StatusTooManyRequests)
+			return
+		default:
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+				http.Error(rw, fmt.Sprintf("Error: Stream too long. Streamed messages may take up to %s.", es.streamDuration), http.StatusRequestTimeout)
+				return
+			}
+			if errors.Is(err, ErrParse) {
+				es.errorf("Publishing of %s to channel '%s' rejected, %s\n", es.remoteAddr(req), channel, err)
+				http.Error(rw, "Error: Invalid message.", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				es.errorf("Publishing of %s to channel '%s' failed, %s\n", es.remoteAddr(req), channel, err)
+				http.Error(rw, "Error: Unable to publish the message.", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if returnResult && dl != nil {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			if err := json.NewEncoder(rw).Encode(&publishResult{Id: dl.id, Consumers: dl.consumerCount}); err != nil {
+				es.errorf("Unable to encode publish result for %s. %s\n", es.remoteAddr(req), err)
+			}
+			return
+		}
+	}
+	rw.WriteHeader(status)
+}
+
+// BroadcastHandler is responsible for publishing global notifications to all consumers across all channels.
+// Allowed request type: [POST]
+//
+// It's an explicit alternative to publishing to the global channel and accepts the same requests as the PublishHandler.
+// If global notifications are disabled, the endpoint isn't available.
+func (es *eventSource) broadcastHandler(rw http.ResponseWriter, req *http.Request) {
+	if es.currentSettings().DisableGlobalChannel {
+		es.errorf("Broadcast of %s rejected, global notifications are disabled\n", es.remoteAddr(req))
+		es.httpError(rw, "Error: Global notifications are disabled.", http.StatusNotFound)
+		return
+	}
+
+	if !es.Authenticated(req) {
+		es.errorf("Authentication of %s failed. Broadcast rejected\n", es.remoteAddr(req))
+		es.authenticationFailed(rw, "Error: Authentication failed. Broadcast rejected.")
+		return
+	}
+
+	es.debugf("Broadcasting global notification of %s\n", es.remoteAddr(req))
+	es.publishHandler(rw, mux.SetURLVars(req, map[string]string{"channel": es.currentSettings().GetGlobalChannelName()}))
+}
+
+// CloseHandler is responsible for the closing channels
+// Allowed request type: [DELETE]
+//
+// Consumers are disconnected. Deleting the global channel closes all channels.
+// If an Auth-Token is set up, only authenticated users can delete a channel.
+func (es *eventSource) closeHandler(rw http.ResponseWriter, req *http.Request) {
+	if !es.Authenticated(req) {
+		es.errorf("Authentication of %s failed. Closing of channel rejected\n", es.remoteAddr(req))
+		es.authenticationFailed(rw, "Error: Authentication failed. Closing of channel rejected.")
+		return
+	}
+
+	params := mux.Vars(req)
+	if channel := params["channel"]; len(channel) > 0 {
+		var err error
+		if es.isGlobalChannel(channel) {
+			err = es.CloseAll()
+		} else {
+			err = es.Close(channel)
+		}
+		if err != nil {
+			es.errorf("Closing of channel '%s' by %s rejected, %s\n", channel, es.remoteAddr(req), err)
+			http.Error(rw, "Error: EventSource service stopped.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// InformationHandler is responsible for the closing channels
+// Allowed request type: [HEAD]
+//
+// The information carries a weak ETag derived from the snapshot. If it matches If-None-Match, 304 Not Modified is returned.
+// If an Auth-Token is set up, only authenticated users can view information of channels.
+func (es *eventSource) informationHandler(rw http.ResponseWriter, req *http.Request) {
+	if !es.Authenticated(req) {
+		es.errorf("Authentication of %s failed. Gettings stats for channel rejected\n", es.remoteAddr(req))
+		es.authenticationFailed(rw, "Error: Authentication failed. Gettings stats for channel rejected.")
+		return
+	}
+
+	params := mux.Vars(req)
+	if channel := params["channel"]; len(channel) > 0 {
+
+		snapshot := es.Stats()
+		if es.isGlobalChannel(channel) {
+			rw.Header().Add("X-Consumer-Count", fmt.Sprint(snapshot.TotalConsumers))
+			rw.Header().Add("X-Available-Channels", fmt.Sprintf("[%s]", strings.Join(snapshot.channelNames(), ",")))
+		} else {
+			_, channelExists := snapshot.Channels[channel]
+			rw.Header().Add("X-Consumer-Count", fmt.Sprint(snapshot.Channels[channel]))
+			rw.Header().Add("X-Channel-Exists", fmt.Sprint(channelExists))
+		}
+
+		etag := weakETag(rw.Header().Get("X-Consumer-Count"), rw.Header().Get("X-Available-Channels"), rw.Header().Get("X-Channel-Exists"))
+		rw.Header().Set("ETag", etag)
+		if etagMatches(req.Header.Get("If-None-Match"), etag) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// WeakETag returns a weak ETag, which is the hash of the given values.
+func weakETag(values ...string) string {
+	hash := fnv.New64a()
+	for _, value := range values {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf(`W/"%x"`, hash.Sum64())
+}
+
+// EtagMatches checks whether the given If-None-Match header lists the ETag, using the weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// PreflightHandler answers CORS preflight requests of browsers.
+// Allowed request type: [OPTIONS]
+//
+// The allowed origin, methods and headers are taken from the settings.
+func (es *eventSource) preflightHandler(rw http.ResponseWriter, req *http.Request) {
+	es.currentSettings().setCorsOriginHeaders(rw.Header(), req.Header.Get("Origin"))
+	rw.Header().Set("Access-Control-Allow-Methods", es.currentSettings().GetCorsAllowMethod())
+	rw.Header().Set("Access-Control-Allow-Headers", es.currentSettings().GetCorsAllowHeaders())
+	rw.WriteHeader(http.StatusOK)
+}
+
+// HealthHandler reports whether the service is running, e.g. for liveness and readiness probes.
+// Allowed request type: [GET]
+//
+// It's available without authentication and doesn't reveal any information of channels.
+func (es *eventSource) healthHandler(rw http.ResponseWriter, req *http.Request) {
+	select {
+	case <-es.done:
+		http.Error(rw, "Error: EventSource service stopped.", http.StatusServiceUnavailable)
+	default:
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// StatsHandler returns the statistics of channels as JSON.
+// Allowed request type: [GET]
+//
+// Requesting the stats of the global channel returns the statistics of all available channels.
+// With the parameter 'consumers=true', information of the connected consumers is included.
+// If an Auth-Token is set up, only authenticated users can view the statistics of channels.
+func (es *eventSource) statsHandler(rw http.ResponseWriter, req *http.Request) {
+	if !es.Authenticated(req) {
+		es.errorf("Authentication of %s failed. Gettings stats for channel rejected\n", es.remoteAddr(req))
+		es.authenticationFailed(rw, "Error: Authentication failed. Gettings stats for channel rejected.")
+		return
+	}
+
+	stats := channelStats{
+		Channels:  make([]string, 0),
+		Consumers: make(map[string]int),
+	}
+
+	params := mux.Vars(req)
+	if channel := params["channel"]; len(channel) > 0 {
+		if withConsumers, _ := strconv.ParseBool(req.URL.Query().Get("consumers")); withConsumers {
+			stats.ConsumerInfo = make(map[string][]ConsumerMeta)
+			for _, consumerMeta := range es.ConsumerInfo(channel) {
+				stats.ConsumerInfo[consumerMeta.Channel] = append(stats.ConsumerInfo[consumerMeta.Channel], consumerMeta)
+			}
+		}
+
+		snapshot := es.Stats()
+		if es.isGlobalChannel(channel) {
+			stats.ConsumerCount = snapshot.TotalConsumers
+			stats.Channels = snapshot.channelNames()
+			stats.Consumers = snapshot.Channels
+			stats.Lagging = snapshot.ConsumersLagging
+			stats.Dropped = snapshot.MessagesDropped
+			stats.BytesWritten = snapshot.BytesWritten
+		} else if consumerCount, ok := snapshot.Channels[channel]; ok {
+			stats.ConsumerCount = consumerCount
+			stats.Channels = append(stats.Channels, channel)
+			stats.Consumers[channel] = consumerCount
+			stats.BytesWritten = snapshot.ChannelBytes[channel]
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(stats); err != nil {
+		es.errorf("Unable to encode stats for %s. %s\n", es.remoteAddr(req), err)
+	}
+}
+
+// ChannelNotFoundHandler is responsible for unknown channels.
+// When a consumer wants to connect to an unknown endpoint, an error message is returned.
+func (es *eventSource) channelNotFoundHandler(rw http.ResponseWriter, req *http.Request) {
+	es.errorf("Consumer %s tries to join invalid channel", es.remoteAddr(req))
+	es.httpError(rw, "Error: Invalid channel name.", http.StatusNotFound)
+}
+
+// MethodNotAllowedHandler responds with '405 Method Not Allowed' to requests whose path matches a route, but not its method.
+// The Allow header lists the methods of all routes matching the path, e.g. 'GET, POST, DELETE, HEAD, OPTIONS' for channels.
+func (es *eventSource) methodNotAllowedHandler(router *mux.Router) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		var allow []string
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			var match mux.RouteMatch
+			if methods, err := route.GetMethods(); err == nil && (route.Match(req, &match) || match.MatchErr == mux.ErrMethodMismatch) {
+				allow = append(allow, methods...)
+			}
+			return nil
+		})
+
+		es.errorf("Request %s %s of %s rejected, the method isn't allowed\n", req.Method, req.URL.Path, es.remoteAddr(req))
+		rw.Header().Set("Allow", strings.Join(allow, ", "))
+		es.httpError(rw, fmt.Sprintf("Error: Method %s not allowed.", req.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// RemoteAddr returns the address of the client, which is used in logs, for ConsumerMeta and for per-IP limits.
+// If TrustProxyHeaders is set up, the client IP is taken from X-Forwarded-For or from X-Real-IP.
+// Entries of X-Forwarded-For are appended by each proxy, so the entry added by the outermost of the TrustedProxyCount proxies is used,
+// entries in front of it may be sent by the client itself. Missing or malformed headers fall back to the address of the connection.
+func (es *eventSource) remoteAddr(req *http.Request) string {
+	settings := es.currentSettings()
+	if !settings.TrustProxyHeaders {
+		return req.RemoteAddr
+	}
+
+	var forwardedFor string
+	if header := req.Header.Values("X-Forwarded-For"); len(header) > 0 {
+		entries := strings.Split(strings.Join(header, ","), ",")
+		if index := len(entries) - settings.GetTrustedProxyCount(); index > 0 {
+			entries = entries[index:]
+		}
+		forwardedFor = entries[0]
+	}
+	for _, addr := range []string{forwardedFor, req.Header.Get("X-Real-IP")} {
+		if addr = strings.TrimSpace(addr); net.ParseIP(remoteIP(addr)) != nil {
+			return addr
+		}
+	}
+	return req.RemoteAddr
+}
+
+// Authenticated validates the user submitted AUTH Token.
+// Channels of a namespace with an own token in NamespaceAuthTokens require this token or the AuthToken.
+func (es *eventSource) Authenticated(req *http.Request) bool {
+	authToken := strings.TrimSpace(req.Header.Get("Auth-Token"))
+	settingsAuthToken := es.currentSettings().GetAuthToken()
+	if namespaceAuthToken := es.currentSettings().GetNamespaceAuthToken(mux.Vars(req)["channel"]); len(namespaceAuthToken) > 0 {
+		return authToken == namespaceAuthToken || (len(settingsAuthToken) > 0 && authToken == settingsAuthToken)
+	}
+	if len(settingsAuthToken) == 0 && len(authToken) == 0 {
+		return true
+	}
+	return len(settingsAuthToken) > 0 && authToken == settingsAuthToken
+}
+
+// AuthenticationFailed rejects a request which failed the authentication.
+// The status code and the error message can be customized via AuthFailureStatus and AuthFailureMessage.
+// Responses with 401 Unauthorized contain a WWW-Authenticate header, which names the Auth-Token header.
+func (es *eventSource) authenticationFailed(rw http.ResponseWriter, message string) {
+	settings := es.currentSettings()
+
+	status := settings.GetAuthFailureStatus()
+	if status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Auth-Token realm="eventsource"`)
+	}
+
+	if len(settings.AuthFailureMessage) > 0 {
+		message = settings.AuthFailureMessage
+	}
+	es.httpError(rw, message, status)
+}
+
+// HttpError responds with an error message in the ErrorFormat.
+// JSON errors are sent as {"error": "..."}, without the 'Error: ' prefix of plain text errors.
+func (es *eventSource) httpError(rw http.ResponseWriter, message string, status int) {
+	if es.currentSettings().GetErrorFormat() != ErrorFormatJSON {
+		http.Error(rw, message, status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(&errorResult{Error: strings.TrimPrefix(message, "Error: ")}); err != nil {
+		es.errorf("Unable to encode error. %s\n", err)
+	}
+}
+
+// IsGlobalChannel checks whether a channel is the reserved channel for global notifications.
+// If the global channel is disabled, every channel is an ordinary channel.
+func (es *eventSource) isGlobalChannel(channel string) bool {
+	settings := es.currentSettings()
+	return !settings.DisableGlobalChannel && channel == settings.GetGlobalChannelName()
+}
+
+// ValidChannelName validates a channel name against the channel route pattern. Reserved names of other routes are invalid.
+func validChannelName(channel string) bool {
+	return channelNameRegexp.MatchString(channel) && !reservedChannelNames[channel]
+}
+
+// UnreservedChannel matches requests of channel routes, unless the channel name is reserved for another route,
+// so e.g. 'DELETE /broadcast' is answered with '404 Not Found' instead of closing a channel named 'broadcast'.
+func unreservedChannel(basePath string) mux.MatcherFunc {
+	return func(req *http.Request, _ *mux.RouteMatch) bool {
+		channel, _, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, basePath+"/"), "/")
+		return !reservedChannelNames[channel]
+	}
+}
+
+// ValidBasePath validates a base path, which has to start with a slash and must not end with a slash.
+func validBasePath(basePath string) bool {
+	return len(basePath) > 1 && strings.HasPrefix(basePath, "/") && !strings.HasSuffix(basePath, "/")
+}
+
+// IsEventStream checks whether the submitted Content-Type is a pre-formatted event stream.
+func isEventStream(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "text/event-stream")
+}
+
+// IsPlainText checks whether the submitted Content-Type is plain text, which is published as a stream.
+func isPlainText(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "text/plain")
+}
+
+// AcceptsJSON checks whether the given Accept header explicitly accepts JSON responses.
+func acceptsJSON(accept string) bool {
+	return strings.Contains(strings.ToLower(accept), "application/json")
+}
+
+// AcceptsEventStream checks whether the given Accept header allows event streams.
+// An omitted Accept header accepts any response, wildcards like '*/*' and 'text/*' match as well.
+func acceptsEventStream(accept string) bool {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return true
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(mediaRange, ";")
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "text/event-stream", "text/*", "*/*":
+		default:
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// IsJSONLines checks whether the submitted Content-Type is a batch of JSON lines.
+func isJSONLines(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "application/x-ndjson")
+}
+
+// ValidContentType validates the submitted Content-Type.
+func validContentType(contentType string) bool {
+	if strings.Contains(strings.ToLower(contentType), "application/json") {
+		return true
+	}
+	return false
+}
+
+// ActionDispatcher is the central hub of the EventSource service.
+func (es *eventSource) actionDispatcher() {
+	pruneTicker := time.NewTicker(es.pruneInterval())
+	defer pruneTicker.Stop()
+
+	var adaptRetry <-chan time.Time
+	if adaptiveRetryInterval := es.currentSettings().GetAdaptiveRetryInterval(); adaptiveRetryInterval > 0 {
+		adaptTicker := time.NewTicker(adaptiveRetryInterval)
+		defer adaptTicker.Stop()
+		adaptRetry = adaptTicker.C
+	}
+
+	for {
+		select {
+
+		// em.messageRouter is responsible for delivering messages to consumers of channels.
+		case dl := <-es.messageRouter:
+			var err error
+			if es.currentSettings().RejectUnknownChannels && !es.knownChannel(dl.message.Channel) {
+				err = errUnknownChannel
+			} else if es.shuttingDown() && dl.result != nil {
+				err = ErrStopped
+			} else if es.draining[dl.message.Channel] && dl.result != nil {
+				err = errChannelDraining
+			} else if dl.message.deferred() && len(es.scheduled) >= es.currentSettings().GetMaxScheduledMessages() {
+				err = errTooManyScheduled
+			} else {
+				dl.consumerCount, dl.id = es.routeMessage(dl.message)
+			}
+			if dl.result != nil {
+				dl.result <- err
+			}
+
+		// em.broadcastRouter is responsible for delivering a message to consumers of several channels.
+		case bc := <-es.broadcastRouter:
+			var err error
+			if es.currentSettings().RejectUnknownChannels {
+				for _, channel := range bc.channels {
+					if !es.knownChannel(channel) {
+						err = errUnknownChannel
+						break
+					}
+				}
+			}
+			if err == nil {
+				for _, channel := range bc.channels {
+					em := *bc.message
+					em.Channel = channel
+					es.routeMessage(&em)
+				}
+			}
+			if bc.result != nil {
+				bc.result <- err
+			}
+
+		// em.scheduledRouter is responsible for delivering scheduled messages at their delivery time.
+		case s := <-es.scheduledRouter:
+			es.deliverScheduled(s)
+
+		// em.targetRouter is responsible for delivering a message to a single consumer.
+		case td := <-es.targetRouter:
+			td.result <- es.routeTargetedMessage(td)
+
+		// em.createChannel is responsible for registering channels without consumers.
+		case channel := <-es.createChannel:
+			if _, ok := es.consumers[channel]; !ok {
+				es.infof("Creating channel '%s'\n", channel)
+				es.consumers[channel] = []*consumer{}
+			}
+			es.created[channel] = true
+
+		// em.closeChannel is responsible for closing seleted channels.
+		case channels := <-es.closeChannel:
+			es.closeChannels(channels)
+
+		// em.closeAll is responsible for closing all channels.
+		case <-es.closeAll:
+			es.infof("Closing all channels and disconnecting consumers\n")
+			for _, channelConsumers := range es.consumers {
+				for _, channelConsumer := range channelConsumers {
+					es.setCloseMessage(channelConsumer)
+				}
+			}
+			es.closeAllChannels()
+
+		// em.closeNamespace is responsible for closing all channels of a namespace.
+		case namespace := <-es.closeNamespace:
+			es.infof("Closing namespace '%s'\n", namespace)
+			es.closeChannels(es.namespaceChannels(namespace))
+
+		// em.pauseChannel is responsible for holding the messages of paused channels and releasing them on resume.
+		case p := <-es.pauseChannel:
+			held, paused := es.paused[p.channel]
+			switch {
+			case p.paused && !paused:
+				es.infof("Channel '%s' paused\n", p.channel)
+				es.paused[p.channel] = []*eventMessage{}
+			case !p.paused && paused:
+				es.infof("Channel '%s' resumed, delivering %d held messages\n", p.channel, len(held))
+				delete(es.paused, p.channel)
+				es.releaseMessages(p.channel, held)
+			}
+
+		// em.drainChannel is responsible for draining channels.
+		// Closed inboxes still deliver queued messages, before the consumers get disconnected.
+		case dr := <-es.drainChannel:
+			if dr.result == nil {
+				es.infof("Channel '%s' drained\n", dr.channel)
+				delete(es.draining, dr.channel)
+				continue
+			}
+
+			es.infof("Draining channel '%s' and disconnecting consumers\n", dr.channel)
+			es.draining[dr.channel] = true
+			finished := make([]<-chan struct{}, 0, len(es.consumers[dr.channel]))
+			for _, channelConsumer := range es.consumers[dr.channel] {
+				es.closeConsumer(channelConsumer)
+				finished = append(finished, channelConsumer.finished)
+			}
+			delete(es.consumers, dr.channel)
+			delete(es.created, dr.channel)
+			es.dropHistory(dr.channel)
+			delete(es.channelBytes, dr.channel)
+			delete(es.recentIds, dr.channel)
+			delete(es.paused, dr.channel)
+			es.discardScheduled(dr.channel)
+			dr.result <- finished
+
+		// em.collectStats is responsible for taking a snapshot of the channels and their consumers.
+		case result := <-es.collectStats:
+			stats := Stats{
+				TotalConsumers:    es.totalConsumers(),
+				Channels:          make(map[string]int, len(es.consumers)),
+				MessagesPublished: es.messageCount,
+				MessagesDropped:   es.droppedCount,
+				BytesWritten:      atomic.LoadUint64(&es.bytesWritten),
+				ChannelBytes:      make(map[string]uint64, len(es.consumers)),
+			}
+			threshold := es.currentSettings().GetBackpressureThreshold()
+			for channel, consumers := range es.consumers {
+				stats.Channels[channel] = len(consumers)
+				if channelBytes, ok := es.channelBytes[channel]; ok {
+					stats.ChannelBytes[channel] = atomic.LoadUint64(channelBytes)
+				}
+				for _, cr := range consumers {
+					stats.MessagesDropped += atomic.LoadUint64(&cr.dropped)
+					if cr.lagging(threshold) {
+						stats.ConsumersLagging++
+					}
+				}
+			}
+			result <- stats
+
+		// em.consumerInfo is responsible for listing the consumers of channels.
+		case cir := <-es.consumerInfo:
+			channels := []string{cir.channel}
+			if es.isGlobalChannel(cir.channel) {
+				channels = make([]string, 0, len(es.consumers))
+				for channel := range es.consumers {
+					channels = append(channels, channel)
+				}
+				sort.Strings(channels)
+			}
+
+			consumerMetas := make([]ConsumerMeta, 0)
+			for _, channel := range channels {
+				for _, cr := range es.consumers[channel] {
+					consumerMetas = append(consumerMetas, cr.meta())
+				}
+			}
+			cir.result <- consumerMetas
+
+		// em.stopApplication is responsible for shutting down the service properly.
+		// Channels are closed inline, because no one receives from the action channels afterwards.
+		case <-es.stopApplication:
+			es.infof("Halting EventSource server\n")
+			es.closeAllChannels()
+			close(es.done)
+			return
+
+		// em.addConsumer is responsible for adding consumers to channels.
+		case reg := <-es.addConsumer:
+			cr := reg.consumer
+			if maxConsumers := es.currentSettings().GetMaxConsumersTotal(); maxConsumers > 0 && es.totalConsumers() >= maxConsumers {
+				reg.result <- errMaxConsumersReached
+				continue
+			}
+			if es.shuttingDown() {
+				reg.result <- ErrStopped
+				continue
+			}
+			if es.draining[cr.channel] {
+				reg.result <- errChannelDraining
+				continue
+			}
+			if maxConnections := es.currentSettings().GetMaxConnectionsPerIP(); maxConnections > 0 && len(cr.ip) > 0 && es.connections[cr.ip] >= maxConnections {
+				reg.result <- errTooManyConnections
+				continue
+			}
+			if len(cr.ip) > 0 {
+				es.connections[cr.ip]++
+			}
+			es.debugf("Consumer %s joined channel '%s'\n", cr.remoteAddr, cr.channel)
+			es.consumers[cr.channel] = append(es.consumers[cr.channel], cr)
+			if _, ok := es.channelBytes[cr.channel]; !ok {
+				es.channelBytes[cr.channel] = new(uint64)
+			}
+			cr.channelBytes = es.channelBytes[cr.channel]
+			cr.replay = es.replayMessages(cr.channel, cr.replayRequest)
+			reg.result <- nil
+
+		// em.pruneTicker is responsible for removing messages which are older than the replay window
+		// and event IDs which are older than the dedup window.
+		case <-pruneTicker.C:
+			if es.replayWindow > 0 {
+				es.pruneHistory()
+			}
+			es.pruneRecentIds()
+
+		// em.adaptRetry is responsible for adjusting the advertised reconnection time to the load.
+		case <-adaptRetry:
+			es.adaptRetry()
+
+		// em.expireConsumer is responsible disconnecting and removing staled consumers.
+		case expiredConsumer := <-es.expireConsumer:
+			if consumers, ok := es.consumers[expiredConsumer.channel]; ok {
+				consumerSlice := make([]*consumer, 0)
+				removed := false
+
+				for _, cr := range consumers {
+					if cr != expiredConsumer {
+						consumerSlice = append(consumerSlice, cr)
+					} else {
+						removed = true
 					}
 				}
 
 				es.consumers[expiredConsumer.channel] = consumerSlice
-				close(expiredConsumer.inbox)
+				if removed {
+					es.debugf("Consumer %s expired and gets removed from channel '%s'\n", expiredConsumer.remoteAddr, expiredConsumer.channel)
+					es.closeConsumer(expiredConsumer)
+				}
+
+				if removed && len(consumerSlice) == 0 && es.currentSettings().CloseEmptyChannels {
+					es.removeEmptyChannel(expiredConsumer.channel)
+				}
+			}
+		}
+	}
+}
+
+// PruneInterval returns the interval in which the history and the recent event IDs are pruned.
+// It's the shorter of the replay window and the DedupWindow, but at most maxPruneInterval,
+// so a DedupWindow which is set up later is covered as well.
+func (es *eventSource) pruneInterval() time.Duration {
+	interval := maxPruneInterval
+	for _, window := range []time.Duration{es.replayWindow, es.currentSettings().GetDedupWindow()} {
+		if window > 0 && window < interval {
+			interval = window
+		}
+	}
+	return interval
+}
+
+// CloseChannels closes the given channels and disconnects their consumers.
+func (es *eventSource) closeChannels(channels []string) {
+	for _, channel := range channels {
+		if channelConsumers, ok := es.consumers[channel]; ok {
+			es.infof("Closing channel '%s' and disconnecting consumers\n", channel)
+			for _, channelConsumer := range channelConsumers {
+				es.setCloseMessage(channelConsumer)
+				es.closeConsumer(channelConsumer)
+			}
+			delete(es.consumers, channel)
+		}
+		delete(es.created, channel)
+		es.dropHistory(channel)
+		delete(es.recentIds, channel)
+		delete(es.paused, channel)
+		delete(es.channelBytes, channel)
+		es.discardScheduled(channel)
+	}
+}
+
+// NamespaceChannels returns all channels of a namespace, which have consumers or were created explicitly.
+func (es *eventSource) namespaceChannels(namespace string) []string {
+	var channels []string
+	for channel := range es.consumers {
+		if es.currentSettings().namespace(channel) == namespace {
+			channels = append(channels, channel)
+		}
+	}
+	for channel := range es.created {
+		if _, ok := es.consumers[channel]; !ok && es.currentSettings().namespace(channel) == namespace {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// RemoveEmptyChannel removes a channel without consumers, including its history and ID sequence.
+// Channels which were preregistered or created explicitly are kept, as well as channels being drained.
+func (es *eventSource) removeEmptyChannel(channel string) {
+	if es.created[channel] || es.draining[channel] {
+		return
+	}
+
+	es.infof("Removing channel '%s' without consumers\n", channel)
+	delete(es.consumers, channel)
+	es.dropHistory(channel)
+	delete(es.recentIds, channel)
+	delete(es.sequences, channel)
+	delete(es.channelBytes, channel)
+}
+
+// CloseAllChannels closes all available channels and disconnects their consumers.
+func (es *eventSource) closeAllChannels() {
+	for channelName, channelConsumers := range es.consumers {
+		for _, channelConsumer := range channelConsumers {
+			es.closeConsumer(channelConsumer)
+		}
+		delete(es.consumers, channelName)
+	}
+	es.created = make(map[string]bool)
+	es.history = make(map[string][]*historyEntry)
+	es.historyBytes = 0
+	es.recentIds = make(map[string]*recentIds)
+	es.paused = make(map[string][]*eventMessage)
+	es.channelBytes = make(map[string]*uint64)
+	es.discardScheduled("")
+}
+
+// SetCloseMessage hands the message of the ChannelCloseMessage callback over to a consumer, which is about to be closed.
+// The consumer writes the message right before it's disconnected.
+func (es *eventSource) setCloseMessage(cr *consumer) {
+	if channelCloseMessage := es.currentSettings().ChannelCloseMessage; channelCloseMessage != nil {
+		if e := channelCloseMessage(cr.channel); e != nil {
+			cr.closeMessage = eventMessageFromEvent(e, cr.channel)
+		}
+	}
+}
+
+// CloseConsumer closes the inbox of a consumer, which disconnects it, and releases its connection of the remote IP.
+// The messages dropped for the consumer are kept, so the stats show all dropped messages.
+func (es *eventSource) closeConsumer(cr *consumer) {
+	close(cr.inbox)
+	es.droppedCount += atomic.LoadUint64(&cr.dropped)
+	if len(cr.ip) > 0 {
+		if es.connections[cr.ip]--; es.connections[cr.ip] <= 0 {
+			delete(es.connections, cr.ip)
+		}
+	}
+}
+
+// TotalConsumers returns the overall amount of consumers. It's only used by the dispatcher.
+func (es *eventSource) totalConsumers() int {
+	var consumerCount int
+	for _, consumers := range es.consumers {
+		consumerCount += len(consumers)
+	}
+	return consumerCount
+}
+
+// KnownChannel checks whether a channel has consumers or was created explicitly.
+// The global channel is always known.
+func (es *eventSource) knownChannel(channel string) bool {
+	return es.isGlobalChannel(channel) || len(es.consumers[channel]) > 0 || es.created[channel]
+}
+
+// InterceptMessage passes a message to the MessageInterceptor, if set up.
+// It returns the message which should be delivered and whether it should be delivered at all.
+func (es *eventSource) interceptMessage(em *eventMessage) (*eventMessage, bool) {
+	messageInterceptor := es.currentSettings().MessageInterceptor
+	if messageInterceptor == nil {
+		return em, true
+	}
+
+	e, ok := messageInterceptor(em.Channel, em.event())
+	if !ok {
+		return nil, false
+	}
+
+	if e == nil {
+		return em, true
+	}
+	return eventMessageFromEvent(e, em.Channel), true
+}
+
+// AssignId keeps track of the event IDs of each channel.
+// If AutoAssignIDs is set up, messages without an ID get the next ID of their channel.
+func (es *eventSource) assignId(em *eventMessage) {
+	if !es.currentSettings().AutoAssignIDs {
+		return
+	}
+
+	if em.Id == 0 {
+		em.Id = es.sequences[em.Channel] + 1
+	}
+	if em.Id > es.sequences[em.Channel] {
+		es.sequences[em.Channel] = em.Id
+	}
+}
+
+// PrepareMessage names, intercepts, numbers, timestamps and signs a message before it's delivered.
+// If the message is a duplicate or dropped by the MessageInterceptor, false is returned.
+func (es *eventSource) prepareMessage(em *eventMessage) (*eventMessage, bool) {
+	if es.isDuplicate(em) {
+		return nil, false
+	}
+
+	if len(em.Event) == 0 {
+		em.Event = es.currentSettings().GetChannelDefaultEvent(em.Channel)
+	}
+
+	em, ok := es.interceptMessage(em)
+	if !ok {
+		return nil, false
+	}
+	es.assignId(em)
+	if es.currentSettings().InjectTimestamp {
+		em.Comments = append(comments{timestampComment(time.Now())}, em.Comments...)
+	}
+	if signingKey := es.currentSettings().SigningKey; len(signingKey) > 0 {
+		em.sign(signingKey)
+	}
+	return em, true
+}
+
+// TimestampComment returns the comment, which tells consumers when the server sent a message, e.g. 'timestamp 2014-06-01T12:00:00.000Z'.
+// The timestamp is in RFC3339 format with milliseconds in UTC.
+func timestampComment(t time.Time) string {
+	return "timestamp " + t.UTC().Format(timestampFormat)
+}
+
+// RouteTargetedMessage delivers a message to the consumer of the given ID. It's only used by the dispatcher.
+// Consumers are looked up across all channels, as targeted messages are rare compared to published ones.
+func (es *eventSource) routeTargetedMessage(td *targetedDelivery) error {
+	for _, channelConsumers := range es.consumers {
+		for _, cr := range channelConsumers {
+			if cr.id != td.consumerId || cr.expired.Load() {
+				continue
+			}
+
+			em := *td.message
+			em.Channel = cr.channel
+			if signingKey := es.currentSettings().SigningKey; len(signingKey) > 0 {
+				em.sign(signingKey)
+			}
+
+			select {
+			case cr.inbox <- &em:
+				es.debugf("Sending targeted message to consumer %s on channel '%s'\n", cr.remoteAddr, cr.channel)
+				return nil
+			default:
+				atomic.AddUint64(&cr.dropped, 1)
+				return errConsumerBusy
+			}
+		}
+	}
+	return ErrUnknownConsumer
+}
+
+// ReleaseMessages routes the messages held while a channel was paused. They are combined into a batch,
+// so consumers receive them in a single write, instead of dropping all but the first for consumers which don't keep up.
+// Raw messages can't be part of a batch and are routed on their own.
+func (es *eventSource) releaseMessages(channel string, held []*eventMessage) {
+	var batch []*eventMessage
+	flush := func() {
+		if len(batch) > 0 {
+			es.routeMessage(&eventMessage{Channel: channel, batch: batch})
+			batch = nil
+		}
+	}
+
+	for _, em := range held {
+		switch {
+		case em.batch != nil:
+			batch = append(batch, em.batch...)
+		case em.raw != nil:
+			flush()
+			es.routeMessage(em)
+		default:
+			batch = append(batch, em)
+		}
+	}
+	flush()
+}
+
+// RouteMessage delivers a message to the consumers of its channel and returns the number of consumers it was enqueued to
+// and the ID of the message, which is the ID of the last message for batches.
+// Messages of the global channel are delivered to all consumers. Messages dropped by the MessageInterceptor reach no one.
+//
+// As all messages pass this single dispatcher and inboxes are FIFO queues, each consumer receives the messages
+// of a channel in publish order. If a consumer doesn't keep up, the newest message is dropped for this consumer,
+// so messages may be missing, but are never reordered.
+// After the local delivery, the message is queued for the forwarding to the forward URL of its channel.
+func (es *eventSource) routeMessage(em *eventMessage) (int, uint) {
+	if es.draining[em.Channel] {
+		return 0, 0
+	}
+
+	if em.deferred() {
+		es.scheduleMessage(em)
+		return 0, 0
+	}
+
+	if held, paused := es.paused[em.Channel]; paused {
+		// Streamed messages are read while they're delivered, so they can't be held.
+		if em.stream != nil {
+			es.debugf("Streamed message to paused channel '%s' dropped\n", em.Channel)
+			es.droppedCount++
+			return 0, 0
+		}
+		if len(held) < es.currentSettings().GetMaxPausedMessages() {
+			es.paused[em.Channel] = append(held, em)
+		} else {
+			es.debugf("Message to paused channel '%s' dropped, %d messages are held already\n", em.Channel, len(held))
+			es.droppedCount++
+		}
+		return 0, 0
+	}
+
+	if em.batch != nil {
+		// Each message of a batch is processed on its own, but written to consumers at once.
+		var batch []*eventMessage
+		var messageData bytes.Buffer
+		for _, bm := range em.batch {
+			if bm, ok := es.prepareMessage(bm); ok {
+				es.storeMessage(bm)
+				batch = append(batch, bm)
+				messageData.Write(bm.Message())
+			}
+		}
+
+		if len(batch) == 0 {
+			return 0, 0
+		}
+		es.messageCount += uint64(len(batch))
+		em = &eventMessage{Channel: em.Channel, raw: messageData.Bytes(), batch: batch}
+	} else {
+		// Raw messages are relayed verbatim and the data of streamed messages is unknown upfront,
+		// so they can't be named, intercepted, numbered, timestamped or signed.
+		if em.raw == nil && em.stream == nil {
+			var ok bool
+			if em, ok = es.prepareMessage(em); !ok {
+				return 0, 0
+			}
+		}
+		es.storeMessage(em)
+		es.messageCount++
+	}
+
+	consumerCount := 0
+	switch {
+	default:
+		if channelConsumers, ok := es.consumers[em.Channel]; ok {
+			for _, channelConsumer := range channelConsumers {
+				if cr := channelConsumer; !cr.expired.Load() && cr.enqueue(em) {
+					consumerCount++
+				}
+			}
+		}
+	case es.isGlobalChannel(em.Channel):
+		es.debugf("Sending global notification to all consumers\n")
+		for _, channelConsumers := range es.consumers {
+			for _, channelConsumer := range channelConsumers {
+				if cr := channelConsumer; !cr.expired.Load() && cr.enqueue(em) {
+					consumerCount++
+				}
 			}
 		}
 	}
+
+	es.forwardMessage(em)
+
+	id := em.Id
+	if em.batch != nil {
+		id = em.batch[len(em.batch)-1].Id
+	}
+	return consumerCount, id
 }
@@ -5,14 +5,23 @@
 package eventsource
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -57,14 +66,19 @@ func readResponse(t *testing.T, conn net.Conn) []byte {
 	return resp
 }
 
-// Helper for joining an EventSource channel
-func (es *testEventSource) joinChannel(t *testing.T, channel string) (net.Conn, []byte) {
+// Helper for joining an EventSource channel, optionally with additional request headers
+func (es *testEventSource) joinChannel(t *testing.T, channel string, headers ...string) (net.Conn, []byte) {
 	conn, err := net.Dial("tcp", strings.Replace(es.testServer.URL, "http://", "", 1))
 	if err != nil {
 		t.Error(err)
 	}
 
-	if _, err := conn.Write([]byte("GET /" + channel + " HTTP/1.1\n\n")); err != nil {
+	request := "GET /" + channel + " HTTP/1.1\nHost: localhost\n"
+	for _, header := range headers {
+		request += header + "\n"
+	}
+
+	if _, err := conn.Write([]byte(request + "\n")); err != nil {
 		t.Error(err)
 	}
 
@@ -79,6 +93,17 @@ func expectResponse(t *testing.T, conn net.Conn, expectedResponse string) {
 	}
 }
 
+// Helper to ensure that no EventSource response arrives
+func expectNoResponse(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	resp := make([]byte, 1024)
+	if n, err := conn.Read(resp); err == nil {
+		t.Errorf("Expected no response and got:\n%s\n", resp[:n])
+	}
+}
+
 // Helper function to build EventMessages
 func buildMessageData(messageType string) io.Reader {
 	var messageStream io.Reader
@@ -130,13 +155,23 @@ func TestRouter(t *testing.T) {
 		t.Error("Method 'DELETE' is not allowed for channel name 'default'")
 	}
 
+	// Testing Router with a OPTIONS Request and a proper formated channel name
+	req, err = http.NewRequest("OPTIONS", "http://127.0.0.1/default", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !router.Match(req, &match) {
+		t.Error("Method 'OPTIONS' is not allowed for channel name 'default'")
+	}
+
 	// Testing Router with a PUT Request and a proper formated channel name
 	req, err = http.NewRequest("PUT", "http://127.0.0.1/default", nil)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if router.Match(req, &match) {
+	if !router.Match(req, &match) || match.MatchErr != mux.ErrMethodMismatch {
 		t.Error("Method 'PUT' is not allowed for channel name 'default'")
 	}
 
@@ -146,7 +181,8 @@ func TestRouter(t *testing.T) {
 		t.Error(err)
 	}
 
-	if router.Match(req, &match) {
+	match = mux.RouteMatch{}
+	if router.Match(req, &match) && match.Route != nil {
 		t.Error("Method 'GET' on is not allowed wrong formated for channel name 'DEFAULT'")
 	}
 
@@ -156,7 +192,8 @@ func TestRouter(t *testing.T) {
 		t.Error(err)
 	}
 
-	if router.Match(req, &match) {
+	match = mux.RouteMatch{}
+	if router.Match(req, &match) && match.Route != nil {
 		t.Error("Method 'POST' is not allowed for wrong formated channel ' nameDEFAULT'")
 	}
 
@@ -166,7 +203,8 @@ func TestRouter(t *testing.T) {
 		t.Error(err)
 	}
 
-	if router.Match(req, &match) {
+	match = mux.RouteMatch{}
+	if router.Match(req, &match) && match.Route != nil {
 		t.Error("Method 'DELETE' is not allowed for wrong formated channel ' nameDEFAULT'")
 	}
 }
@@ -178,346 +216,3555 @@ func TestConnection(t *testing.T) {
 	conn, resp := es.joinChannel(t, "default")
 	defer conn.Close()
 
-	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\n") {
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
 		t.Error("Response has no HTTP status")
 	}
 
-	if !strings.Contains(string(resp), "Content-Type: text/event-stream\n") {
-		t.Error("Response header does not contain 'Content-Type: text/event-stream'")
+	if !strings.Contains(string(resp), "Content-Type: text/event-stream; charset=utf-8\r\n") {
+		t.Error("Response header does not contain 'Content-Type: text/event-stream; charset=utf-8'")
+	}
+
+	if !strings.Contains(string(resp), "X-Accel-Buffering: no\r\n") {
+		t.Error("Response header does not contain 'X-Accel-Buffering: no'")
 	}
 
-	if !strings.Contains(string(resp), "Cache-Control: no-cache\n") {
+	if !strings.Contains(string(resp), "Cache-Control: no-cache\r\n") {
 		t.Error("Response header does not contain 'Cache-Control: no-cache'")
 	}
 
-	if !strings.Contains(string(resp), "Connection: keep-alive\n") {
+	if !strings.Contains(string(resp), "Connection: keep-alive\r\n") {
 		t.Error("Response header does not contain 'Connection: keep-alive'")
 	}
 
-	if !strings.Contains(string(resp), "Access-Control-Allow-Origin: 127.0.0.1\n") {
+	if !strings.Contains(string(resp), "Access-Control-Allow-Origin: 127.0.0.1\r\n") {
 		t.Error("Response header does not contain 'Access-Control-Allow-Origin: 127.0.0.1'")
 	}
 
-	if !strings.Contains(string(resp), "Access-Control-Allow-Method: GET\n") {
+	if !strings.Contains(string(resp), "Access-Control-Allow-Method: GET\r\n") {
 		t.Error("Response header does not contain 'Access-Control-Allow-Method: GET'")
 	}
+
+	if !strings.Contains(string(resp), "Access-Control-Allow-Headers: Content-Type, Auth-Token\r\n") {
+		t.Error("Response header does not contain 'Access-Control-Allow-Headers: Content-Type, Auth-Token'")
+	}
 }
 
-func TestAuthToken(t *testing.T) {
+func TestMaxConnectionsPerIP(t *testing.T) {
 	es := setupEventSource(t,
 		&Settings{
-			AuthToken: "secrect",
+			MaxConnectionsPerIP: 2,
 		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	conn1, _ := es.joinChannel(t, "default")
+	conn2, _ := es.joinChannel(t, "my-channel")
+	defer conn2.Close()
 
-	req, err := http.NewRequest("DELETE", es.testServer.URL+"/default", nil)
-	if err != nil {
-		t.Error("Creating DELETE request failed with", err)
-	}
-	req.Header.Add("Auth-Token", "secrect")
+	conn3, resp := es.joinChannel(t, "default")
+	defer conn3.Close()
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.Error("Unable to send DELETE request")
+	if !strings.Contains(string(resp), "429 Too Many Requests") {
+		t.Error("Expected third connection of the same IP to be rejected, got", string(resp))
 	}
 
-	if resp.StatusCode != 200 {
-		t.Error("DELETE request of channel failed with status code", resp.StatusCode)
+	// Disconnected consumers release their connection
+	conn1.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn4, resp := es.joinChannel(t, "default")
+	defer conn4.Close()
+
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Expected connection after a disconnect to be accepted, got", string(resp))
 	}
 }
 
-func TestSendMessage(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestTrustProxyHeaders(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			TrustProxyHeaders:   true,
+			MaxConnectionsPerIP: 1,
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	conn1, _ := es.joinChannel(t, "default", "X-Forwarded-For: 203.0.113.7")
+	defer conn1.Close()
 
-	// Test EventMessage in different modes
-	for _, mode := range messageModes() {
-		messageStream := buildMessageData(mode)
-		var expectedMessage bytes.Buffer
+	if info := es.eventSource.ConsumerInfo("default"); len(info) != 1 || info[0].RemoteAddr != "203.0.113.7" {
+		t.Error("Expected the forwarded IP to be recorded, got", info)
+	}
 
-		if mode != ModeNoid {
-			expectedMessage.WriteString("id: 1\n")
-		}
+	// Limits apply to the forwarded IP, not to the proxy, and can't be avoided by entries of the client
+	conn2, resp := es.joinChannel(t, "default", "X-Forwarded-For: 192.0.2.1, 203.0.113.7")
+	defer conn2.Close()
 
-		if mode != ModeNoevent {
-			expectedMessage.WriteString("event: foo\n")
-		}
+	if !strings.Contains(string(resp), "429 Too Many Requests") {
+		t.Error("Expected second connection of the forwarded IP to be rejected, got", string(resp))
+	}
 
-		if mode != ModeNodata {
-			expectedMessage.WriteString("data: bar\n")
-		}
-		expectedMessage.WriteString("\n")
+	conn3, resp := es.joinChannel(t, "default", "X-Real-IP: 198.51.100.1")
+	defer conn3.Close()
 
-		es.eventSource.SendMessage(messageStream, "default")
-		expectResponse(t, conn, string(expectedMessage.Bytes()))
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Expected connection of another forwarded IP to be accepted, got", string(resp))
 	}
 }
 
-func TestSendMessageViaHTTPPost(t *testing.T) {
-	es := setupEventSource(t, nil)
-	defer es.closeEventSource()
+func TestRemoteAddr(t *testing.T) {
+	req := httptest.NewRequest("GET", "/default", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	es := &eventSource{settings: &Settings{}}
+	if addr := es.remoteAddr(req); addr != "10.0.0.1:1234" {
+		t.Error("Expected proxy headers to be ignored unless trusted, got", addr)
+	}
+
+	es.settings.TrustProxyHeaders = true
+	for header, expected := range map[string]string{
+		"192.0.2.1, 203.0.113.7": "203.0.113.7",
+		"2001:db8::1":            "2001:db8::1",
+		"203.0.113.7, not-an-ip": "10.0.0.1:1234",
+		"":                       "10.0.0.1:1234",
+	} {
+		req.Header.Set("X-Forwarded-For", header)
+		if addr := es.remoteAddr(req); addr != expected {
+			t.Errorf("Expected '%s' for X-Forwarded-For '%s', got '%s'", expected, header, addr)
+		}
+	}
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	// Behind two proxies, the entry of the outer proxy is used
+	es.settings.TrustedProxyCount = 2
+	req.Header.Set("X-Forwarded-For", "192.0.2.1, 203.0.113.7, 10.0.0.2")
+	if addr := es.remoteAddr(req); addr != "203.0.113.7" {
+		t.Error("Expected '203.0.113.7' behind two proxies, got", addr)
+	}
+}
 
-	// Test EventMessage in different modes
-	for _, mode := range messageModes() {
-		messageStream := buildMessageData(mode)
-		var expectedMessage bytes.Buffer
+// Helper implementing a http.ResponseWriter, which doesn't support streaming
+type nonStreamingWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
 
-		if mode != ModeNoid {
-			expectedMessage.WriteString("id: 1\n")
-		}
+func (w *nonStreamingWriter) Header() http.Header         { return w.header }
+func (w *nonStreamingWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *nonStreamingWriter) WriteHeader(status int)      { w.status = status }
 
-		if mode != ModeNoevent {
-			expectedMessage.WriteString("event: foo\n")
-		}
+func TestStreamingUnsupported(t *testing.T) {
+	es := New(nil).(*eventSource)
+	defer es.Stop()
 
-		if mode != ModeNodata {
-			expectedMessage.WriteString("data: bar\n")
-		}
-		expectedMessage.WriteString("\n")
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/default", nil), map[string]string{"channel": "default"})
+	rw := &nonStreamingWriter{header: http.Header{}}
+	es.subscribeHandler(rw, req)
 
-		resp, err := http.Post(es.testServer.URL+"/default", "application/json", messageStream)
-		if err != nil {
-			t.Error("POST event failed with", err)
-		}
+	if rw.status != http.StatusInternalServerError {
+		t.Error("Expected status code 500, got", rw.status)
+	}
 
-		if resp.StatusCode != 201 {
-			t.Error("POST event failed with status code", resp.StatusCode)
-		}
+	if !strings.Contains(rw.body.String(), "doesn't support streaming") {
+		t.Error("Expected a descriptive error message, got", rw.body.String())
+	}
 
-		expectResponse(t, conn, string(expectedMessage.Bytes()))
+	if consumerCount := es.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected the consumer to be removed, got", consumerCount)
 	}
 }
 
-func TestChannelExists(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestMiddleware(t *testing.T) {
+	var order []string
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				rw.Header().Add("X-Middleware", name)
+				next.ServeHTTP(rw, req)
+			})
+		}
+	}
+
+	es := setupEventSource(t,
+		&Settings{
+			Middleware: []func(http.Handler) http.Handler{middleware("outer"), middleware("inner")},
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
+	conn, resp := es.joinChannel(t, "default")
 	defer conn.Close()
 
-	if !es.eventSource.ChannelExists("default") {
-		t.Error("Channel 'default' should exist")
+	if !strings.Contains(string(resp), "X-Middleware: outer\r\nX-Middleware: inner\r\n") {
+		t.Error("Expected the headers of both middlewares on the subscribe response, got", string(resp))
 	}
 
-	if es.eventSource.ChannelExists("my-channel") {
-		t.Error("Channel 'my-channel' should not exist")
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+		t.Error("Expected the first middleware to be the outermost, got", order)
+	}
+
+	es.eventSource.SendEvent(Event{Data: "streamed"}, "default")
+	expectResponse(t, conn, "data: streamed\n\n")
+
+	// Unknown routes and unsupported methods pass the middleware as well
+	for request, status := range map[[2]string]int{{"GET", "/INVALID"}: http.StatusNotFound, {"PUT", "/default"}: http.StatusMethodNotAllowed} {
+		order = nil
+		req, _ := http.NewRequest(request[0], es.testServer.URL+request[1], nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send request", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != status || len(order) != 2 || order[0] != "outer" || order[1] != "inner" {
+			t.Errorf("Expected status code %d after both middlewares for %s %s, got %d and %v", status, request[0], request[1], resp.StatusCode, order)
+		}
+		if middlewares := resp.Header.Values("X-Middleware"); len(middlewares) != 2 {
+			t.Errorf("Expected the headers of both middlewares for %s %s, got %v", request[0], request[1], middlewares)
+		}
 	}
 }
 
-func TestConsumerCount(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestOnConnectMessage(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			OnConnectMessage: func(channel string) *Event {
+				return &Event{Event: "welcome", Data: "hello " + channel}
+			},
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
+	conn, resp := es.joinChannel(t, "default")
 	defer conn.Close()
 
-	if es.eventSource.ConsumerCount("default") > 1 {
-		t.Error("ConsumerCount for channel 'default' is invalid")
+	if !strings.Contains(string(resp), "event: welcome\ndata: hello default\n\n") {
+		t.Error("Response does not contain the welcome event after the headers")
 	}
 }
 
-func TestConsumerCountAll(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestDefaultRetry(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			DefaultRetry: 10 * time.Second,
+			OnConnectMessage: func(channel string) *Event {
+				return &Event{Event: "connected"}
+			},
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
+	conn, resp := es.joinChannel(t, "default")
 	defer conn.Close()
 
-	if es.eventSource.ConsumerCountAll() > 1 {
-		t.Error("ConsumerCountAll is invalid")
+	if !strings.Contains(string(resp), "retry: 10000\n\nevent: connected\n\n") {
+		t.Error("Response does not contain the retry field before the welcome event, got", string(resp))
 	}
 }
 
-func TestChannels(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestOmitAccelBuffering(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			OmitAccelBuffering: true,
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
+	conn, resp := es.joinChannel(t, "default")
 	defer conn.Close()
 
-	if es.eventSource.Channels()[0] != "default" {
-		t.Error("Returned channel names are invalid")
+	if strings.Contains(string(resp), "X-Accel-Buffering") {
+		t.Error("Response header should not contain 'X-Accel-Buffering'")
 	}
 }
 
-func TestChannelClose(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestMaxConsumersTotal(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			MaxConsumersTotal: 2,
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	conn1, resp := es.joinChannel(t, "default")
+	defer conn1.Close()
 
-	if !es.eventSource.ChannelExists("default") {
-		t.Error("Channel 'default' should exist")
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("First consumer should be accepted")
 	}
 
-	es.eventSource.Close("default")
-	time.Sleep(100 * time.Millisecond)
+	conn2, resp := es.joinChannel(t, "my-channel")
+	defer conn2.Close()
 
-	if es.eventSource.ChannelExists("default") {
-		t.Error("Channel 'default' should not exist")
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Second consumer should be accepted")
 	}
-}
 
-func TestChannelCloseViaHTTPDelete(t *testing.T) {
-	es := setupEventSource(t, nil)
-	defer es.closeEventSource()
+	conn3, resp := es.joinChannel(t, "default")
+	defer conn3.Close()
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	if !strings.Contains(string(resp), "503 Service Unavailable") {
+		t.Error("Third consumer should be rejected with status code 503")
+	}
 
-	if !es.eventSource.ChannelExists("default") {
-		t.Error("Channel 'default' should exist")
+	if consumerCount := es.eventSource.ConsumerCountAll(); consumerCount != 2 {
+		t.Error("Expected 2 consumers, got", consumerCount)
 	}
+}
 
-	req, err := http.NewRequest("DELETE", es.testServer.URL+"/default", nil)
+func TestPreflight(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			CorsAllowOrigin: "*",
+			CorsAllowMethod: []string{"GET", "POST"},
+		})
+	defer es.closeEventSource()
+
+	req, err := http.NewRequest("OPTIONS", es.testServer.URL+"/default", nil)
 	if err != nil {
-		t.Error("Creating DELETE request failed with", err)
+		t.Error("Creating OPTIONS request failed with", err)
 	}
+	req.Header.Add("Origin", "http://example.com")
+	req.Header.Add("Access-Control-Request-Method", "POST")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.Error("Unable to send DELETE request")
+		t.Fatal("Unable to send OPTIONS request")
 	}
 
 	if resp.StatusCode != 200 {
-		t.Error("DELETE request of channel failed with status code", resp.StatusCode)
+		t.Error("OPTIONS request failed with status code", resp.StatusCode)
 	}
 
-	if len(es.eventSource.Channels()) != 0 {
-		t.Error("Channel 'default' should be closed")
+	if allowOrigin := resp.Header.Get("Access-Control-Allow-Origin"); allowOrigin != "*" {
+		t.Error("Expected Access-Control-Allow-Origin '*', got", allowOrigin)
+	}
+
+	if allowMethods := resp.Header.Get("Access-Control-Allow-Methods"); allowMethods != "GET, POST" {
+		t.Error("Expected Access-Control-Allow-Methods 'GET, POST', got", allowMethods)
+	}
+
+	if allowHeaders := resp.Header.Get("Access-Control-Allow-Headers"); allowHeaders != "Content-Type, Auth-Token" {
+		t.Error("Expected Access-Control-Allow-Headers 'Content-Type, Auth-Token', got", allowHeaders)
 	}
 }
 
-func TestChannelCloseAll(t *testing.T) {
-	es := setupEventSource(t, nil)
+func TestCorsAllowOrigins(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			CorsAllowOrigins:     []string{"http://example.com", "http://example.org"},
+			CorsAllowCredentials: true,
+		})
 	defer es.closeEventSource()
 
-	conn, _ := es.joinChannel(t, "default")
+	// Allowed origins are echoed back
+	conn, resp := es.joinChannel(t, "default", "Origin: http://example.org")
 	defer conn.Close()
 
-	if len(es.eventSource.Channels()) == 0 {
-		t.Error("At least one channel should exist")
+	if !strings.Contains(string(resp), "Access-Control-Allow-Origin: http://example.org\r\n") {
+		t.Error("Response header does not contain 'Access-Control-Allow-Origin: http://example.org'")
 	}
 
-	es.eventSource.CloseAll()
-	time.Sleep(100 * time.Millisecond)
-
-	if len(es.eventSource.Channels()) != 0 {
-		t.Error("All channels should be closed")
+	if !strings.Contains(string(resp), "Access-Control-Allow-Credentials: true\r\n") {
+		t.Error("Response header does not contain 'Access-Control-Allow-Credentials: true'")
 	}
-}
 
-func TestChannelCloseAllViaHTTPDelete(t *testing.T) {
-	es := setupEventSource(t, nil)
-	defer es.closeEventSource()
+	if !strings.Contains(string(resp), "Vary: Origin\r\n") {
+		t.Error("Response header does not contain 'Vary: Origin'")
+	}
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	// Unknown origins are omitted
+	unknownConn, resp := es.joinChannel(t, "default", "Origin: http://example.net")
+	defer unknownConn.Close()
 
-	if !es.eventSource.ChannelExists("default") {
-		t.Error("Channel 'default' should exist")
+	if strings.Contains(string(resp), "Access-Control-Allow-Origin") {
+		t.Error("Response header should not contain 'Access-Control-Allow-Origin' for unknown origins")
 	}
 
-	req, err := http.NewRequest("DELETE", es.testServer.URL+"/all", nil)
+	// Preflight requests echo back allowed origins, too
+	req, err := http.NewRequest("OPTIONS", es.testServer.URL+"/default", nil)
 	if err != nil {
-		t.Error("Creating DELETE request failed with", err)
+		t.Error("Creating OPTIONS request failed with", err)
 	}
+	req.Header.Add("Origin", "http://example.com")
 
-	resp, err := http.DefaultClient.Do(req)
+	preflightResp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.Error("Unable to send DELETE request")
+		t.Fatal("Unable to send OPTIONS request")
 	}
 
-	if resp.StatusCode != 200 {
-		t.Error("DELETE request of all channels failed with status code", resp.StatusCode)
+	if allowOrigin := preflightResp.Header.Get("Access-Control-Allow-Origin"); allowOrigin != "http://example.com" {
+		t.Error("Expected Access-Control-Allow-Origin 'http://example.com', got", allowOrigin)
 	}
 
-	if len(es.eventSource.Channels()) != 0 {
-		t.Error("All channels should be closed")
+	if allowCredentials := preflightResp.Header.Get("Access-Control-Allow-Credentials"); allowCredentials != "true" {
+		t.Error("Expected Access-Control-Allow-Credentials 'true', got", allowCredentials)
+	}
+
+	if vary := preflightResp.Header.Get("Vary"); vary != "Origin" {
+		t.Error("Expected Vary 'Origin', got", vary)
 	}
 }
 
-func TestStats(t *testing.T) {
-	es := setupEventSource(t, nil)
-	defer es.closeEventSource()
+func TestHTTP2Streaming(t *testing.T) {
+	es := New(nil)
+	defer es.Stop()
 
-	conn, _ := es.joinChannel(t, "default")
-	defer conn.Close()
+	testServer := httptest.NewUnstartedServer(es.Router())
+	testServer.EnableHTTP2 = true
+	testServer.StartTLS()
+	defer testServer.Close()
 
-	// HEAD for single channel
-	req, err := http.NewRequest("HEAD", es.testServer.URL+"/default", nil)
+	resp, err := testServer.Client().Get(testServer.URL + "/default")
 	if err != nil {
-		t.Error("Creating HEAD request failed with", err)
+		t.Fatal("Unable to subscribe via HTTP/2", err)
 	}
-	req.Header.Add("Connection", "close")
+	defer resp.Body.Close()
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.Error("Unable to send HEAD request")
+	if resp.ProtoMajor != 2 {
+		t.Error("Expected a HTTP/2 response, got", resp.Proto)
 	}
 
-	if statusCode := resp.StatusCode; statusCode != 200 {
-		t.Error("HEAD request for channel failed with status code", statusCode)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream; charset=utf-8" {
+		t.Error("Expected Content-Type 'text/event-stream; charset=utf-8', got", contentType)
 	}
 
-	consumerCountHeader := resp.Header.Get("X-Consumer-Count")
-	consumerCount, err := strconv.Atoi(consumerCountHeader)
-	if err != nil {
-		t.Error("Unable to convert to integer", err)
+	if consumerCount := es.ConsumerCount("default"); consumerCount != 1 {
+		t.Error("Expected 1 consumer, got", consumerCount)
 	}
 
-	if consumerCount != 1 {
-		t.Error("Response for X-Consumer-Count is invalid", consumerCount)
-	}
+	es.SendMessage(buildMessageData(ModeAll), "default")
 
-	channelExistsHeader := resp.Header.Get("X-Channel-Exists")
-	channelExists, err := strconv.ParseBool(channelExistsHeader)
-	if err != nil {
-		t.Error("Unable to convert to bool", err)
+	reader := bufio.NewReader(resp.Body)
+	var message bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Unable to read event", err)
+		}
+		message.WriteString(line)
+		if line == "\n" {
+			break
+		}
 	}
 
-	if channelExists != true {
-		t.Error("Response for X-Channel-Exists is invalid", channelExists)
+	if message.String() != "id: 1\nevent: foo\ndata: bar\n\n" {
+		t.Errorf("Expected response:\nid: 1\nevent: foo\ndata: bar\n\n and got:\n%s\n", message.String())
 	}
 
-	// HEAD for all channels
-	req, err = http.NewRequest("HEAD", es.testServer.URL+"/all", nil)
-	if err != nil {
-		t.Error("Creating HEAD request failed with", err)
-	}
-	req.Header.Add("Connection", "close")
+	// Closing the response removes the consumer
+	resp.Body.Close()
+	time.Sleep(100 * time.Millisecond)
 
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Error("Unable to send HEAD request")
+	if consumerCount := es.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers after disconnect, got", consumerCount)
 	}
+}
 
-	if statusCode := resp.StatusCode; statusCode != 200 {
+func TestAuthToken(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AuthToken: "secrect",
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	req, err := http.NewRequest("DELETE", es.testServer.URL+"/default", nil)
+	if err != nil {
+		t.Error("Creating DELETE request failed with", err)
+	}
+	req.Header.Add("Auth-Token", "secrect")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Unable to send DELETE request")
+	}
+
+	if resp.StatusCode != 200 {
+		t.Error("DELETE request of channel failed with status code", resp.StatusCode)
+	}
+}
+
+func TestNamespaceAuthTokens(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AuthToken:           "admin",
+			NamespaceSeparator:  "-",
+			NamespaceAuthTokens: map[string]string{"tenant1": "token1", "tenant2": "token2"},
+		})
+	defer es.closeEventSource()
+
+	for _, request := range []struct {
+		channel string
+		token   string
+		status  int
+	}{
+		{"tenant1-orders", "token1", http.StatusCreated},
+		{"tenant1-orders", "token2", http.StatusForbidden},
+		{"tenant1-orders", "", http.StatusForbidden},
+		{"tenant1-orders", "admin", http.StatusCreated},
+		{"tenant2-orders", "token2", http.StatusCreated},
+		{"tenant2-orders", "token1", http.StatusForbidden},
+		{"shared", "token1", http.StatusForbidden},
+		{"shared", "admin", http.StatusCreated},
+	} {
+		req, _ := http.NewRequest("POST", es.testServer.URL+"/"+request.channel, buildMessageData(ModeAll))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", request.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != request.status {
+			t.Errorf("Expected status %d publishing to '%s' with token '%s', got %d", request.status, request.channel, request.token, resp.StatusCode)
+		}
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	// Failed authentications are rejected with 403 by default
+	es := setupEventSource(t, &Settings{AuthToken: "secret"})
+	defer es.closeEventSource()
+
+	resp, err := http.Get(es.testServer.URL + "/default/stats")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected status code 403, got", resp.StatusCode)
+	}
+
+	if !strings.Contains(string(body), "Authentication failed") {
+		t.Error("Expected default error message, got", string(body))
+	}
+
+	// Status and message are customizable
+	es.eventSource.UpdateSettings(&Settings{AuthToken: "secret", AuthFailureStatus: http.StatusUnauthorized, AuthFailureMessage: "unauthorized"})
+
+	for _, method := range []string{"POST", "DELETE", "HEAD", "GET"} {
+		req, _ := http.NewRequest(method, es.testServer.URL+"/default", nil)
+		if method == "GET" {
+			req, _ = http.NewRequest(method, es.testServer.URL+"/default/stats", nil)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send request", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 for %s, got %d", method, resp.StatusCode)
+		}
+
+		if authenticate := resp.Header.Get("WWW-Authenticate"); !strings.HasPrefix(authenticate, "Auth-Token") {
+			t.Errorf("Expected WWW-Authenticate header for %s, got '%s'", method, authenticate)
+		}
+
+		if method != "HEAD" && strings.TrimSpace(string(body)) != "unauthorized" {
+			t.Errorf("Expected custom message for %s, got '%s'", method, body)
+		}
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Test EventMessage in different modes
+	for _, mode := range messageModes() {
+		messageStream := buildMessageData(mode)
+		var expectedMessage bytes.Buffer
+
+		if mode != ModeNoid {
+			expectedMessage.WriteString("id: 1\n")
+		}
+
+		if mode != ModeNoevent {
+			expectedMessage.WriteString("event: foo\n")
+		}
+
+		if mode != ModeNodata {
+			expectedMessage.WriteString("data: bar\n")
+		}
+		expectedMessage.WriteString("\n")
+
+		es.eventSource.SendMessage(messageStream, "default")
+		expectResponse(t, conn, string(expectedMessage.Bytes()))
+	}
+}
+
+func TestMaxDataBytes(t *testing.T) {
+	es := setupEventSource(t, &Settings{MaxDataBytes: 8})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if err := es.eventSource.SendEvent(Event{Data: "too large data"}, "default"); err != errDataTooLarge {
+		t.Error("Expected errDataTooLarge, got", err)
+	}
+
+	if err := es.eventSource.Broadcast(strings.NewReader(`{"data":"too large data"}`), []string{"default"}); err != errDataTooLarge {
+		t.Error("Expected errDataTooLarge for broadcasts, got", err)
+	}
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader(`{"data":"too large data"}`))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Expected status code 413, got", resp.StatusCode)
+	}
+	expectNoResponse(t, conn)
+
+	if err := es.eventSource.SendEvent(Event{Data: "fits"}, "default"); err != nil {
+		t.Error("Expected data within the limit to be sent, got", err)
+	}
+	expectResponse(t, conn, "data: fits\n\n")
+}
+
+func TestSendInvalidUTF8(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	if err := es.eventSource.SendEvent(Event{Data: "\xff"}, "default"); err != errInvalidEncoding {
+		t.Error("Expected errInvalidEncoding, got", err)
+	}
+
+	resp, err := http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader("data: \xff\n\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400, got", resp.StatusCode)
+	}
+}
+
+func TestSendBase64Data(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader(`{"event":"blob","data_base64":"AP8BAg=="}`))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	expectResponse(t, conn, "event: blob+base64\ndata: AP8BAg==\n\n")
+
+	resp, err = http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader(`{"data_base64":"AP8B*"}`))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400 for invalid base64, got", resp.StatusCode)
+	}
+}
+
+func TestFieldMapping(t *testing.T) {
+	es := setupEventSource(t, &Settings{FieldMapping: map[string]string{"type": "event", "payload": "data"}})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader(`{"type":"x","payload":"y"}`))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	expectResponse(t, conn, "event: x\ndata: y\n\n")
+}
+
+func TestSendEvent(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Emitted bytes of SendMessage
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	time.Sleep(100 * time.Millisecond)
+	messageResp := readResponse(t, conn)
+
+	// Emitted bytes of SendEvent
+	if err := es.eventSource.SendEvent(Event{Id: 1, Event: "foo", Data: "bar"}, "default"); err != nil {
+		t.Error("SendEvent failed with", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	eventResp := readResponse(t, conn)
+
+	if !bytes.Equal(messageResp, eventResp) {
+		t.Errorf("Expected equal responses, got:\n%s\n and:\n%s\n", messageResp, eventResp)
+	}
+
+	if err := es.eventSource.SendEvent(Event{Data: "bar"}, "NOT VALID"); err == nil {
+		t.Error("SendEvent should fail for invalid channel names")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn1, _ := es.joinChannel(t, "channel-1")
+	defer conn1.Close()
+
+	conn2, _ := es.joinChannel(t, "channel-2")
+	defer conn2.Close()
+
+	conn3, _ := es.joinChannel(t, "channel-3")
+	defer conn3.Close()
+
+	if err := es.eventSource.Broadcast(buildMessageData(ModeAll), []string{"channel-1", "channel-2", "channel-1"}); err != nil {
+		t.Error("Broadcast failed with", err)
+	}
+
+	expectResponse(t, conn1, "id: 1\nevent: foo\ndata: bar\n\n")
+	expectResponse(t, conn2, "id: 1\nevent: foo\ndata: bar\n\n")
+	expectNoResponse(t, conn3)
+
+	// Duplicate channels receive the message only once
+	expectNoResponse(t, conn1)
+
+	if err := es.eventSource.Broadcast(buildMessageData(ModeAll), []string{"channel-1", "NOT VALID"}); err == nil {
+		t.Error("Broadcast should fail for invalid channel names")
+	}
+
+	// Invalid channel names are rejected, regardless of their position relative to the global channel
+	for _, channels := range [][]string{{"all", "bad name!"}, {"bad name!", "all"}} {
+		if err := es.eventSource.Broadcast(buildMessageData(ModeAll), channels); err != ErrInvalidChannel {
+			t.Errorf("Expected ErrInvalidChannel for %q, got %v", channels, err)
+		}
+	}
+	expectNoResponse(t, conn3)
+
+	if err := es.eventSource.Broadcast(strings.NewReader("{invalid"), []string{"channel-1"}); err == nil {
+		t.Error("Broadcast should fail for invalid JSON data")
+	}
+
+	// Unknown channels are rejected, so none of the channels receives the message
+	es.eventSource.UpdateSettings(&Settings{RejectUnknownChannels: true})
+	if err := es.eventSource.Broadcast(buildMessageData(ModeAll), []string{"channel-1", "unknown"}); err != errUnknownChannel {
+		t.Error("Expected errUnknownChannel, got", err)
+	}
+	expectNoResponse(t, conn1)
+
+	if err := es.eventSource.Broadcast(buildMessageData(ModeAll), []string{"channel-1", "channel-3"}); err != nil {
+		t.Error("Broadcast failed with", err)
+	}
+	expectResponse(t, conn1, "id: 1\nevent: foo\ndata: bar\n\n")
+	expectResponse(t, conn3, "id: 1\nevent: foo\ndata: bar\n\n")
+}
+
+func TestSubscribe(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 1 {
+		t.Error("Expected 1 consumer, got", consumerCount)
+	}
+
+	// Messages of the channel
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	select {
+	case e := <-events:
+		if e.Id != 1 || e.Event != "foo" || e.Data != "bar" {
+			t.Error("Received invalid event", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected an event of channel 'default'")
+	}
+
+	// Global notifications
+	es.eventSource.SendEvent(Event{Data: "global"}, "all")
+	select {
+	case e := <-events:
+		if e.Data != "global" {
+			t.Error("Received invalid event", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a global notification")
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("Channel of events should be closed after unsubscribing")
+		}
+	case <-time.After(time.Second):
+		t.Error("Channel of events should be closed after unsubscribing")
+	}
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers, got", consumerCount)
+	}
+
+	// Subscribing to the global channel is rejected
+	globalEvents, _ := es.eventSource.Subscribe("all")
+	if _, ok := <-globalEvents; ok {
+		t.Error("Subscribing to channel 'all' should be rejected")
+	}
+}
+
+func TestSubscribeRawMessage(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+	defer unsubscribe()
+
+	// Raw messages without data reach no in-process consumer
+	for _, raw := range []string{"retry: 1000\n\n", "id: 7\nevent: foo\ndata: bar\n\n"} {
+		resp, err := http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+	}
+
+	select {
+	case e := <-events:
+		if e.Id != 7 || e.Event != "foo" || e.Data != "bar" {
+			t.Error("Expected the parsed event of the raw message, got", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected an event of channel 'default'")
+	}
+
+	select {
+	case e := <-events:
+		t.Error("Expected no further event, got", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSubscribeAck(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	events, unsubscribe := es.eventSource.SubscribeAck("default")
+	defer unsubscribe()
+
+	var received []*AckableEvent
+	for i := 1; i <= 3; i++ {
+		es.eventSource.SendEvent(Event{Id: uint(i), Data: "ack me"}, "default")
+		select {
+		case e := <-events:
+			if e.Id != uint(i) || e.Data != "ack me" {
+				t.Error("Received invalid event", e.Event)
+			}
+			received = append(received, e)
+		case <-time.After(time.Second):
+			t.Fatal("Expected an event of channel 'default'")
+		}
+	}
+
+	if info := es.eventSource.ConsumerInfo("default"); len(info) != 1 || info[0].Unacknowledged != 3 {
+		t.Error("Expected 3 unacknowledged events, got", info)
+	}
+
+	// Repeated acknowledgements are ignored
+	received[0].Ack()
+	received[0].Ack()
+	received[2].Ack()
+
+	if info := es.eventSource.ConsumerInfo("default"); len(info) != 1 || info[0].Unacknowledged != 1 || info[0].Dropped != 0 {
+		t.Error("Expected 1 unacknowledged event, got", info)
+	}
+
+	// Events are dropped if the consumer doesn't keep up
+	for i := 0; i < 4*localBufferSize; i++ {
+		es.eventSource.SendEvent(Event{Data: "flood"}, "default")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if info := es.eventSource.ConsumerInfo("default"); len(info) != 1 || info[0].Dropped == 0 || info[0].Unacknowledged != 1+localBufferSize {
+		t.Error("Expected dropped events and a full buffer of unacknowledged events, got", info)
+	}
+
+	// Subscribing to the global channel is rejected
+	globalEvents, _ := es.eventSource.SubscribeAck("all")
+	if _, ok := <-globalEvents; ok {
+		t.Error("Subscribing to channel 'all' should be rejected")
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+	defer unsubscribe()
+
+	// Published rapidly, so events may be dropped, but never reordered
+	for id := uint(1); id <= 200; id++ {
+		es.eventSource.SendEvent(Event{Id: id, Data: "ordered"}, "default")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var lastId uint
+	for pending := true; pending; {
+		select {
+		case e := <-events:
+			if e.Id <= lastId {
+				t.Fatalf("Expected increasing IDs of in-process consumers, got %d after %d", e.Id, lastId)
+			}
+			lastId = e.Id
+		default:
+			pending = false
+		}
+	}
+
+	es.eventSource.SendEvent(Event{Id: 201, Data: "ordered"}, "default")
+	select {
+	case e := <-events:
+		if e.Id != 201 {
+			t.Error("Expected the last event, got", e.Id)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout while waiting for the last event")
+	}
+
+	lastId = 0
+	response := readUntil(t, conn, nil, "id: 201\n")
+	for _, match := range regexp.MustCompile(`id: (\d+)\n`).FindAllStringSubmatch(response, -1) {
+		id, _ := strconv.ParseUint(match[1], 10, 0)
+		if uint(id) <= lastId {
+			t.Fatalf("Expected increasing IDs, got %d after %d", id, lastId)
+		}
+		lastId = uint(id)
+	}
+}
+
+func TestSendMessageViaHTTPPost(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Test EventMessage in different modes
+	for _, mode := range messageModes() {
+		messageStream := buildMessageData(mode)
+		var expectedMessage bytes.Buffer
+
+		if mode != ModeNoid {
+			expectedMessage.WriteString("id: 1\n")
+		}
+
+		if mode != ModeNoevent {
+			expectedMessage.WriteString("event: foo\n")
+		}
+
+		if mode != ModeNodata {
+			expectedMessage.WriteString("data: bar\n")
+		}
+		expectedMessage.WriteString("\n")
+
+		resp, err := http.Post(es.testServer.URL+"/default", "application/json", messageStream)
+		if err != nil {
+			t.Error("POST event failed with", err)
+		}
+
+		if resp.StatusCode != 201 {
+			t.Error("POST event failed with status code", resp.StatusCode)
+		}
+
+		expectResponse(t, conn, string(expectedMessage.Bytes()))
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			FlushInterval: 500 * time.Millisecond,
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	es.eventSource.SendEvent(Event{Id: 1, Data: "foo"}, "default")
+	time.Sleep(50 * time.Millisecond)
+	es.eventSource.SendEvent(Event{Id: 2, Data: "bar"}, "default")
+
+	// Messages are held back until the flush interval elapses
+	expectNoResponse(t, conn)
+
+	// Both messages are written at once
+	expectResponse(t, conn, "id: 1\ndata: foo\n\nid: 2\ndata: bar\n\n")
+}
+
+func TestOnError(t *testing.T) {
+	errors := make(chan error, 1)
+	es := New(&Settings{
+		Timeout: 50 * time.Millisecond,
+		OnError: func(channel, remoteAddr string, err error) {
+			if channel != "default" || remoteAddr != "pipe" {
+				t.Errorf("Expected channel 'default' and remote address 'pipe', got '%s' and '%s'", channel, remoteAddr)
+			}
+			errors <- err
+		},
+	})
+	defer es.Stop()
+
+	// A consumer which never reads runs into the write timeout
+	server, client := net.Pipe()
+	defer client.Close()
+
+	cr := newConsumer(httptest.NewRequest("GET", "/default", nil), es.(*eventSource), "default")
+	cr.connection = server
+	cr.remoteAddr = "pipe"
+	if err := es.(*eventSource).registerConsumer(cr); err != nil {
+		t.Fatal("Unable to register consumer", err)
+	}
+	go cr.inboxDispatcher(nil, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	es.SendMessage(buildMessageData(ModeAll), "default")
+
+	select {
+	case err := <-errors:
+		if err == nil {
+			t.Error("Expected an error in OnError callback")
+		}
+	case <-time.After(time.Second):
+		t.Error("OnError callback was not called")
+	}
+}
+
+// Connection which fails every write with a non-timeout network error
+type brokenConnection struct{}
+
+func (bc *brokenConnection) Write(data []byte) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}
+}
+
+func (bc *brokenConnection) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (bc *brokenConnection) Close() error {
+	return nil
+}
+
+func TestBrokenConnection(t *testing.T) {
+	es := New(nil)
+	defer es.Stop()
+
+	// The inbox is buffered, so the message isn't dropped before the inbox dispatcher is running
+	cr := newConsumer(httptest.NewRequest("GET", "/default", nil), es.(*eventSource), "default")
+	cr.connection = &brokenConnection{}
+	cr.inbox = make(chan *eventMessage, 1)
+	if err := es.(*eventSource).registerConsumer(cr); err != nil {
+		t.Fatal("Unable to register consumer", err)
+	}
+
+	es.SendMessage(buildMessageData(ModeAll), "default")
+
+	dispatcherDone := make(chan struct{})
+	go func() {
+		cr.inboxDispatcher(nil, nil)
+		close(dispatcherDone)
+	}()
+
+	select {
+	case <-dispatcherDone:
+	case <-time.After(time.Second):
+		t.Fatal("Consumer with a broken connection wasn't disconnected")
+	}
+
+	if !cr.expired.Load() {
+		t.Error("Consumer with a broken connection should be expired")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if consumerCount := es.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers after a broken connection, got", consumerCount)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 1 {
+		t.Error("Expected 1 consumer, got", consumerCount)
+	}
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers after disconnect, got", consumerCount)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			EnableCompression: true,
+		})
+	defer es.closeEventSource()
+
+	req, err := http.NewRequest("GET", es.testServer.URL+"/default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Unable to subscribe", err)
+	}
+	defer resp.Body.Close()
+
+	if contentEncoding := resp.Header.Get("Content-Encoding"); contentEncoding != "gzip" {
+		t.Fatal("Expected Content-Encoding 'gzip', got", contentEncoding)
+	}
+
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal("Unable to read compressed stream", err)
+	}
+
+	messageData := bufio.NewReader(reader)
+	for _, expectedLine := range []string{"id: 1\n", "event: foo\n", "data: bar\n", "\n"} {
+		if line, err := messageData.ReadString('\n'); err != nil || line != expectedLine {
+			t.Errorf("Expected line %q, got %q (%v)", expectedLine, line, err)
+		}
+	}
+
+	// Consumers without gzip support receive uncompressed streams
+	conn, resp2 := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if strings.Contains(string(resp2), "Content-Encoding") {
+		t.Error("Expected an uncompressed stream without Accept-Encoding")
+	}
+}
+
+func TestCompressionTrailer(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			EnableCompression: true,
+			IdleTimeout:       300 * time.Millisecond,
+		})
+	defer es.closeEventSource()
+
+	req, err := http.NewRequest("GET", es.testServer.URL+"/default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Unable to subscribe", err)
+	}
+	defer resp.Body.Close()
+
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal("Unable to read compressed stream", err)
+	}
+
+	// Streams ended by the server, e.g. by the IdleTimeout, are finished with the gzip trailer
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Error("Expected a complete compressed stream, got", err)
+	}
+	if string(data) != "id: 1\nevent: foo\ndata: bar\n\n" {
+		t.Errorf("Unexpected stream %q", data)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	acceptEncodings := map[string]bool{
+		"gzip":                true,
+		"deflate, gzip;q=0.8": true,
+		"GZIP":                true,
+		"":                    false,
+		"deflate":             false,
+		"gzip;q=0, deflate":   false,
+		"br, gzip ; q=0.000":  false,
+		"x-gzip":              false,
+	}
+
+	for acceptEncoding, expected := range acceptEncodings {
+		if accepted := acceptsGzip(acceptEncoding); accepted != expected {
+			t.Errorf("Expected %t for '%s', got %t", expected, acceptEncoding, accepted)
+		}
+	}
+}
+
+func TestStrictAccept(t *testing.T) {
+	es := setupEventSource(t, &Settings{StrictAccept: true})
+	defer es.closeEventSource()
+
+	conn, resp := es.joinChannel(t, "default", "Accept: application/json")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "406 Not Acceptable") {
+		t.Error("Expected a subscription accepting only JSON to be rejected, got", string(resp))
+	}
+
+	conn, resp = es.joinChannel(t, "default", "Accept: text/event-stream")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "200 OK") {
+		t.Error("Expected a subscription accepting event streams to succeed, got", string(resp))
+	}
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	accepts := map[string]bool{
+		"text/event-stream":                   true,
+		"":                                    true,
+		"*/*":                                 true,
+		"text/*":                              true,
+		"application/json, text/event-stream": true,
+		"TEXT/EVENT-STREAM; charset=utf-8":    true,
+		"application/json":                    false,
+		"text/html":                           false,
+		"text/event-stream;q=0, */*;q=0":      false,
+	}
+
+	for accept, expected := range accepts {
+		if accepted := acceptsEventStream(accept); accepted != expected {
+			t.Errorf("Expected %t for '%s', got %t", expected, accept, accepted)
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	for level, expected := range map[LogLevel][]string{
+		LogSilent: {},
+		LogError:  {"[E] Consumer"},
+		LogInfo:   {"[E] Consumer", "[I] Creating channel"},
+		LogDebug:  {"[E] Consumer", "[I] Creating channel", "[D] Consumer"},
+	} {
+		output.Reset()
+		es := setupEventSource(t, &Settings{LogLevel: level})
+
+		conn, _ := es.joinChannel(t, "default")
+		es.eventSource.CreateChannel("created")
+		if resp, err := http.Get(es.testServer.URL + "/Invalid_Channel"); err == nil {
+			resp.Body.Close()
+		}
+		conn.Close()
+		es.closeEventSource()
+
+		logged := output.String()
+		for _, prefix := range []string{"[E] ", "[I] ", "[D] "} {
+			shouldLog := false
+			for _, line := range expected {
+				shouldLog = shouldLog || strings.HasPrefix(line, prefix)
+			}
+			if strings.Contains(logged, prefix) != shouldLog {
+				t.Errorf("Expected lines with prefix '%s' to be logged at level %d: %t, got:\n%s", prefix, level, shouldLog, logged)
+			}
+		}
+		for _, line := range expected {
+			if !strings.Contains(logged, line) {
+				t.Errorf("Expected '%s' to be logged at level %d, got:\n%s", line, level, logged)
+			}
+		}
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	es := setupEventSource(t, &Settings{DedupWindow: 200 * time.Millisecond})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	es.eventSource.SendEvent(Event{Id: 5, Data: "first"}, "default")
+	expectResponse(t, conn, "id: 5\ndata: first\n\n")
+
+	if consumers, err := es.eventSource.SendMessageCount(strings.NewReader(`{"id":5,"data":"second"}`), "default"); err != nil || consumers != 0 {
+		t.Error("Expected the duplicate to reach no consumer, got", consumers, err)
+	}
+	expectNoResponse(t, conn)
+
+	// Events without ID are never duplicates
+	for i := 0; i < 2; i++ {
+		es.eventSource.SendEvent(Event{Data: "anonymous"}, "default")
+		expectResponse(t, conn, "data: anonymous\n\n")
+	}
+
+	// After the window, the ID may be published again
+	time.Sleep(200 * time.Millisecond)
+	es.eventSource.SendEvent(Event{Id: 5, Data: "again"}, "default")
+	expectResponse(t, conn, "id: 5\ndata: again\n\n")
+}
+
+func TestPruneRecentIds(t *testing.T) {
+	es := &eventSource{
+		settings:  &Settings{DedupWindow: time.Minute},
+		recentIds: make(map[string]*recentIds),
+	}
+	for i, channel := range []string{"once", "twice"} {
+		es.isDuplicate(&eventMessage{Id: uint(i + 1), Channel: channel})
+	}
+	es.recentIds["once"].entries[0].timestamp = time.Now().Add(-2 * time.Minute)
+
+	// Channels are removed once all of their IDs are older than the window
+	es.pruneRecentIds()
+	if _, ok := es.recentIds["once"]; ok || len(es.recentIds) != 1 {
+		t.Error("Expected only the recent IDs of channel 'twice' to be kept, got", len(es.recentIds), "channels")
+	}
+
+	es.recentIds["twice"].entries[0].timestamp = time.Now().Add(-2 * time.Minute)
+	es.pruneRecentIds()
+	if len(es.recentIds) != 0 {
+		t.Error("Expected no recent IDs after the window, got", len(es.recentIds), "channels")
+	}
+}
+
+func TestPruneInterval(t *testing.T) {
+	for settings, expected := range map[*Settings]time.Duration{
+		{}:                               maxPruneInterval,
+		{ReplayWindow: time.Hour}:        maxPruneInterval,
+		{ReplayWindow: 10 * time.Second}: 10 * time.Second,
+		{DedupWindow: 5 * time.Second}:   5 * time.Second,
+		{ReplayWindow: 10 * time.Second, DedupWindow: 30 * time.Second}: 10 * time.Second,
+	} {
+		es := &eventSource{settings: settings, replayWindow: settings.ReplayWindow}
+		if interval := es.pruneInterval(); interval != expected {
+			t.Error("Expected", expected, "got", interval)
+		}
+	}
+}
+
+func TestMessageInterceptor(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			MessageInterceptor: func(channel string, e *Event) (*Event, bool) {
+				if e.Event == "secret" {
+					return nil, false
+				}
+				if e.Event == "unchanged" {
+					return nil, true
+				}
+				e.Data = channel + ": " + e.Data
+				return e, true
+			},
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	es.eventSource.SendEvent(Event{Event: "secret", Data: "password"}, "default")
+	expectNoResponse(t, conn)
+
+	es.eventSource.SendEvent(Event{Event: "unchanged", Data: "bar"}, "default")
+	expectResponse(t, conn, "event: unchanged\ndata: bar\n\n")
+
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: default: bar\n\n")
+
+	if consumerCount, _ := es.eventSource.SendMessageCount(strings.NewReader("{\"event\":\"secret\"}"), "default"); consumerCount != 0 {
+		t.Error("Expected dropped message to reach 0 consumers, got", consumerCount)
+	}
+}
+
+func TestAutoAssignIDs(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AutoAssignIDs: true,
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	conn2, _ := es.joinChannel(t, "my-channel")
+	defer conn2.Close()
+
+	es.eventSource.SendEvent(Event{Data: "foo"}, "default")
+	expectResponse(t, conn, "id: 1\ndata: foo\n\n")
+
+	es.eventSource.SendEvent(Event{Data: "bar"}, "default")
+	expectResponse(t, conn, "id: 2\ndata: bar\n\n")
+
+	// Sequences are kept per channel
+	es.eventSource.SendEvent(Event{Data: "foo"}, "my-channel")
+	expectResponse(t, conn2, "id: 1\ndata: foo\n\n")
+
+	// IDs of publishers are kept and continued
+	es.eventSource.SendEvent(Event{Id: 10, Data: "baz"}, "default")
+	expectResponse(t, conn, "id: 10\ndata: baz\n\n")
+
+	es.eventSource.SendEvent(Event{Data: "qux"}, "default")
+	expectResponse(t, conn, "id: 11\ndata: qux\n\n")
+}
+
+func TestSigningKey(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			SigningKey: "secret",
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\nsignature: ")
+}
+
+func TestSendToConsumer(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	target, resp := es.joinChannel(t, "default")
+	defer target.Close()
+	other, _ := es.joinChannel(t, "default")
+	defer other.Close()
+
+	var id string
+	for _, line := range strings.Split(string(resp), "\r\n") {
+		if value, ok := strings.CutPrefix(line, "X-Consumer-Id: "); ok {
+			id = value
+		}
+	}
+	if len(id) != 36 {
+		t.Fatal("Expected the consumer ID in the response headers, got", string(resp))
+	}
+
+	if err := es.eventSource.SendToConsumer(id, Event{Event: "ack", Data: "private"}); err != nil {
+		t.Error("Unable to send event to consumer", err)
+	}
+	expectResponse(t, target, "event: ack\ndata: private\n\n")
+	expectNoResponse(t, other)
+
+	// The ID is listed by ConsumerInfo as well
+	var listed bool
+	for _, consumerMeta := range es.eventSource.ConsumerInfo("default") {
+		listed = listed || consumerMeta.Id == id
+	}
+	if !listed {
+		t.Error("Expected the consumer ID to be listed by ConsumerInfo")
+	}
+
+	if err := es.eventSource.SendToConsumer("unknown", Event{Data: "private"}); !errors.Is(err, ErrUnknownConsumer) {
+		t.Error("Expected ErrUnknownConsumer, got", err)
+	}
+
+	target.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := es.eventSource.SendToConsumer(id, Event{Data: "private"}); !errors.Is(err, ErrUnknownConsumer) {
+		t.Error("Expected ErrUnknownConsumer after disconnecting, got", err)
+	}
+}
+
+func TestBackpressureStats(t *testing.T) {
+	es := setupEventSource(t, &Settings{BackpressureThreshold: 0.5})
+	defer es.closeEventSource()
+
+	// An in-process consumer, whose inbox isn't processed
+	cr := newLocalConsumer(es.eventSource.(*eventSource), "default")
+	if err := es.eventSource.(*eventSource).registerConsumer(cr); err != nil {
+		t.Fatal("Unable to register consumer", err)
+	}
+
+	for i := 0; i < localBufferSize/2; i++ {
+		es.eventSource.SendEvent(Event{Data: "data"}, "default")
+	}
+	if stats := es.eventSource.Stats(); stats.ConsumersLagging != 1 || stats.MessagesDropped != 0 {
+		t.Error("Expected 1 lagging consumer without dropped messages, got", stats)
+	}
+
+	for i := 0; i < localBufferSize; i++ {
+		es.eventSource.SendEvent(Event{Data: "data"}, "default")
+	}
+	if stats := es.eventSource.Stats(); stats.ConsumersLagging != 1 || stats.MessagesDropped != localBufferSize/2 {
+		t.Error("Expected 1 lagging consumer with dropped messages, got", stats)
+	}
+
+	resp, err := http.Get(es.testServer.URL + "/all/stats")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	defer resp.Body.Close()
+
+	var stats channelStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal("Unable to decode stats", err)
+	}
+	if stats.Lagging != 1 || stats.Dropped != localBufferSize/2 {
+		t.Error("Expected the backpressure in the stats of all channels, got", stats)
+	}
+
+	// Dropped messages are kept once the consumer is removed
+	es.eventSource.(*eventSource).removeConsumer(cr)
+	if stats := es.eventSource.Stats(); stats.ConsumersLagging != 0 || stats.MessagesDropped != localBufferSize/2 {
+		t.Error("Expected the dropped messages of removed consumers, got", stats)
+	}
+}
+
+// Helper implementing a connection, whose writes block until it's released
+type blockingConnection struct {
+	release chan struct{}
+}
+
+func (c *blockingConnection) Write(b []byte) (int, error) {
+	<-c.release
+	return len(b), nil
+}
+func (c *blockingConnection) SetWriteDeadline(t time.Time) error { return nil }
+func (c *blockingConnection) Close() error                       { return nil }
+
+func TestBackpressureStatsHTTP(t *testing.T) {
+	es := setupEventSource(t, &Settings{BackpressureThreshold: 0.5, WriteTimeout: 400 * time.Millisecond})
+	defer es.closeEventSource()
+
+	// A consumer connected via HTTP, whose client doesn't read
+	conn := &blockingConnection{release: make(chan struct{})}
+	cr := newConsumer(httptest.NewRequest("GET", "/default", nil), es.eventSource.(*eventSource), "default")
+	cr.connection = conn
+	if err := es.eventSource.(*eventSource).registerConsumer(cr); err != nil {
+		t.Fatal("Unable to register consumer", err)
+	}
+	defer es.eventSource.(*eventSource).removeConsumer(cr)
+
+	written := make(chan bool)
+	go func() { written <- cr.write([]byte("data: blocked\n\n")) }()
+
+	time.Sleep(100 * time.Millisecond)
+	if stats := es.eventSource.Stats(); stats.ConsumersLagging != 0 {
+		t.Error("Expected no lagging consumer before the threshold, got", stats)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if stats := es.eventSource.Stats(); stats.ConsumersLagging != 1 {
+		t.Error("Expected 1 lagging consumer with a blocked write, got", stats)
+	}
+
+	close(conn.release)
+	<-written
+	if stats := es.eventSource.Stats(); stats.ConsumersLagging != 0 {
+		t.Error("Expected no lagging consumer once the write completed, got", stats)
+	}
+}
+
+func TestConsumerInfo(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	joined := time.Now()
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	_, unsubscribe := es.eventSource.Subscribe("my-channel")
+	defer unsubscribe()
+
+	consumerMetas := es.eventSource.ConsumerInfo("default")
+	if len(consumerMetas) != 1 {
+		t.Fatal("Expected 1 consumer, got", len(consumerMetas))
+	}
+
+	if consumerMeta := consumerMetas[0]; consumerMeta.Channel != "default" || !strings.HasPrefix(consumerMeta.RemoteAddr, "127.0.0.1:") {
+		t.Error("Expected consumer of channel 'default' from 127.0.0.1, got", consumerMeta)
+	}
+
+	if connectedAt := consumerMetas[0].ConnectedAt; connectedAt.Before(joined.Add(-time.Second)) || connectedAt.After(time.Now()) {
+		t.Error("Unexpected connection time", connectedAt)
+	}
+
+	if consumerMetas := es.eventSource.ConsumerInfo("all"); len(consumerMetas) != 2 || consumerMetas[1].RemoteAddr != localRemoteAddr {
+		t.Error("Expected 2 consumers across all channels, got", consumerMetas)
+	}
+
+	if consumerMetas := es.eventSource.ConsumerInfo("unknown"); len(consumerMetas) != 0 {
+		t.Error("Expected no consumers of an unknown channel, got", consumerMetas)
+	}
+
+	// Consumer information is included in the stats on request
+	resp, err := http.Get(es.testServer.URL + "/all/stats?consumers=true")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	defer resp.Body.Close()
+
+	var stats channelStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal("Unable to decode stats", err)
+	}
+
+	if len(stats.ConsumerInfo["default"]) != 1 || len(stats.ConsumerInfo["my-channel"]) != 1 {
+		t.Error("Expected consumer information of both channels, got", stats.ConsumerInfo)
+	}
+}
+
+func TestBroadcastEndpoint(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AuthToken: "secret",
+		})
+	defer es.closeEventSource()
+
+	conn1, _ := es.joinChannel(t, "default")
+	defer conn1.Close()
+
+	conn2, _ := es.joinChannel(t, "my-channel")
+	defer conn2.Close()
+
+	broadcast := func(authToken string) int {
+		req, _ := http.NewRequest("POST", es.testServer.URL+"/broadcast", buildMessageData(ModeAll))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := broadcast("wrong"); status != http.StatusForbidden {
+		t.Error("Expected status code 403 without authentication, got", status)
+	}
+	expectNoResponse(t, conn1)
+
+	if status := broadcast("secret"); status != http.StatusCreated {
+		t.Error("Expected status code 201, got", status)
+	}
+	expectResponse(t, conn1, "id: 1\nevent: foo\ndata: bar\n\n")
+	expectResponse(t, conn2, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	// The name of the endpoint is reserved, so it can't be used as channel
+	if err := es.eventSource.CreateChannel("broadcast"); err != ErrInvalidChannel {
+		t.Error("Expected ErrInvalidChannel for channel 'broadcast', got", err)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		req, _ := http.NewRequest(method, es.testServer.URL+"/broadcast", nil)
+		req.Header.Set("Auth-Token", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to send %s request. %s", method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Expected %s of the reserved channel 'broadcast' to fail, got %d", method, resp.StatusCode)
+		}
+	}
+
+	// Without global notifications, there is nothing to broadcast to
+	es.eventSource.UpdateSettings(&Settings{AuthToken: "secret", DisableGlobalChannel: true})
+	if status := broadcast("secret"); status != http.StatusNotFound {
+		t.Error("Expected status code 404 with disabled global notifications, got", status)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AuthToken: "secret",
+		})
+	defer es.closeEventSource()
+
+	resp, err := http.Get(es.testServer.URL + "/healthz")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected status code 200 while running, got", resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); strings.Contains(contentType, "text/event-stream") {
+		t.Error("Health check should not subscribe to a channel")
+	}
+
+	// The name of the endpoint is reserved, so it can't be used as channel
+	if err := es.eventSource.CreateChannel("healthz"); err != ErrInvalidChannel {
+		t.Error("Expected ErrInvalidChannel for channel 'healthz', got", err)
+	}
+	resp, err = http.Post(es.testServer.URL+"/healthz", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected status code 404 for publishing to the reserved channel 'healthz', got", resp.StatusCode)
+	}
+
+	es.eventSource.Stop()
+
+	resp, err = http.Get(es.testServer.URL + "/healthz")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected status code 503 after Stop, got", resp.StatusCode)
+	}
+}
+
+func TestChannelDefaultEvent(t *testing.T) {
+	es := setupEventSource(t, &Settings{ChannelDefaultEvent: map[string]string{"prices": "price"}})
+	defer es.closeEventSource()
+
+	prices, _ := es.joinChannel(t, "prices")
+	defer prices.Close()
+	other, _ := es.joinChannel(t, "other")
+	defer other.Close()
+
+	es.eventSource.SendMessage(strings.NewReader(`{"id":1,"data":"42"}`), "prices")
+	expectResponse(t, prices, "id: 1\nevent: price\ndata: 42\n\n")
+
+	// Explicit event names win
+	es.eventSource.SendMessage(strings.NewReader(`{"id":2,"event":"halt","data":"0"}`), "prices")
+	expectResponse(t, prices, "id: 2\nevent: halt\ndata: 0\n\n")
+
+	// Other channels are unaffected
+	es.eventSource.SendMessage(strings.NewReader(`{"id":3,"data":"a"}`), "other")
+	expectResponse(t, other, "id: 3\ndata: a\n\n")
+
+	// Broadcasts are named per channel
+	es.eventSource.Broadcast(strings.NewReader(`{"id":4,"data":"b"}`), []string{"prices", "other"})
+	expectResponse(t, prices, "id: 4\nevent: price\ndata: b\n\n")
+	expectResponse(t, other, "id: 4\ndata: b\n\n")
+}
+
+func TestInjectTimestamp(t *testing.T) {
+	es := setupEventSource(t, &Settings{InjectTimestamp: true})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	sent := time.Now()
+	es.eventSource.SendEvent(Event{Id: 1, Data: "data", Comments: []string{"comment"}}, "default")
+
+	time.Sleep(100 * time.Millisecond)
+	response := string(readResponse(t, conn))
+	_, timestamp, ok := strings.Cut(response, ": timestamp ")
+	timestamp, rest, _ := strings.Cut(timestamp, "\n")
+	if !ok || !strings.HasPrefix(rest, ": comment\nid: 1\ndata: data\n\n") {
+		t.Fatal("Expected the timestamp comment ahead of the event, got", response)
+	}
+
+	emitted, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		t.Fatal("Expected an RFC3339 timestamp, got", timestamp, err)
+	}
+	if emitted.Before(sent.Add(-time.Second)) || emitted.After(time.Now()) || !strings.HasSuffix(timestamp, "Z") {
+		t.Error("Expected the time of sending in UTC, got", timestamp)
+	}
+}
+
+func TestPublishRawMessage(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	resp, err := http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader("event: relayed\ndata: {\"key\": 1}\n\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Error("Expected status code 201, got", resp.StatusCode)
+	}
+	expectResponse(t, conn, "event: relayed\ndata: {\"key\": 1}\n\n")
+
+	// Event streams without a trailing blank line are rejected
+	resp, err = http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader("data: incomplete\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400, got", resp.StatusCode)
+	}
+	expectNoResponse(t, conn)
+}
+
+func TestStrictJSON(t *testing.T) {
+	es := setupEventSource(t, &Settings{DisallowUnknownFields: true})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	for _, invalid := range []string{`{"id":1,"data":"a","unknown":true}`, "{\"id\":1,\"data\":\"a\"}\n{\"unknown\":true}"} {
+		resp, err := http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader(invalid))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status code 400 for %s, got %d", invalid, resp.StatusCode)
+		}
+	}
+	expectNoResponse(t, conn)
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+}
+
+func TestPublishSeveralObjects(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader(`{"id":1,"data":"a"}{"id":2,"event":"b"}`))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "application/x-ndjson") {
+		t.Error("Expected status code 400 pointing to JSON lines, got", resp.StatusCode, string(body))
+	}
+	expectNoResponse(t, conn)
+}
+
+func TestPublishMalformedJSON(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", strings.NewReader("{\"event\":\"foo\",\n\"data\":}"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400 for malformed JSON, got", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Error("Expected Content-Type application/json, got", contentType)
+	}
+
+	var result struct {
+		Error  string `json:"error"`
+		Line   int    `json:"line"`
+		Column int    `json:"column"`
+		Offset int64  `json:"offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal("Unable to decode error response", err)
+	}
+	if result.Line != 2 || result.Column != 8 || result.Offset != 24 || !strings.Contains(result.Error, "invalid character '}'") {
+		t.Error("Expected the position of the invalid character, got", result)
+	}
+	expectNoResponse(t, conn)
+}
+
+func TestPublishResult(t *testing.T) {
+	es := setupEventSource(t, &Settings{AutoAssignIDs: true})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Without accepting JSON, the response is empty
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeNoid))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated || len(body) != 0 {
+		t.Error("Expected status code 201 without body, got", resp.StatusCode, string(body))
+	}
+
+	// Clients accepting JSON receive the assigned ID and the number of consumers
+	req, _ := http.NewRequest("POST", es.testServer.URL+"/default", buildMessageData(ModeNoid))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/json" {
+		t.Error("Expected status code 201 with JSON, got", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var result publishResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal("Unable to decode publish result", err)
+	}
+
+	if result.Id != 2 || result.Consumers != 1 {
+		t.Error("Expected ID 2 reaching 1 consumer, got", result)
+	}
+}
+
+func TestPublishSuccessStatus(t *testing.T) {
+	es := setupEventSource(t, &Settings{PublishSuccessStatus: http.StatusOK})
+	defer es.closeEventSource()
+
+	req, _ := http.NewRequest("POST", es.testServer.URL+"/default", buildMessageData(ModeAll))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"id":1`) {
+		t.Error("Expected status code 200 with the event ID, got", resp.StatusCode, string(body))
+	}
+
+	// No Content never contains a body
+	es.eventSource.UpdateSettings(&Settings{PublishSuccessStatus: http.StatusNoContent})
+	req, _ = http.NewRequest("POST", es.testServer.URL+"/default", buildMessageData(ModeAll))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Error("Expected status code 204, got", resp, err)
+	}
+}
+
+func TestPublishBatchMessage(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+	defer unsubscribe()
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/x-ndjson", strings.NewReader("{\"data\":\"first\"}\n{\"data\":\"second\"}\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Error("Expected status code 201, got", resp.StatusCode)
+	}
+	if response := readUntil(t, conn, nil, "data: second\n\n"); !strings.Contains(response, "data: first\n\n") || strings.Index(response, "first") > strings.Index(response, "second") {
+		t.Error("Expected both events in order, got", response)
+	}
+
+	// In-process consumers receive each event of a batch
+	for _, data := range []string{"first", "second"} {
+		select {
+		case e := <-events:
+			if e.Data != data {
+				t.Errorf("Expected event '%s', got '%s'", data, e.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout while waiting for event", data)
+		}
+	}
+
+	// Batches with invalid lines are rejected as a whole
+	resp, err = http.Post(es.testServer.URL+"/default", "application/x-ndjson", strings.NewReader("{\"data\":\"first\"}\nnot json\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "line 2") {
+		t.Error("Expected status code 400 naming line 2, got", resp.StatusCode, string(body))
+	}
+	expectNoResponse(t, conn)
+}
+
+func TestPublishStreamedMessage(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	resp, err := http.Post(es.testServer.URL+"/default?event=log", "text/plain", strings.NewReader("line 1\nline 2\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Error("Expected status code 201, got", resp.StatusCode)
+	}
+	expectResponse(t, conn, "event: log\ndata: line 1\ndata: line 2\n")
+
+	// Chunks are sent as soon as they're read, so consumers receive them before the payload is complete
+	client := NewClient()
+	defer client.Close()
+	events, err := client.Connect(es.testServer.URL + "/default")
+	if err != nil {
+		t.Fatal("Unable to connect client", err)
+	}
+
+	body, writer := io.Pipe()
+	published := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(es.testServer.URL+"/default?event=log", "text/plain", body)
+		if err != nil {
+			t.Error("Unable to send POST request", err)
+			published <- 0
+			return
+		}
+		resp.Body.Close()
+		published <- resp.StatusCode
+	}()
+
+	writer.Write([]byte("line 1\n"))
+	time.Sleep(100 * time.Millisecond)
+	if resp := readResponse(t, conn); !strings.Contains(string(resp), "event: log\ndata: line 1\n") || strings.Contains(string(resp), "data: line 1\n\n") {
+		t.Errorf("Expected the first chunk of an unfinished event, got:\n%s\n", resp)
+	}
+
+	// Payloads of several chunks are sent as a single event
+	payload := strings.Repeat(strings.Repeat("x", 1023)+"\n", 40)
+	writer.Write([]byte(payload))
+	writer.Close()
+
+	if status := <-published; status != http.StatusCreated {
+		t.Error("Expected status code 201, got", status)
+	}
+	if e := receiveEvent(t, events); e.Event != "log" || e.Data != "line 1\n"+strings.TrimSuffix(payload, "\n") {
+		t.Error("Expected the whole payload as a single event, got", len(e.Data), "bytes")
+	}
+
+	// Lines exceeding the chunk size are sent as a single 'data:' line
+	line := strings.Repeat("é", streamChunkSize)
+	resp, err = http.Post(es.testServer.URL+"/default", "text/plain", strings.NewReader(line+"\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if e := receiveEvent(t, events); e.Data != line {
+		t.Error("Expected the long line as the data, got", len(e.Data), "bytes")
+	}
+
+	// Reading stops once the data exceeds the MaxDataBytes and consumers, which received a part of the event, are disconnected
+	es.eventSource.UpdateSettings(&Settings{MaxDataBytes: 20 * 1024})
+	resp, err = http.Post(es.testServer.URL+"/default", "text/plain", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Expected status code 413, got", resp.StatusCode)
+	}
+
+	// The response ends right after the last chunk, so the unfinished event is discarded by clients
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var stream []byte
+	buffer := make([]byte, 64*1024)
+	for !strings.HasSuffix(string(stream), "0\r\n\r\n") {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal("Expected the end of the response, got", err)
+		}
+		stream = append(stream, buffer[:n]...)
+	}
+	if !strings.HasSuffix(string(stream), "x\n\r\n0\r\n\r\n") {
+		t.Errorf("Expected the aborted event to end without a blank line, got %q", stream[len(stream)-16:])
+	}
+
+	select {
+	case e := <-events:
+		t.Error("Expected no event for the aborted stream, got", len(e.Data), "bytes")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPublishStreamedMessageTimeout(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+	es.eventSource.(*eventSource).streamDuration = 200 * time.Millisecond
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Streams, which take longer than the stream duration, are aborted
+	body, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte("line 1\nline 2\n"))
+
+	resp, err := http.Post(es.testServer.URL+"/default", "text/plain", body)
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Error("Expected status code 408, got", resp.StatusCode)
+	}
+	if resp := readResponse(t, conn); !strings.Contains(string(resp), "data: line 2\n") || strings.Contains(string(resp), "data: line 2\n\n") {
+		t.Errorf("Expected the unfinished event, got:\n%s\n", resp)
+	}
+}
+
+func TestUpdateSettings(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AuthToken: "old-token",
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	es.eventSource.UpdateSettings(&Settings{AuthToken: "new-token"})
+
+	publish := func(authToken string) int {
+		req, err := http.NewRequest("POST", es.testServer.URL+"/default", buildMessageData(ModeAll))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Auth-Token", authToken)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if statusCode := publish("old-token"); statusCode != http.StatusForbidden {
+		t.Error("Expected the old token to be rejected, got status code", statusCode)
+	}
+
+	if statusCode := publish("new-token"); statusCode != http.StatusCreated {
+		t.Error("Expected the new token to be accepted, got status code", statusCode)
+	}
+
+	// Existing consumers stay connected
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+}
+
+func TestRejectUnknownChannels(t *testing.T) {
+	for _, rejectUnknownChannels := range []bool{false, true} {
+		es := setupEventSource(t,
+			&Settings{
+				RejectUnknownChannels: rejectUnknownChannels,
+				PreregisteredChannels: []string{"preregistered"},
+			})
+
+		resp, err := http.Post(es.testServer.URL+"/unknown", "application/json", buildMessageData(ModeAll))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+
+		expectedStatusCode := http.StatusCreated
+		if rejectUnknownChannels {
+			expectedStatusCode = http.StatusConflict
+		}
+		if resp.StatusCode != expectedStatusCode {
+			t.Errorf("Expected status code %d for an unknown channel, got %d", expectedStatusCode, resp.StatusCode)
+		}
+
+		if err := es.eventSource.SendMessage(buildMessageData(ModeAll), "unknown"); rejectUnknownChannels && err != errUnknownChannel {
+			t.Error("Expected errUnknownChannel, got", err)
+		} else if !rejectUnknownChannels && err != nil {
+			t.Error("Expected no error, got", err)
+		}
+
+		// Preregistered channels, channels with consumers and the global channel are known
+		conn, _ := es.joinChannel(t, "default")
+		for _, channel := range []string{"preregistered", "default", "all"} {
+			if err := es.eventSource.SendMessage(buildMessageData(ModeAll), channel); err != nil {
+				t.Errorf("Expected no error for channel '%s', got %v", channel, err)
+			}
+		}
+
+		conn.Close()
+		es.closeEventSource()
+	}
+}
+
+func TestCreateChannel(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			PreregisteredChannels: []string{"preregistered", "invalid$channel", "all"},
+		})
+	defer es.closeEventSource()
+
+	if channels := es.eventSource.Channels(); len(channels) != 1 || channels[0] != "preregistered" {
+		t.Error("Expected only the valid preregistered channel, got", channels)
+	}
+
+	if err := es.eventSource.CreateChannel("my-channel"); err != nil {
+		t.Fatal("Unable to create channel", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if !es.eventSource.ChannelExists("my-channel") {
+		t.Error("Channel 'my-channel' should exist")
+	}
+
+	if consumerCount := es.eventSource.ConsumerCount("my-channel"); consumerCount != 0 {
+		t.Error("Expected 0 consumers, got", consumerCount)
+	}
+
+	if err := es.eventSource.CreateChannel("all"); err != ErrInvalidChannel {
+		t.Error("Expected ErrInvalidChannel for the global channel, got", err)
+	}
+
+	// Empty channels are closed as well
+	es.eventSource.CloseAll()
+	time.Sleep(50 * time.Millisecond)
+
+	if channels := es.eventSource.Channels(); len(channels) != 0 {
+		t.Error("Expected no channels after CloseAll, got", channels)
+	}
+}
+
+func TestDrainChannel(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			FlushInterval: time.Minute,
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+	defer unsubscribe()
+
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	time.Sleep(50 * time.Millisecond)
+	es.eventSource.SendEvent(Event{Data: "last"}, "default")
+
+	if err := es.eventSource.DrainChannel("default"); err != nil {
+		t.Fatal("Unable to drain channel", err)
+	}
+
+	// Queued messages are delivered before the consumers get disconnected
+	expectResponse(t, conn, "data: last\n\n")
+
+	received := 0
+	for range events {
+		received++
+	}
+	if received != 2 {
+		t.Error("Expected 2 events before the channel was drained, got", received)
+	}
+
+	if es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should not exist after draining")
+	}
+
+	if err := es.eventSource.DrainChannel("all"); err != ErrInvalidChannel {
+		t.Error("Expected ErrInvalidChannel for the global channel, got", err)
+	}
+}
+
+func TestSendMessageCount(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn1, _ := es.joinChannel(t, "default")
+	defer conn1.Close()
+
+	conn2, _ := es.joinChannel(t, "default")
+	defer conn2.Close()
+
+	conn3, _ := es.joinChannel(t, "my-channel")
+	defer conn3.Close()
+
+	if consumerCount, err := es.eventSource.SendMessageCount(buildMessageData(ModeAll), "default"); err != nil || consumerCount != 2 {
+		t.Error("Expected message to be enqueued to 2 consumers, got", consumerCount, err)
+	}
+
+	if consumerCount, err := es.eventSource.SendMessageCount(buildMessageData(ModeAll), "unknown"); err != nil || consumerCount != 0 {
+		t.Error("Expected message to be enqueued to 0 consumers, got", consumerCount, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if consumerCount, err := es.eventSource.SendMessageCount(buildMessageData(ModeAll), "all"); err != nil || consumerCount != 3 {
+		t.Error("Expected global message to be enqueued to 3 consumers, got", consumerCount, err)
+	}
+
+	es.eventSource.Stop()
+	if _, err := es.eventSource.SendMessageCount(buildMessageData(ModeAll), "default"); err != ErrStopped {
+		t.Error("Expected ErrStopped after Stop, got", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			IdleTimeout: 300 * time.Millisecond,
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// A successful write resets the idle timeout
+	time.Sleep(150 * time.Millisecond)
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	time.Sleep(250 * time.Millisecond)
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 1 {
+		t.Error("Expected 1 consumer before the idle timeout, got", consumerCount)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers after the idle timeout, got", consumerCount)
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			MaxConnectionLifetime: 300 * time.Millisecond,
+			DefaultRetry:          time.Second,
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Messages don't extend the lifetime
+	time.Sleep(150 * time.Millisecond)
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 1 {
+		t.Error("Expected 1 consumer before the lifetime elapsed, got", consumerCount)
+	}
+
+	// The retry field is sent before disconnecting
+	expectResponse(t, conn, "retry: 1000\n\n")
+	time.Sleep(50 * time.Millisecond)
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers after the lifetime elapsed, got", consumerCount)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	es := setupEventSource(t, &Settings{EnableLongPoll: true, LongPollTimeout: 200 * time.Millisecond, ReplayWindow: time.Minute})
+	defer es.closeEventSource()
+
+	// The request is held open until the next message arrives
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(es.testServer.URL + "/default/poll")
+		if err != nil {
+			t.Error("Unable to send GET request", err)
+		}
+		responses <- resp
+	}()
+
+	for deadline := time.Now().Add(time.Second); es.eventSource.ConsumerCount("default") == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+
+	resp := <-responses
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Error("Expected the message as JSON, got", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if string(body) != `[{"id":1,"event":"foo","data":"bar","comment":null,"ttl":0}]`+"\n" {
+		t.Error("Expected the events of the message, got", string(body))
+	}
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected the long polling consumer to be removed, got", consumerCount)
+	}
+
+	// Messages after the last ID are returned immediately
+	es.eventSource.SendMessage(strings.NewReader(`{"id":2,"data":"next"}`), "default")
+	start := time.Now()
+	resp, err := http.Get(es.testServer.URL + "/default/poll?lastId=1")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"id":2`) || time.Since(start) >= 200*time.Millisecond {
+		t.Error("Expected the message after the last ID to be returned immediately, got", string(body), time.Since(start))
+	}
+
+	// Without a message, the request times out
+	resp, err = http.Get(es.testServer.URL + "/default/poll?lastId=2")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("Expected status code 204 after the timeout, got", resp.StatusCode)
+	}
+}
+
+func TestLongPollStreamedMessage(t *testing.T) {
+	es := setupEventSource(t, &Settings{EnableLongPoll: true, LongPollTimeout: 2 * time.Second})
+	defer es.closeEventSource()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(es.testServer.URL + "/default/poll")
+		if err != nil {
+			t.Error("Unable to send GET request", err)
+		}
+		responses <- resp
+	}()
+
+	for deadline := time.Now().Add(time.Second); es.eventSource.ConsumerCount("default") == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Streams exceeding the window of held chunks are read to their end and returned as a single event
+	payload := strings.Repeat(strings.Repeat("x", 1023)+"\n", 100)
+	resp, err := http.Post(es.testServer.URL+"/default?event=log", "text/plain", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Error("Expected status code 201, got", resp.StatusCode)
+	}
+
+	resp = <-responses
+	var events []*Event
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		t.Fatal("Unable to decode events", err)
+	}
+	resp.Body.Close()
+	if len(events) != 1 || events[0].Event != "log" || events[0].Data != strings.TrimSuffix(payload, "\n") {
+		t.Error("Expected the whole payload as a single event, got", len(events), "events")
+	}
+}
+
+func TestLongPollRawMessage(t *testing.T) {
+	es := setupEventSource(t, &Settings{EnableLongPoll: true, LongPollTimeout: 2 * time.Second})
+	defer es.closeEventSource()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(es.testServer.URL + "/default/poll")
+		if err != nil {
+			t.Error("Unable to send GET request", err)
+		}
+		responses <- resp
+	}()
+
+	for deadline := time.Now().Add(time.Second); es.eventSource.ConsumerCount("default") == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Raw messages without data are skipped, the request waits for the next event
+	for _, raw := range []string{"retry: 1000\n\n", "id: 7\nevent: foo\ndata: bar\n\n"} {
+		resp, err := http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+	}
+
+	resp := <-responses
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `[{"id":7,"event":"foo","data":"bar","comment":null,"ttl":0}]`+"\n" {
+		t.Error("Expected the parsed event of the raw message, got", string(body))
+	}
+}
+
+func TestLongPollMaxConnectionsPerIP(t *testing.T) {
+	es := setupEventSource(t, &Settings{EnableLongPoll: true, LongPollTimeout: 500 * time.Millisecond, MaxConnectionsPerIP: 1})
+	defer es.closeEventSource()
+
+	// The first request is held open, the second one of the same IP is rejected
+	go func() {
+		if resp, err := http.Get(es.testServer.URL + "/default/poll"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	for deadline := time.Now().Add(time.Second); es.eventSource.ConsumerCount("default") == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(es.testServer.URL + "/default/poll")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Error("Expected status code 429 for a second long poll of the same IP, got", resp.StatusCode)
+	}
+}
+
+func TestLongPollDisabled(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	resp, err := http.Get(es.testServer.URL + "/default/poll")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected status code 404 without EnableLongPoll, got", resp.StatusCode)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	filtered, _ := es.joinChannel(t, "default?events=created,%20message")
+	defer filtered.Close()
+	unfiltered, _ := es.joinChannel(t, "default")
+	defer unfiltered.Close()
+
+	if consumerCount, _ := es.eventSource.SendMessageCount(buildMessageData(ModeAll), "default"); consumerCount != 1 {
+		t.Error("Expected the filtered out event to reach 1 consumer, got", consumerCount)
+	}
+	expectNoResponse(t, filtered)
+	expectResponse(t, unfiltered, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	es.eventSource.SendEvent(Event{Id: 2, Event: "created", Data: "a"}, "default")
+	expectResponse(t, filtered, "id: 2\nevent: created\ndata: a\n\n")
+
+	// Events without a name are of the type 'message'
+	es.eventSource.SendEvent(Event{Id: 3, Data: "b"}, "default")
+	expectResponse(t, filtered, "id: 3\ndata: b\n\n")
+
+	// Batches are reduced to the events passing the filter
+	resp, err := http.Post(es.testServer.URL+"/default", "application/x-ndjson", strings.NewReader("{\"id\":4,\"event\":\"deleted\",\"data\":\"c\"}\n{\"id\":5,\"event\":\"created\",\"data\":\"d\"}\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if response := string(readResponse(t, filtered)); strings.Contains(response, "deleted") || !strings.Contains(response, "id: 5\nevent: created\ndata: d\n\n") {
+		t.Error("Expected only the created event of the batch, got", response)
+	}
+}
+
+func TestAllowedChannels(t *testing.T) {
+	es := setupEventSource(t, &Settings{AllowedChannels: []string{"orders", "invoices"}})
+	defer es.closeEventSource()
+
+	conn, resp := es.joinChannel(t, "orders")
+	defer conn.Close()
+	if !strings.Contains(string(resp), "200 OK") {
+		t.Error("Expected subscribing to an allowed channel to succeed, got", string(resp))
+	}
+
+	disallowed, resp := es.joinChannel(t, "random")
+	defer disallowed.Close()
+	if !strings.Contains(string(resp), "404 Not Found") {
+		t.Error("Expected subscribing to a channel which isn't allowed to be rejected, got", string(resp))
+	}
+
+	for channel, status := range map[string]int{"orders": http.StatusCreated, "random": http.StatusNotFound, "all": http.StatusCreated} {
+		resp, err := http.Post(es.testServer.URL+"/"+channel, "application/json", buildMessageData(ModeAll))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Errorf("Expected status code %d for channel '%s', got %d", status, channel, resp.StatusCode)
+		}
+	}
+
+	if channels := es.eventSource.Channels(); len(channels) != 1 || channels[0] != "orders" {
+		t.Error("Expected no other channels to be created, got", channels)
+	}
+}
+
+func TestMaxEventsPerSecondPerConsumer(t *testing.T) {
+	es := setupEventSource(t, &Settings{MaxEventsPerSecondPerConsumer: 2})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	for id, expected := range []int{1, 1, 0, 0} {
+		if consumerCount, _ := es.eventSource.SendMessageCount(strings.NewReader(`{"id":`+strconv.Itoa(id+1)+`,"data":"data"}`), "default"); consumerCount != expected {
+			t.Errorf("Expected event %d to reach %d consumers, got %d", id+1, expected, consumerCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if consumerMetas := es.eventSource.ConsumerInfo("default"); len(consumerMetas) != 1 || consumerMetas[0].Dropped != 2 {
+		t.Error("Expected 2 dropped events, got", consumerMetas)
+	}
+
+	// Events pass again once the rate allows it
+	time.Sleep(500 * time.Millisecond)
+	es.eventSource.SendEvent(Event{Id: 5, Data: "data"}, "default")
+	expectResponse(t, conn, "id: 5\ndata: data\n\n")
+}
+
+func TestChannelExists(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should exist")
+	}
+
+	if es.eventSource.ChannelExists("my-channel") {
+		t.Error("Channel 'my-channel' should not exist")
+	}
+}
+
+func TestConsumerCount(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if es.eventSource.ConsumerCount("default") > 1 {
+		t.Error("ConsumerCount for channel 'default' is invalid")
+	}
+}
+
+func TestConsumerCountAll(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if es.eventSource.ConsumerCountAll() > 1 {
+		t.Error("ConsumerCountAll is invalid")
+	}
+}
+
+func TestChannels(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if es.eventSource.Channels()[0] != "default" {
+		t.Error("Returned channel names are invalid")
+	}
+}
+
+func TestChannelClose(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should exist")
+	}
+
+	es.eventSource.Close("default")
+	time.Sleep(100 * time.Millisecond)
+
+	if es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should not exist")
+	}
+}
+
+func TestCloseEmptyChannels(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			CloseEmptyChannels:    true,
+			PreregisteredChannels: []string{"preregistered"},
+			ReplayWindow:          time.Minute,
+		})
+	defer es.closeEventSource()
+
+	for _, channel := range []string{"default", "preregistered"} {
+		conn, _ := es.joinChannel(t, channel)
+		es.eventSource.SendEvent(Event{Id: 1, Data: "stored"}, channel)
+		expectResponse(t, conn, "data: stored\n\n")
+		conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should be removed after the last consumer left")
+	}
+
+	if history := es.eventSource.(*eventSource).replayMessages("default", &replayRequest{}); len(history) != 0 {
+		t.Error("Expected the history of channel 'default' to be removed, got", len(history))
+	}
+
+	if !es.eventSource.ChannelExists("preregistered") {
+		t.Error("Preregistered channel should be kept")
+	}
+}
+
+func TestChannelCloseMessage(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			ChannelCloseMessage: func(channel string) *Event {
+				return &Event{Event: "closed", Data: channel + " closed, do not reconnect"}
+			},
+		})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+	defer unsubscribe()
+
+	es.eventSource.Close("default")
+
+	// The final event is written right before the response is finished
+	response := readUntil(t, conn, nil, "\r\n0\r\n\r\n")
+	if !strings.Contains(response, "event: closed\ndata: default closed, do not reconnect\n\n") {
+		t.Error("Expected the final event before disconnecting, got", response)
+	}
+
+	select {
+	case e, ok := <-events:
+		if !ok || e.Event != "closed" {
+			t.Error("Expected the final event, got", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timeout while waiting for the final event")
+	}
+
+	if _, ok := <-events; ok {
+		t.Error("Expected the event channel to be closed after the final event")
+	}
+}
+
+func TestChannelCloseViaHTTPDelete(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should exist")
+	}
+
+	req, err := http.NewRequest("DELETE", es.testServer.URL+"/default", nil)
+	if err != nil {
+		t.Error("Creating DELETE request failed with", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Unable to send DELETE request")
+	}
+
+	if resp.StatusCode != 200 {
+		t.Error("DELETE request of channel failed with status code", resp.StatusCode)
+	}
+
+	if len(es.eventSource.Channels()) != 0 {
+		t.Error("Channel 'default' should be closed")
+	}
+}
+
+func TestCloseChannels(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	for _, channel := range []string{"tenant-a", "tenant-b", "other"} {
+		conn, _ := es.joinChannel(t, channel)
+		defer conn.Close()
+	}
+
+	// Invalid names and the global channel are rejected, without closing any channel
+	for _, channels := range [][]string{{"tenant-a", "all"}, {"tenant-a", "*"}, {"Tenant-B"}} {
+		if err := es.eventSource.CloseChannels(channels); err != ErrInvalidChannel {
+			t.Errorf("Expected ErrInvalidChannel for %v, got %v", channels, err)
+		}
+	}
+	for _, channel := range []string{"all", "*"} {
+		if err := es.eventSource.Close(channel); err != ErrInvalidChannel {
+			t.Errorf("Expected ErrInvalidChannel for '%s', got %v", channel, err)
+		}
+	}
+	if channels := es.eventSource.Channels(); len(channels) != 3 {
+		t.Error("Expected all channels to survive invalid names, got", channels)
+	}
+
+	if err := es.eventSource.CloseChannels([]string{"tenant-a", "tenant-b"}); err != nil {
+		t.Error("Expected the channels to be closed, got", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if channels := es.eventSource.Channels(); len(channels) != 1 || channels[0] != "other" {
+		t.Error("Expected only channel 'other' to survive, got", channels)
+	}
+}
+
+func TestCloseNamespace(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			NamespaceSeparator:    "_",
+			PreregisteredChannels: []string{"tenant1_billing"},
+		})
+	defer es.closeEventSource()
+
+	for _, channel := range []string{"tenant1_orders", "tenant1_users", "tenant2_orders", "tenant1"} {
+		conn, _ := es.joinChannel(t, channel)
+		defer conn.Close()
+	}
+
+	if err := es.eventSource.CloseNamespace("tenant1"); err != nil {
+		t.Error("Expected the namespace to be closed, got", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Channels without separator don't belong to a namespace
+	if channels := es.eventSource.Channels(); len(channels) != 2 || channels[0] != "tenant1" || channels[1] != "tenant2_orders" {
+		t.Error("Expected only channels outside of namespace 'tenant1' to survive, got", channels)
+	}
+}
+
+func TestChannelCloseAll(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if len(es.eventSource.Channels()) == 0 {
+		t.Error("At least one channel should exist")
+	}
+
+	es.eventSource.CloseAll()
+	time.Sleep(100 * time.Millisecond)
+
+	if len(es.eventSource.Channels()) != 0 {
+		t.Error("All channels should be closed")
+	}
+}
+
+func TestChannelCloseAllViaHTTPDelete(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should exist")
+	}
+
+	req, err := http.NewRequest("DELETE", es.testServer.URL+"/all", nil)
+	if err != nil {
+		t.Error("Creating DELETE request failed with", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Unable to send DELETE request")
+	}
+
+	if resp.StatusCode != 200 {
+		t.Error("DELETE request of all channels failed with status code", resp.StatusCode)
+	}
+
+	if len(es.eventSource.Channels()) != 0 {
+		t.Error("All channels should be closed")
+	}
+}
+
+func TestGlobalChannelName(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			GlobalChannelName: "everyone",
+		})
+	defer es.closeEventSource()
+
+	// Channel 'all' is an ordinary channel now
+	conn, resp := es.joinChannel(t, "all")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Subscribing to channel 'all' should be allowed")
+	}
+
+	// The global channel is reserved
+	reservedConn, resp := es.joinChannel(t, "everyone")
+	defer reservedConn.Close()
+
+	if !strings.Contains(string(resp), "400 Bad Request") {
+		t.Error("Subscribing to channel 'everyone' should be rejected")
+	}
+
+	// Global notifications are sent via the configured channel
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "everyone")
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	es.eventSource.CloseAll()
+	time.Sleep(100 * time.Millisecond)
+
+	if len(es.eventSource.Channels()) != 0 {
+		t.Error("All channels should be closed")
+	}
+}
+
+func TestDisableGlobalChannel(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			DisableGlobalChannel: true,
+		})
+	defer es.closeEventSource()
+
+	allConn, resp := es.joinChannel(t, "all")
+	defer allConn.Close()
+
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Subscribing to channel 'all' should be allowed")
+	}
+
+	defaultConn, _ := es.joinChannel(t, "default")
+	defer defaultConn.Close()
+
+	// Publishing to 'all' only reaches the consumers of channel 'all'
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "all")
+	expectResponse(t, allConn, "id: 1\nevent: foo\ndata: bar\n\n")
+	expectNoResponse(t, defaultConn)
+
+	// Deleting 'all' only closes channel 'all'
+	req, err := http.NewRequest("DELETE", es.testServer.URL+"/all", nil)
+	if err != nil {
+		t.Error("Creating DELETE request failed with", err)
+	}
+
+	if _, err := http.DefaultClient.Do(req); err != nil {
+		t.Error("Unable to send DELETE request")
+	}
+
+	if es.eventSource.ChannelExists("all") {
+		t.Error("Channel 'all' should be closed")
+	}
+
+	if !es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should still exist")
+	}
+
+	// CloseAll still closes every channel
+	es.eventSource.CloseAll()
+	time.Sleep(100 * time.Millisecond)
+
+	if len(es.eventSource.Channels()) != 0 {
+		t.Error("All channels should be closed")
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			BasePath: "/events",
+		})
+	defer es.closeEventSource()
+
+	conn, resp := es.joinChannel(t, "events/default")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Subscribing to '/events/default' failed")
+	}
+
+	if !es.eventSource.ChannelExists("default") {
+		t.Error("Channel 'default' should exist")
+	}
+
+	// Routes without the base path are unknown
+	rootConn, resp := es.joinChannel(t, "default")
+	defer rootConn.Close()
+
+	if !strings.Contains(string(resp), "404 Not Found") {
+		t.Error("Subscribing to '/default' should fail")
+	}
+
+	// The stats endpoint is prefixed, too
+	statsResp, err := http.Get(es.testServer.URL + "/events/all/stats")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	statsResp.Body.Close()
+
+	if statusCode := statsResp.StatusCode; statusCode != 200 {
+		t.Error("GET request for '/events/all/stats' failed with status code", statusCode)
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	es := setupEventSource(t, &Settings{PreregisteredChannels: []string{"empty"}})
+	defer es.closeEventSource()
+
+	conn1, _ := es.joinChannel(t, "default")
+	defer conn1.Close()
+
+	conn2, _ := es.joinChannel(t, "default")
+	defer conn2.Close()
+
+	conn3, _ := es.joinChannel(t, "my-channel")
+	defer conn3.Close()
+
+	es.eventSource.SendEvent(Event{Data: "published"}, "default")
+	es.eventSource.SendEvent(Event{Data: "published"}, "my-channel")
+
+	stats := es.eventSource.Stats()
+	if stats.TotalConsumers != 3 {
+		t.Error("Expected 3 consumers, got", stats.TotalConsumers)
+	}
+
+	if len(stats.Channels) != 3 || stats.Channels["default"] != 2 || stats.Channels["my-channel"] != 1 || stats.Channels["empty"] != 0 {
+		t.Error("Unexpected consumers per channel", stats.Channels)
+	}
+
+	if stats.MessagesPublished != 2 {
+		t.Error("Expected 2 published messages, got", stats.MessagesPublished)
+	}
+
+	// Snapshots are copies, which aren't changed by the service
+	stats.Channels["default"] = 0
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 2 {
+		t.Error("Expected 2 consumers, got", consumerCount)
+	}
+
+	es.eventSource.Stop()
+	if stats := es.eventSource.Stats(); stats.TotalConsumers != 0 || stats.Channels == nil {
+		t.Error("Expected an empty snapshot after the service has been stopped, got", stats)
+	}
+}
+
+func TestBytesWritten(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		ChannelCloseMessage: func(channel string) *Event {
+			return &Event{Data: "bye"}
+		},
+	})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	message := "id: 1\nevent: foo\ndata: bar\n\n"
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	expectResponse(t, conn, message)
+
+	stats := es.eventSource.Stats()
+	if stats.BytesWritten != uint64(len(message)) {
+		t.Errorf("Expected %d bytes written, got %d", len(message), stats.BytesWritten)
+	}
+	if written := stats.ChannelBytes["default"]; written != uint64(len(message)) {
+		t.Errorf("Expected %d bytes written to channel 'default', got %d", len(message), written)
+	}
+
+	consumers := es.eventSource.ConsumerInfo("default")
+	if len(consumers) != 1 || consumers[0].Written != uint64(len(message)) {
+		t.Errorf("Expected %d bytes written to the consumer, got %v", len(message), consumers)
+	}
+
+	// Bytes of disconnected consumers are retained, as long as the channel exists
+	other, _ := es.joinChannel(t, "default")
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+	expectResponse(t, other, message)
+	other.Close()
+	for i := 0; i < 50 && es.eventSource.ConsumerCount("default") != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if written := es.eventSource.Stats().ChannelBytes["default"]; written != uint64(3*len(message)) {
+		t.Errorf("Expected %d bytes written to channel 'default', got %d", 3*len(message), written)
+	}
+
+	// Messages written while closing the channel are counted as well
+	if err := es.eventSource.Close("default"); err != nil {
+		t.Fatal("Unable to close channel", err)
+	}
+	expectResponse(t, conn, "data: bye\n\n")
+
+	if written := es.eventSource.Stats().BytesWritten; written != uint64(3*len(message)+len("data: bye\n\n")) {
+		t.Errorf("Expected %d bytes written, got %d", 3*len(message)+len("data: bye\n\n"), written)
+	}
+}
+
+func TestStats(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// HEAD for single channel
+	req, err := http.NewRequest("HEAD", es.testServer.URL+"/default", nil)
+	if err != nil {
+		t.Error("Creating HEAD request failed with", err)
+	}
+	req.Header.Add("Connection", "close")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Unable to send HEAD request")
+	}
+
+	if statusCode := resp.StatusCode; statusCode != 200 {
+		t.Error("HEAD request for channel failed with status code", statusCode)
+	}
+
+	consumerCountHeader := resp.Header.Get("X-Consumer-Count")
+	consumerCount, err := strconv.Atoi(consumerCountHeader)
+	if err != nil {
+		t.Error("Unable to convert to integer", err)
+	}
+
+	if consumerCount != 1 {
+		t.Error("Response for X-Consumer-Count is invalid", consumerCount)
+	}
+
+	channelExistsHeader := resp.Header.Get("X-Channel-Exists")
+	channelExists, err := strconv.ParseBool(channelExistsHeader)
+	if err != nil {
+		t.Error("Unable to convert to bool", err)
+	}
+
+	if channelExists != true {
+		t.Error("Response for X-Channel-Exists is invalid", channelExists)
+	}
+
+	// HEAD for all channels
+	req, err = http.NewRequest("HEAD", es.testServer.URL+"/all", nil)
+	if err != nil {
+		t.Error("Creating HEAD request failed with", err)
+	}
+	req.Header.Add("Connection", "close")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error("Unable to send HEAD request")
+	}
+
+	if statusCode := resp.StatusCode; statusCode != 200 {
 		t.Error("HEAD request for channel failed with status code", statusCode)
 	}
 
-	consumerCountHeader = resp.Header.Get("X-Consumer-Count")
-	consumerCount, err = strconv.Atoi(consumerCountHeader)
+	consumerCountHeader = resp.Header.Get("X-Consumer-Count")
+	consumerCount, err = strconv.Atoi(consumerCountHeader)
+	if err != nil {
+		t.Error("Unable to convert to integer", err)
+	}
+
+	if consumerCount != 1 {
+		t.Error("Response for X-Consumer-Count is invalid", consumerCount)
+	}
+
+	if availableChannels := resp.Header.Get("X-Available-Channels"); availableChannels != "[default]" {
+		t.Error("Response for X-Available-Channels is invalid", availableChannels)
+	}
+}
+
+func TestStatsETag(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	head := func(ifNoneMatch string) *http.Response {
+		req, _ := http.NewRequest("HEAD", es.testServer.URL+"/all", nil)
+		if len(ifNoneMatch) > 0 {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send HEAD request", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := head("")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(etag, "W/\"") {
+		t.Fatal("Expected a weak ETag, got", resp.StatusCode, etag)
+	}
+
+	// Unchanged state
+	if resp := head(etag); resp.StatusCode != http.StatusNotModified || resp.Header.Get("ETag") != etag {
+		t.Error("Expected 304 Not Modified for an unchanged state, got", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	// Changed state
+	conn2, _ := es.joinChannel(t, "other")
+	defer conn2.Close()
+
+	if resp := head(etag); resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Error("Expected a new ETag for a changed state, got", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestStatsViaHTTPGet(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Stats for all channels
+	resp, err := http.Get(es.testServer.URL + "/all/stats")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	defer resp.Body.Close()
+
+	if statusCode := resp.StatusCode; statusCode != 200 {
+		t.Error("GET request for stats failed with status code", statusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Error("Expected Content-Type 'application/json', got", contentType)
+	}
+
+	var stats channelStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal("Unable to decode stats", err)
+	}
+
+	if stats.ConsumerCount != 1 {
+		t.Error("Expected 1 consumer, got", stats.ConsumerCount)
+	}
+
+	if len(stats.Channels) != 1 || stats.Channels[0] != "default" {
+		t.Error("Expected channels [default], got", stats.Channels)
+	}
+
+	if stats.Consumers["default"] != 1 {
+		t.Error("Expected 1 consumer for channel 'default', got", stats.Consumers["default"])
+	}
+
+	// Stats for a single, unknown channel
+	resp, err = http.Get(es.testServer.URL + "/my-channel/stats")
 	if err != nil {
-		t.Error("Unable to convert to integer", err)
+		t.Fatal("Unable to send GET request", err)
 	}
+	defer resp.Body.Close()
 
-	if consumerCount != 1 {
-		t.Error("Response for X-Consumer-Count is invalid", consumerCount)
+	stats = channelStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal("Unable to decode stats", err)
 	}
 
-	if availableChannels := resp.Header.Get("X-Available-Channels"); availableChannels != "[default]" {
-		t.Error("Response for X-Available-Channels is invalid", availableChannels)
+	if stats.ConsumerCount != 0 || len(stats.Channels) != 0 {
+		t.Error("Expected empty stats for channel 'my-channel', got", stats)
+	}
+}
+
+func TestStatsAuthentication(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			AuthToken: "secret",
+		})
+	defer es.closeEventSource()
+
+	resp, err := http.Get(es.testServer.URL + "/all/stats")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	resp.Body.Close()
+
+	if statusCode := resp.StatusCode; statusCode != 403 {
+		t.Error("Expected status code 403 without Auth-Token, got", statusCode)
+	}
+}
+
+func TestShutdownRetryAfter(t *testing.T) {
+	es := setupEventSource(t, &Settings{ShutdownRetryAfter: 1500 * time.Millisecond})
+	defer es.testServer.Close()
+
+	es.eventSource.Stop()
+
+	conn, resp := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "503 Service Unavailable") || !strings.Contains(string(resp), "Retry-After: 2\r\n") {
+		t.Error("Expected a subscription after stopping to be declined with Retry-After, got", string(resp))
+	}
+
+	publishResp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	publishResp.Body.Close()
+
+	if publishResp.StatusCode != http.StatusServiceUnavailable || publishResp.Header.Get("Retry-After") != "2" {
+		t.Error("Expected publishing after stopping to be declined with Retry-After, got", publishResp.StatusCode, publishResp.Header.Get("Retry-After"))
+	}
+}
+
+func TestDrainingRetryAfter(t *testing.T) {
+	es := setupEventSource(t, &Settings{ShutdownRetryAfter: 1500 * time.Millisecond})
+	defer es.closeEventSource()
+
+	// A consumer which isn't disconnected yet keeps the channel draining
+	cr := newConsumer(httptest.NewRequest("GET", "/default", nil), es.eventSource.(*eventSource), "default")
+	if err := es.eventSource.(*eventSource).registerConsumer(cr); err != nil {
+		t.Fatal("Unable to register consumer", err)
+	}
+
+	drained := make(chan error)
+	go func() { drained <- es.eventSource.DrainChannel("default") }()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, resp := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "503 Service Unavailable") || !strings.Contains(string(resp), "Retry-After: 2\r\n") {
+		t.Error("Expected a subscription to a draining channel to be declined with Retry-After, got", string(resp))
+	}
+
+	publish := func() *http.Response {
+		resp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeAll))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := publish(); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "2" {
+		t.Error("Expected publishing to a draining channel to be declined with Retry-After, got", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	close(cr.finished)
+	if err := <-drained; err != nil {
+		t.Fatal("Unable to drain channel", err)
+	}
+
+	if resp := publish(); resp.StatusCode != http.StatusCreated {
+		t.Error("Expected publishing to be accepted once the channel is drained, got", resp.StatusCode)
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		LineEnding:   "\r\n",
+		DefaultRetry: 10 * time.Second,
+		OnConnectMessage: func(channel string) *Event {
+			return &Event{Event: "connected"}
+		},
+	})
+	defer es.closeEventSource()
+
+	conn, initial := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !strings.Contains(string(initial), "retry: 10000\r\n\r\nevent: connected\r\n\r\n") {
+		t.Error("Expected the retry field and the welcome event framed with CRLF, got", string(initial))
+	}
+
+	es.eventSource.SendMessage(strings.NewReader(`{"id":1,"event":"foo","data":"multi\nline"}`), "default")
+	expectResponse(t, conn, "id: 1\r\nevent: foo\r\ndata: multi\r\ndata: line\r\n\r\n")
+
+	// Raw messages are framed as well
+	resp, err := http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader("data: raw\n\n"))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	expectResponse(t, conn, "data: raw\r\n\r\n")
+}
+
+func TestSentinelErrors(t *testing.T) {
+	es := New(nil)
+
+	if err := es.SendEvent(Event{Data: "data"}, "invalid/channel"); !errors.Is(err, ErrInvalidChannel) {
+		t.Error("Expected ErrInvalidChannel for an invalid channel name, got", err)
+	}
+	if err := es.CreateChannel("all"); !errors.Is(err, ErrInvalidChannel) {
+		t.Error("Expected ErrInvalidChannel for the global channel, got", err)
+	}
+
+	var syntaxErr *json.SyntaxError
+	if err := es.SendMessage(strings.NewReader(`{"data":}`), "default"); !errors.Is(err, ErrParse) || !errors.As(err, &syntaxErr) {
+		t.Error("Expected ErrParse wrapping the JSON error, got", err)
+	}
+	if err := es.SendEvent(Event{Data: "\xff"}, "default"); !errors.Is(err, ErrParse) {
+		t.Error("Expected ErrParse for invalid UTF-8, got", err)
+	}
+	if err := es.SendMessage(strings.NewReader(`{"data":"a","data_base64":"YQ=="}`), "default"); !errors.Is(err, ErrParse) {
+		t.Error("Expected ErrParse for invalid base64 data, got", err)
+	}
+	if _, err := newEventMessages(strings.NewReader("{}\n{\n"), "default"); !errors.Is(err, ErrParse) {
+		t.Error("Expected ErrParse for an invalid batch, got", err)
+	}
+
+	es.Stop()
+	if err := es.SendEvent(Event{Data: "data"}, "default"); !errors.Is(err, ErrStopped) {
+		t.Error("Expected ErrStopped after stopping, got", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.testServer.Close()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	es.eventSource.Stop()
+
+	if len(es.eventSource.Channels()) != 0 {
+		t.Error("All channels should be closed after stopping")
+	}
+
+	// Public methods are safe no-ops after stopping
+	if err := es.eventSource.Close("x"); err != ErrStopped {
+		t.Error("Expected ErrStopped for Close, got", err)
+	}
+
+	if err := es.eventSource.CloseAll(); err != ErrStopped {
+		t.Error("Expected ErrStopped for CloseAll, got", err)
+	}
+
+	if err := es.eventSource.CloseChannels([]string{"x"}); err != ErrStopped {
+		t.Error("Expected ErrStopped for CloseChannels, got", err)
+	}
+
+	if err := es.eventSource.SendMessage(buildMessageData(ModeAll), "default"); err != ErrStopped {
+		t.Error("Expected ErrStopped for SendMessage, got", err)
+	}
+
+	if err := es.eventSource.SendEvent(Event{Data: "bar"}, "default"); err != ErrStopped {
+		t.Error("Expected ErrStopped for SendEvent, got", err)
+	}
+
+	es.eventSource.Stop()
+
+	events, unsubscribe := es.eventSource.Subscribe("default")
+	if _, ok := <-events; ok {
+		t.Error("Subscribing should be rejected after stopping")
+	}
+	unsubscribe()
+
+	// Subscribing via HTTP is rejected
+	stoppedConn, resp := es.joinChannel(t, "default")
+	defer stoppedConn.Close()
+
+	if !strings.Contains(string(resp), "503 Service Unavailable") {
+		t.Error("Subscribing should be rejected with status code 503 after stopping")
+	}
+}
+
+func TestConcurrentSendMessageAndStop(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.testServer.Close()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	// Publishers keep sending while the service is stopped
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				if err := es.eventSource.SendMessage(buildMessageData(ModeAll), "default"); err == ErrStopped {
+					done <- true
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	es.eventSource.Stop()
+
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Publisher did not return after stopping")
+		}
+	}
+
+	// Publishing via HTTP is rejected
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("POST event failed with", err)
+	}
+
+	if resp.StatusCode != 503 {
+		t.Error("Expected status code 503 after stopping, got", resp.StatusCode)
 	}
 }
 
@@ -525,3 +3772,301 @@ func TestRun(t *testing.T) {
 	es := New(nil)
 	go es.Run()
 }
+
+func TestTCPKeepAlive(t *testing.T) {
+	for _, tc := range []struct {
+		keepAlive time.Duration
+		enabled   bool
+	}{
+		{0, true},
+		{30 * time.Second, true},
+		{-1, false},
+	} {
+		es := New(&Settings{TCPKeepAlive: tc.keepAlive}).(*eventSource)
+
+		listener, err := es.listenTCP("127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Unable to listen", err)
+		}
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal("Unable to connect", err)
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal("Unable to accept connection", err)
+		}
+
+		rawConn, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal("Unable to access raw connection", err)
+		}
+
+		var keepAlive int
+		rawConn.Control(func(fd uintptr) {
+			keepAlive, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		})
+		if err != nil {
+			t.Fatal("Unable to read socket option", err)
+		}
+
+		if enabled := keepAlive != 0; enabled != tc.enabled {
+			t.Errorf("Expected keep-alive enabled %v for %v, got %v", tc.enabled, tc.keepAlive, enabled)
+		}
+
+		conn.Close()
+		client.Close()
+		listener.Close()
+		es.Stop()
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	unixSocket := filepath.Join(t.TempDir(), "eventsource.sock")
+	es := New(&Settings{UnixSocket: unixSocket})
+	go es.Run()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", unixSocket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("Unable to dial unix socket", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET /default HTTP/1.1\nHost: localhost\n\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := readResponse(t, conn); !strings.Contains(string(resp), "HTTP/1.1 200 OK\r\n") {
+		t.Error("Subscribing via unix socket failed, got", string(resp))
+	}
+
+	es.SendMessage(buildMessageData(ModeAll), "default")
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	es.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := os.Stat(unixSocket); !os.IsNotExist(err) {
+		t.Error("Socket file should be removed after Stop")
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen", err)
+	}
+
+	es.eventSource.SendEvent(Event{Data: "last"}, "default")
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	es.eventSource.(*eventSource).handleSignals(signals, listener)
+
+	// Queued messages are delivered before the service is stopped
+	expectResponse(t, conn, "data: last\n\n")
+
+	if !es.eventSource.(*eventSource).stopped() {
+		t.Error("Expected the service to be stopped after SIGTERM")
+	}
+	if _, err := listener.Accept(); err == nil {
+		t.Error("Expected the listener to be closed after SIGTERM")
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	es := setupEventSource(t, &Settings{ShutdownRetryAfter: 1500 * time.Millisecond})
+	defer es.closeEventSource()
+
+	// A consumer which isn't disconnected yet keeps the shutdown in its grace period
+	cr := newConsumer(httptest.NewRequest("GET", "/default", nil), es.eventSource.(*eventSource), "default")
+	if err := es.eventSource.(*eventSource).registerConsumer(cr); err != nil {
+		t.Fatal("Unable to register consumer", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		es.eventSource.(*eventSource).shutdown(time.Second)
+		close(stopped)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Channels which weren't drained are declined as well
+	conn, resp := es.joinChannel(t, "other")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "503 Service Unavailable") || !strings.Contains(string(resp), "Retry-After: 2\r\n") {
+		t.Error("Expected a subscription during the grace period to be declined with Retry-After, got", string(resp))
+	}
+
+	publishResp, err := http.Post(es.testServer.URL+"/other", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	publishResp.Body.Close()
+
+	if publishResp.StatusCode != http.StatusServiceUnavailable || publishResp.Header.Get("Retry-After") != "2" {
+		t.Error("Expected publishing during the grace period to be declined with Retry-After, got", publishResp.StatusCode, publishResp.Header.Get("Retry-After"))
+	}
+
+	close(cr.finished)
+	select {
+	case <-stopped:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Expected the service to be stopped once the last consumer disconnected")
+	}
+}
+
+func TestPauseChannel(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		MaxPausedMessages: 2,
+	})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if err := es.eventSource.PauseChannel("default"); err != nil {
+		t.Fatal("Unable to pause channel", err)
+	}
+
+	for _, data := range []string{"first", "second", "dropped"} {
+		es.eventSource.SendEvent(Event{Data: data}, "default")
+	}
+
+	// Consumers stay connected, but receive nothing while the channel is paused
+	expectNoResponse(t, conn)
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 1 {
+		t.Error("Expected 1 consumer while the channel is paused, got", consumerCount)
+	}
+	if dropped := es.eventSource.Stats().MessagesDropped; dropped != 1 {
+		t.Error("Expected 1 dropped message beyond MaxPausedMessages, got", dropped)
+	}
+
+	// Held messages are delivered in publish order on resume
+	if err := es.eventSource.ResumeChannel("default"); err != nil {
+		t.Fatal("Unable to resume channel", err)
+	}
+	expectResponse(t, conn, "data: first\n\ndata: second\n\n")
+
+	es.eventSource.SendEvent(Event{Data: "live"}, "default")
+	expectResponse(t, conn, "data: live\n\n")
+
+	if err := es.eventSource.PauseChannel("all"); err != ErrInvalidChannel {
+		t.Error("Expected ErrInvalidChannel for the global channel, got", err)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	for path, allow := range map[string]string{
+		"/default":       "GET, POST, DELETE, HEAD, OPTIONS",
+		"/default/stats": "GET",
+	} {
+		req, _ := http.NewRequest("PUT", es.testServer.URL+path, strings.NewReader("{}"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send PUT request", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("Expected status code 405 for PUT %s, got %d", path, resp.StatusCode)
+		}
+		if header := resp.Header.Get("Allow"); header != allow {
+			t.Errorf("Expected Allow header '%s' for %s, got '%s'", allow, path, header)
+		}
+	}
+
+	// Unknown paths are still not found
+	req, _ := http.NewRequest("PUT", es.testServer.URL+"/default/unknown/path", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Unable to send PUT request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected status code 404 for unknown paths, got", resp.StatusCode)
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		AuthToken:            "secret",
+		ErrorFormat:          ErrorFormatJSON,
+		AllowedChannels:      []string{"default"},
+		DisableGlobalChannel: true,
+		EnableLongPoll:       true,
+	})
+	defer es.closeEventSource()
+
+	for request, expected := range map[[3]string]struct {
+		status  int
+		message string
+	}{
+		{"GET", "/INVALID"}:               {http.StatusNotFound, "Invalid channel name."},
+		{"PUT", "/default"}:               {http.StatusMethodNotAllowed, "Method PUT not allowed."},
+		{"POST", "/default"}:              {http.StatusForbidden, "Authentication failed. Publishing to channel rejected."},
+		{"GET", "/default/stats"}:         {http.StatusForbidden, "Authentication failed. Gettings stats for channel rejected."},
+		{"GET", "/random"}:                {http.StatusNotFound, "Invalid channel name."},
+		{"GET", "/random/poll"}:           {http.StatusNotFound, "Invalid channel name."},
+		{"POST", "/random", "secret"}:     {http.StatusNotFound, "Invalid channel name."},
+		{"POST", "/broadcast", "secret"}:  {http.StatusNotFound, "Global notifications are disabled."},
+		{"DELETE", "/default", "invalid"}: {http.StatusForbidden, "Authentication failed. Closing of channel rejected."},
+	} {
+		req, _ := http.NewRequest(request[0], es.testServer.URL+request[1], buildMessageData(ModeAll))
+		req.Header.Set("Content-Type", "application/json")
+		if len(request[2]) > 0 {
+			req.Header.Set("Auth-Token", request[2])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Unable to send request", err)
+		}
+
+		var result map[string]string
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if resp.StatusCode != expected.status {
+			t.Errorf("Expected status code %d for %s %s, got %d", expected.status, request[0], request[1], resp.StatusCode)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Expected Content-Type application/json for %s %s, got %s", request[0], request[1], contentType)
+		}
+		if err != nil || len(result) != 1 || result["error"] != expected.message {
+			t.Errorf("Expected {\"error\":%q} for %s %s, got %v (%v)", expected.message, request[0], request[1], result, err)
+		}
+	}
+
+	// Plain text is the default
+	es.eventSource.UpdateSettings(&Settings{})
+	resp, err := http.Get(es.testServer.URL + "/INVALID")
+	if err != nil {
+		t.Fatal("Unable to send GET request", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") || string(body) != "Error: Invalid channel name.\n" {
+		t.Error("Expected a plain text error by default, got", resp.Header.Get("Content-Type"), string(body))
+	}
+}
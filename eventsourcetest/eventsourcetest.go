@@ -0,0 +1,145 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package eventsourcetest provides an in-memory EventSource service and subscribers for testing code,
+// which publishes or consumes events. It lives in its own package, so it's not linked into production builds.
+//
+//	server := eventsourcetest.NewServer(nil)
+//	defer server.Close()
+//
+//	subscriber := server.Subscribe(t, "updates")
+//	publishUpdate(server.URL + "/updates")
+//	subscriber.ExpectEvent("update", "hello")
+package eventsourcetest
+
+import (
+	"github.com/railsmechanic/eventsource"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Default time to wait for events.
+const defaultTimeout = 2 * time.Second
+
+// Server is an EventSource service served by an httptest.Server.
+// The embedded EventSource publishes events directly, the URL is used for requests via HTTP.
+type Server struct {
+	eventsource.EventSource
+	URL string
+
+	settings *eventsource.Settings
+	server   *httptest.Server
+}
+
+// NewServer starts and returns a new Server with the given settings, which may be nil.
+func NewServer(settings *eventsource.Settings) *Server {
+	es := eventsource.New(settings)
+	server := httptest.NewServer(es.Router())
+	return &Server{
+		EventSource: es,
+		URL:         server.URL,
+		settings:    settings,
+		server:      server,
+	}
+}
+
+// ChannelURL returns the URL of a channel, including the configured base path.
+func (s *Server) ChannelURL(channel string) string {
+	return s.URL + s.settings.GetBasePath() + "/" + channel
+}
+
+// Close stops the EventSource service and shuts down the server.
+func (s *Server) Close() {
+	s.EventSource.Stop()
+	s.server.Close()
+}
+
+// Subscriber receives the events of a channel and asserts them.
+// Failed assertions and timeouts fail the test.
+type Subscriber struct {
+	// Timeout is the time to wait for an event, 2 seconds by default.
+	Timeout time.Duration
+
+	t      testing.TB
+	client *eventsource.Client
+	events <-chan eventsource.Event
+}
+
+// Subscribe connects a new subscriber to a channel via HTTP and fails the test if the subscription is rejected.
+// The subscriber is closed when the test finishes.
+func (s *Server) Subscribe(t testing.TB, channel string) *Subscriber {
+	t.Helper()
+
+	client := eventsource.NewClient()
+	client.HTTPClient = s.server.Client()
+	events, err := client.Connect(s.ChannelURL(channel))
+	if err != nil {
+		t.Fatalf("eventsourcetest: unable to subscribe to channel '%s'. %s", channel, err)
+	}
+
+	subscriber := &Subscriber{
+		Timeout: defaultTimeout,
+		t:       t,
+		client:  client,
+		events:  events,
+	}
+	t.Cleanup(subscriber.Close)
+	return subscriber
+}
+
+// Next waits for the next event and returns it.
+func (sub *Subscriber) Next() eventsource.Event {
+	sub.t.Helper()
+
+	select {
+	case e, ok := <-sub.events:
+		if !ok {
+			sub.t.Fatal("eventsourcetest: the stream was closed while waiting for an event")
+		}
+		return e
+	case <-time.After(sub.Timeout):
+		sub.t.Fatalf("eventsourcetest: no event received within %s", sub.Timeout)
+	}
+	return eventsource.Event{}
+}
+
+// Expect waits for the next event and fails the test if it doesn't equal the expected event.
+// Comments aren't part of received events, so they are ignored.
+func (sub *Subscriber) Expect(expected eventsource.Event) {
+	sub.t.Helper()
+
+	expected.Comments, expected.TTL = nil, 0
+	if e := sub.Next(); !reflect.DeepEqual(e, expected) {
+		sub.t.Errorf("eventsourcetest: expected event %+v, got %+v", expected, e)
+	}
+}
+
+// ExpectEvent waits for the next event and fails the test if its name or data differ.
+func (sub *Subscriber) ExpectEvent(event, data string) {
+	sub.t.Helper()
+
+	if e := sub.Next(); e.Event != event || e.Data != data {
+		sub.t.Errorf("eventsourcetest: expected event '%s' with data '%s', got event '%s' with data '%s'", event, data, e.Event, e.Data)
+	}
+}
+
+// ExpectNone fails the test if an event is received within the given duration.
+func (sub *Subscriber) ExpectNone(duration time.Duration) {
+	sub.t.Helper()
+
+	select {
+	case e, ok := <-sub.events:
+		if ok {
+			sub.t.Errorf("eventsourcetest: expected no event, got %+v", e)
+		}
+	case <-time.After(duration):
+	}
+}
+
+// Close disconnects the subscriber.
+func (sub *Subscriber) Close() {
+	sub.client.Close()
+}
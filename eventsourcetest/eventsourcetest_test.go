@@ -0,0 +1,35 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsourcetest
+
+import (
+	"github.com/railsmechanic/eventsource"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer(&eventsource.Settings{BasePath: "/events"})
+	defer server.Close()
+
+	subscriber := server.Subscribe(t, "updates")
+
+	// Events published via HTTP
+	resp, err := http.Post(server.ChannelURL("updates"), "application/json", strings.NewReader(`{"id":1,"event":"update","data":"hello"}`))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+	subscriber.Expect(eventsource.Event{Id: 1, Event: "update", Data: "hello"})
+
+	// Events published directly
+	server.SendEvent(eventsource.Event{Event: "update", Data: "world"}, "updates")
+	subscriber.ExpectEvent("update", "world")
+
+	server.SendEvent(eventsource.Event{Data: "elsewhere"}, "other")
+	subscriber.ExpectNone(100 * time.Millisecond)
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Settings of the forwarding of published events.
+const (
+	forwardQueueSize  = 256
+	forwardAttempts   = 3
+	forwardRetryDelay = 500 * time.Millisecond
+	forwardTimeout    = 5 * time.Second
+)
+
+// ForwardedEvent stores an event and its channel, which are posted as JSON to the forward URL.
+type forwardedEvent struct {
+	Channel string `json:"channel"`
+	*Event
+}
+
+// Forwarding stores a serialized event and the URL it's forwarded to.
+type forwarding struct {
+	url     string
+	channel string
+	payload []byte
+}
+
+// ForwardMessage queues a published message for the forwarding to the forward URL of its channel.
+// It never blocks the dispatcher, messages are dropped if the queue is full.
+// Pre-formatted event streams and streamed messages aren't forwarded, as they can't be serialized as events.
+func (es *eventSource) forwardMessage(em *eventMessage) {
+	if em.batch != nil {
+		for _, bm := range em.batch {
+			es.forwardMessage(bm)
+		}
+		return
+	}
+
+	url := es.currentSettings().GetForwardURL(em.Channel)
+	if len(url) == 0 || em.raw != nil || em.stream != nil {
+		return
+	}
+
+	payload, err := json.Marshal(&forwardedEvent{Channel: em.Channel, Event: em.event()})
+	if err != nil {
+		es.errorf("Unable to serialize event of channel '%s' for forwarding. %s\n", em.Channel, err)
+		return
+	}
+
+	select {
+	case es.forwardQueue <- &forwarding{url: url, channel: em.Channel, payload: payload}:
+	default:
+		es.errorf("Forwarding queue is full. Event of channel '%s' dropped\n", em.Channel)
+	}
+}
+
+// ForwardDispatcher posts queued events to their forward URLs, one after another, so the order is kept.
+// Failed posts are retried and finally logged. It stops when the service is stopped.
+func (es *eventSource) forwardDispatcher() {
+	for {
+		select {
+		case fw := <-es.forwardQueue:
+			es.forward(fw)
+		case <-es.done:
+			return
+		}
+	}
+}
+
+// Forward posts a serialized event to its forward URL and retries failed posts.
+func (es *eventSource) forward(fw *forwarding) {
+	for attempt := 1; attempt <= forwardAttempts; attempt++ {
+		err := es.post(fw)
+		if err == nil {
+			return
+		}
+		es.errorf("Forwarding event of channel '%s' to %s failed (attempt %d of %d). %s\n", fw.channel, fw.url, attempt, forwardAttempts, err)
+
+		if attempt < forwardAttempts {
+			select {
+			case <-time.After(forwardRetryDelay):
+			case <-es.done:
+				return
+			}
+		}
+	}
+}
+
+// Post sends a serialized event as JSON to its forward URL. Any status but 2xx is an error.
+// All posts share a single client, which times out after the forwardTimeout, as the WriteTimeout only applies to consumers.
+// The response is drained, so the connection is reused for the next post.
+func (es *eventSource) post(fw *forwarding) error {
+	resp, err := es.forwardClient.Post(fw.url, "application/json", bytes.NewReader(fw.payload))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Helper for receiving a forwarded event
+func receiveForwarded(t *testing.T, forwarded <-chan forwardedEvent) forwardedEvent {
+	select {
+	case fe := <-forwarded:
+		return fe
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout while waiting for a forwarded event")
+	}
+	return forwardedEvent{}
+}
+
+func TestForwardURL(t *testing.T) {
+	forwarded := make(chan forwardedEvent, 8)
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The first attempt fails, so the event is retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		fe := forwardedEvent{Event: &Event{}}
+		if err := json.NewDecoder(req.Body).Decode(&fe); err != nil {
+			t.Error("Unable to decode forwarded event", err)
+		}
+		forwarded <- fe
+	}))
+	defer target.Close()
+
+	es := setupEventSource(t, &Settings{ForwardURL: target.URL})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if err := es.eventSource.SendEvent(Event{Id: 1, Event: "foo", Data: "bar"}, "default"); err != nil {
+		t.Fatal("Unable to send event", err)
+	}
+
+	// The local delivery isn't delayed by the forwarding
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	if fe := receiveForwarded(t, forwarded); fe.Channel != "default" || fe.Id != 1 || fe.Event.Event != "foo" || fe.Data != "bar" {
+		t.Error("Unexpected forwarded event", fe.Channel, fe.Event)
+	}
+
+	if attempts := atomic.LoadInt32(&requests); attempts != 2 {
+		t.Error("Expected 2 attempts, got", attempts)
+	}
+}
+
+func TestForwardURLs(t *testing.T) {
+	forwarded := make(chan forwardedEvent, 8)
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fe := forwardedEvent{Event: &Event{}}
+		json.NewDecoder(req.Body).Decode(&fe)
+		forwarded <- fe
+	}))
+	defer target.Close()
+
+	es := setupEventSource(t, &Settings{ForwardURLs: map[string]string{"orders": target.URL + "/orders"}})
+	defer es.closeEventSource()
+
+	es.eventSource.SendEvent(Event{Data: "not forwarded"}, "default")
+	es.eventSource.SendMessage(strings.NewReader(`{"data":"forwarded"}`), "orders")
+
+	if fe := receiveForwarded(t, forwarded); fe.Channel != "orders" || fe.Data != "forwarded" {
+		t.Error("Expected only the event of channel 'orders' to be forwarded, got", fe.Channel, fe.Data)
+	}
+}
+
+func TestForwardTimeout(t *testing.T) {
+	forwarded := make(chan forwardedEvent, 8)
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// The first attempt hangs until it times out, so the event is retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			io.ReadAll(req.Body)
+			select {
+			case <-req.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+
+		fe := forwardedEvent{Event: &Event{}}
+		json.NewDecoder(req.Body).Decode(&fe)
+		forwarded <- fe
+	}))
+	defer target.Close()
+
+	es := setupEventSource(t, &Settings{ForwardURL: target.URL, WriteTimeout: time.Minute})
+	defer es.closeEventSource()
+	es.eventSource.(*eventSource).forwardClient.Timeout = 100 * time.Millisecond
+
+	es.eventSource.SendEvent(Event{Data: "forwarded"}, "default")
+
+	if fe := receiveForwarded(t, forwarded); fe.Data != "forwarded" {
+		t.Error("Expected the event to be forwarded after the timeout, got", fe.Data)
+	}
+	if attempts := atomic.LoadInt32(&requests); attempts != 2 {
+		t.Error("Expected 2 attempts, got", attempts)
+	}
+}
+
+func TestGetForwardURL(t *testing.T) {
+	s := &Settings{
+		ForwardURL:  "http://example.com/events",
+		ForwardURLs: map[string]string{"orders": "http://example.com/orders", "private": ""},
+	}
+
+	for channel, expected := range map[string]string{
+		"default": "http://example.com/events",
+		"orders":  "http://example.com/orders",
+		"private": "",
+	} {
+		if url := s.GetForwardURL(channel); url != expected {
+			t.Errorf("Expected '%s' for channel '%s', got '%s'", expected, channel, url)
+		}
+	}
+}
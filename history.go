@@ -0,0 +1,184 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ReplayMode sets which messages the history of a channel keeps for replaying them to reconnecting consumers.
+type ReplayMode int
+
+// Available replay modes. ReplayLastValue keeps only the latest message per replay key, like a compacted log topic,
+// so consumers of state-snapshot channels get the current state instead of every change.
+const (
+	ReplayHistory ReplayMode = iota + 1
+	ReplayLastValue
+)
+
+// HistoryEntry stores a delivered message, the time it was delivered, the time it expires and its size in bytes.
+// Entries of messages without TTL never expire, but are still limited by the replay window.
+type historyEntry struct {
+	message   *eventMessage
+	timestamp time.Time
+	expires   time.Time
+	size      int
+}
+
+// Expired checks whether the TTL of a history entry has elapsed.
+func (he *historyEntry) expired(now time.Time) bool {
+	return !he.expires.IsZero() && !now.Before(he.expires)
+}
+
+// ReplayRequest stores which messages of the history a consumer asked for when subscribing.
+type replayRequest struct {
+	lastEventId string
+	since       time.Time
+}
+
+// NewReplayRequest builds and returns a replayRequest based on the Last-Event-ID header or the 'lastSeconds' parameter.
+// The requested time span is limited by the replay window. If a consumer asks for no replay, nil is returned.
+func newReplayRequest(req *http.Request, replayWindow time.Duration) *replayRequest {
+	if replayWindow <= 0 {
+		return nil
+	}
+
+	since := time.Now().Add(-replayWindow)
+	if lastEventId := req.Header.Get("Last-Event-ID"); len(lastEventId) > 0 {
+		return &replayRequest{lastEventId: lastEventId, since: since}
+	}
+
+	if lastSeconds, err := strconv.Atoi(req.URL.Query().Get("lastSeconds")); err == nil && lastSeconds > 0 {
+		if requested := time.Now().Add(-time.Duration(lastSeconds) * time.Second); requested.After(since) {
+			since = requested
+		}
+		return &replayRequest{since: since}
+	}
+
+	return nil
+}
+
+// StoreMessage appends a message to the history of its channel.
+// Messages of the global channel are not stored, as they don't belong to a single channel.
+// Streamed messages are not stored either, as their data is never held as a whole.
+// In the ReplayLastValue mode, stored messages with the same replay key are replaced.
+// If the history of all channels exceeds the MaxReplayMemoryBytes, the oldest messages are evicted.
+func (es *eventSource) storeMessage(em *eventMessage) {
+	if es.replayWindow <= 0 || es.isGlobalChannel(em.Channel) || em.stream != nil {
+		return
+	}
+	entry := &historyEntry{
+		message:   em,
+		timestamp: time.Now(),
+		size:      len(em.Message()),
+	}
+	if em.TTL > 0 {
+		entry.expires = entry.timestamp.Add(time.Duration(em.TTL) * time.Millisecond)
+	}
+	if es.currentSettings().GetReplayMode() == ReplayLastValue {
+		es.compactHistory(em.Channel, es.currentSettings().replayKey(em))
+	}
+	es.history[em.Channel] = append(es.history[em.Channel], entry)
+	es.historyBytes += entry.size
+	es.evictHistory()
+}
+
+// EvictHistory removes the oldest messages across all channels, until the history fits into the MaxReplayMemoryBytes.
+func (es *eventSource) evictHistory() {
+	maxReplayMemoryBytes := es.currentSettings().GetMaxReplayMemoryBytes()
+	for maxReplayMemoryBytes > 0 && es.historyBytes > maxReplayMemoryBytes {
+		var oldest string
+		for channel, entries := range es.history {
+			if len(oldest) == 0 || entries[0].timestamp.Before(es.history[oldest][0].timestamp) {
+				oldest = channel
+			}
+		}
+
+		entries := es.history[oldest]
+		es.historyBytes -= entries[0].size
+		if len(entries) == 1 {
+			delete(es.history, oldest)
+		} else {
+			// Releases the evicted message, which is still referenced by the backing array.
+			entries[0] = nil
+			es.history[oldest] = entries[1:]
+		}
+	}
+}
+
+// DropHistory removes the history of a channel.
+func (es *eventSource) dropHistory(channel string) {
+	for _, entry := range es.history[channel] {
+		es.historyBytes -= entry.size
+	}
+	delete(es.history, channel)
+}
+
+// CompactHistory removes the messages with the given replay key from the history of a channel.
+func (es *eventSource) compactHistory(channel, key string) {
+	entries := es.history[channel][:0]
+	for _, entry := range es.history[channel] {
+		if es.currentSettings().replayKey(entry.message) != key {
+			entries = append(entries, entry)
+		} else {
+			es.historyBytes -= entry.size
+		}
+	}
+	es.history[channel] = entries
+}
+
+// PruneHistory removes all messages which are older than the replay window.
+func (es *eventSource) pruneHistory() {
+	since := time.Now().Add(-es.replayWindow)
+	for channel, entries := range es.history {
+		i := 0
+		for i < len(entries) && entries[i].timestamp.Before(since) {
+			es.historyBytes -= entries[i].size
+			i++
+		}
+
+		if i == len(entries) {
+			delete(es.history, channel)
+		} else if i > 0 {
+			es.history[channel] = append([]*historyEntry(nil), entries[i:]...)
+		}
+	}
+}
+
+// ReplayMessages returns the messages of a channel's history requested by the consumer.
+// If the consumer sent a Last-Event-ID, messages after this event are returned.
+// Unknown event IDs cause a replay of all messages within the replay window.
+// Messages whose TTL has elapsed are not replayed.
+func (es *eventSource) replayMessages(channel string, rr *replayRequest) []*eventMessage {
+	if rr == nil {
+		return nil
+	}
+
+	entries := es.history[channel]
+	start := 0
+	for start < len(entries) && entries[start].timestamp.Before(rr.since) {
+		start++
+	}
+
+	if len(rr.lastEventId) > 0 {
+		for i := len(entries) - 1; i >= start; i-- {
+			if strconv.FormatUint(uint64(entries[i].message.Id), 10) == rr.lastEventId {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	messages := make([]*eventMessage, 0, len(entries)-start)
+	for _, entry := range entries[start:] {
+		if !entry.expired(now) {
+			messages = append(messages, entry.message)
+		}
+	}
+	return messages
+}
@@ -0,0 +1,264 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Helper for building an eventSource with a history, but without a running dispatcher
+func historyEventSource(replayWindow time.Duration) *eventSource {
+	return &eventSource{
+		settings:     &Settings{ReplayWindow: replayWindow},
+		replayWindow: replayWindow,
+		history:      make(map[string][]*historyEntry),
+	}
+}
+
+// Helper for reading EventSource responses until the expected response arrives
+func readUntil(t *testing.T, conn net.Conn, resp []byte, expectedResponse string) string {
+	response := string(bytes.TrimRight(resp, "\x00"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for !strings.Contains(response, expectedResponse) {
+		buffer := make([]byte, 1024)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Errorf("Expected response:\n%s\n and got:\n%s\n", expectedResponse, response)
+			break
+		}
+		response += string(buffer[:n])
+	}
+	return response
+}
+
+func TestReplayWindow(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			ReplayWindow: 300 * time.Millisecond,
+		})
+	defer es.closeEventSource()
+
+	es.eventSource.SendEvent(Event{Id: 1, Data: "stale"}, "default")
+	time.Sleep(400 * time.Millisecond)
+	es.eventSource.SendEvent(Event{Id: 2, Data: "foo"}, "default")
+	es.eventSource.SendEvent(Event{Id: 3, Data: "bar"}, "default")
+
+	// Events after the Last-Event-ID are replayed
+	conn, resp := es.joinChannel(t, "default", "Last-Event-ID: 2")
+	defer conn.Close()
+
+	if response := readUntil(t, conn, resp, "id: 3\ndata: bar\n\n"); strings.Contains(response, "data: foo") {
+		t.Error("Event with the Last-Event-ID should not be replayed")
+	}
+
+	// Events within the requested seconds are replayed, stale ones aren't
+	conn2, resp := es.joinChannel(t, "default?lastSeconds=10")
+	defer conn2.Close()
+
+	response := readUntil(t, conn2, resp, "id: 3\ndata: bar\n\n")
+	if !strings.Contains(response, "id: 2\ndata: foo\n\n") {
+		t.Error("Events within the requested seconds should be replayed")
+	}
+
+	if strings.Contains(response, "stale") {
+		t.Error("Events outside of the replay window should not be replayed")
+	}
+
+	// Without Last-Event-ID or lastSeconds nothing is replayed
+	conn3, _ := es.joinChannel(t, "default")
+	defer conn3.Close()
+	expectNoResponse(t, conn3)
+}
+
+func TestReplayWindowOnStartupOnly(t *testing.T) {
+	// Without a replay window on startup, there's no pruning, so later settings must not enable the history
+	es := historyEventSource(0)
+	es.settings = &Settings{ReplayWindow: time.Minute}
+	es.storeMessage(&eventMessage{Id: 1, Channel: "default"})
+
+	if len(es.history) != 0 {
+		t.Error("Expected no history without a replay window on startup, got", es.history)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	es := historyEventSource(time.Minute)
+	es.history["default"] = []*historyEntry{
+		{message: &eventMessage{Id: 1}, timestamp: time.Now().Add(-2 * time.Minute)},
+		{message: &eventMessage{Id: 2}, timestamp: time.Now()},
+	}
+	es.history["stale"] = []*historyEntry{
+		{message: &eventMessage{Id: 1}, timestamp: time.Now().Add(-2 * time.Minute)},
+	}
+
+	es.pruneHistory()
+
+	if entries := es.history["default"]; len(entries) != 1 || entries[0].message.Id != 2 {
+		t.Error("Expected only the recent message to be kept, got", len(entries), "messages")
+	}
+
+	if _, ok := es.history["stale"]; ok {
+		t.Error("Expected history of channel 'stale' to be removed")
+	}
+}
+
+func TestReplayMessages(t *testing.T) {
+	es := historyEventSource(time.Minute)
+	for id := uint(1); id <= 3; id++ {
+		es.storeMessage(&eventMessage{Id: id, Channel: "default"})
+	}
+
+	// Unknown event IDs replay the whole window
+	rr := &replayRequest{lastEventId: "42", since: time.Now().Add(-time.Minute)}
+	if messages := es.replayMessages("default", rr); len(messages) != 3 {
+		t.Error("Expected 3 replayed messages, got", len(messages))
+	}
+
+	rr = &replayRequest{lastEventId: "3", since: time.Now().Add(-time.Minute)}
+	if messages := es.replayMessages("default", rr); len(messages) != 0 {
+		t.Error("Expected 0 replayed messages, got", len(messages))
+	}
+
+	if messages := es.replayMessages("default", nil); messages != nil {
+		t.Error("Expected no replay without a replay request, got", len(messages))
+	}
+
+	// Replay requests are limited by the replay window
+	req := httptest.NewRequest("GET", "/default?lastSeconds=3600", nil)
+	if rr := newReplayRequest(req, time.Minute); rr == nil || time.Since(rr.since) > time.Minute+time.Second {
+		t.Error("Expected replay request limited to the replay window")
+	}
+
+	if rr := newReplayRequest(req, 0); rr != nil {
+		t.Error("Expected no replay request without a replay window")
+	}
+}
+
+func TestReplayTTL(t *testing.T) {
+	es := historyEventSource(time.Minute)
+	es.storeMessage(&eventMessage{Id: 1, Channel: "default", TTL: 50})
+	es.storeMessage(&eventMessage{Id: 2, Channel: "default"})
+
+	rr := &replayRequest{since: time.Now().Add(-time.Minute)}
+	if messages := es.replayMessages("default", rr); len(messages) != 2 {
+		t.Error("Expected 2 replayed messages before the TTL elapsed, got", len(messages))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Expired messages are skipped, even if they are known by the Last-Event-ID
+	if messages := es.replayMessages("default", rr); len(messages) != 1 || messages[0].Id != 2 {
+		t.Error("Expected only the message without TTL to be replayed, got", len(messages))
+	}
+
+	rr = &replayRequest{lastEventId: "42", since: time.Now().Add(-time.Minute)}
+	if messages := es.replayMessages("default", rr); len(messages) != 1 || messages[0].Id != 2 {
+		t.Error("Expected only the message without TTL to be replayed, got", len(messages))
+	}
+}
+
+func TestReplayTTLViaHTTP(t *testing.T) {
+	es := setupEventSource(t,
+		&Settings{
+			ReplayWindow: time.Minute,
+		})
+	defer es.closeEventSource()
+
+	es.eventSource.SendMessage(strings.NewReader("{\"id\":1,\"event\":\"typing\",\"ttl\":50}"), "default")
+	es.eventSource.SendMessage(strings.NewReader("{\"id\":2,\"data\":\"message\"}"), "default")
+	time.Sleep(100 * time.Millisecond)
+
+	conn, resp := es.joinChannel(t, "default", "Last-Event-ID: 0")
+	defer conn.Close()
+
+	if response := readUntil(t, conn, resp, "id: 2\ndata: message\n\n"); strings.Contains(response, "typing") {
+		t.Error("Expired event should not be replayed")
+	}
+}
+
+func TestReplayLastValue(t *testing.T) {
+	es := historyEventSource(time.Minute)
+	es.settings.ReplayMode = ReplayLastValue
+
+	es.storeMessage(&eventMessage{Id: 1, Event: "price", Data: "10", Channel: "default"})
+	es.storeMessage(&eventMessage{Id: 2, Event: "volume", Data: "500", Channel: "default"})
+	es.storeMessage(&eventMessage{Id: 3, Event: "price", Data: "11", Channel: "default"})
+	es.storeMessage(&eventMessage{Id: 4, Data: "unnamed", Channel: "default"})
+
+	// Only the latest message per event name is replayed, in the order of publishing
+	rr := &replayRequest{since: time.Now().Add(-time.Minute)}
+	messages := es.replayMessages("default", rr)
+	if len(messages) != 3 {
+		t.Fatal("Expected 3 replayed messages, got", len(messages))
+	}
+	for i, id := range []uint{2, 3, 4} {
+		if messages[i].Id != id {
+			t.Errorf("Expected message %d at position %d, got %d", id, i, messages[i].Id)
+		}
+	}
+
+	// Messages are keyed by the ReplayKey, if set up
+	es.settings.ReplayKey = func(e *Event) string {
+		key, _, _ := strings.Cut(e.Data, ":")
+		return key
+	}
+	es.storeMessage(&eventMessage{Id: 5, Data: "AAPL:10", Channel: "quotes"})
+	es.storeMessage(&eventMessage{Id: 6, Data: "MSFT:20", Channel: "quotes"})
+	es.storeMessage(&eventMessage{Id: 7, Data: "AAPL:11", Channel: "quotes"})
+
+	messages = es.replayMessages("quotes", rr)
+	if len(messages) != 2 || messages[0].Id != 6 || messages[1].Id != 7 {
+		t.Error("Expected messages 6 and 7 to be replayed, got", messages)
+	}
+}
+
+func TestMaxReplayMemoryBytes(t *testing.T) {
+	es := historyEventSource(time.Minute)
+	es.settings.MaxReplayMemoryBytes = 1000
+
+	// The last messages take about 110 bytes each, including their ID and fields
+	data := eventData(strings.Repeat("x", 94))
+	for i := 0; i < 100; i++ {
+		es.storeMessage(&eventMessage{Id: uint(i + 1), Data: data, Channel: fmt.Sprintf("channel-%d", i%25)})
+	}
+
+	retained, count := 0, 0
+	for _, entries := range es.history {
+		for _, entry := range entries {
+			retained += entry.size
+			count++
+		}
+	}
+	if retained != es.historyBytes || retained > 1000 {
+		t.Errorf("Expected at most 1000 retained bytes, got %d (tracked %d)", retained, es.historyBytes)
+	}
+	if count != 9 {
+		t.Error("Expected 9 retained messages, got", count)
+	}
+
+	// The oldest messages are evicted first, across all channels
+	rr := &replayRequest{since: time.Now().Add(-time.Minute)}
+	if messages := es.replayMessages("channel-24", rr); len(messages) != 1 || messages[0].Id != 100 {
+		t.Error("Expected the latest message of channel-24 to be retained, got", messages)
+	}
+	if messages := es.replayMessages("channel-0", rr); len(messages) != 0 {
+		t.Error("Expected the messages of channel-0 to be evicted, got", messages)
+	}
+
+	// Dropping a channel releases its share
+	size := es.history["channel-24"][0].size
+	es.dropHistory("channel-24")
+	if es.historyBytes != retained-size {
+		t.Errorf("Expected %d retained bytes after dropping a channel, got %d", retained-size, es.historyBytes)
+	}
+}
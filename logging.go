@@ -0,0 +1,47 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"log"
+)
+
+// LogLevel sets the verbosity of the log output of the EventSource service.
+type LogLevel int
+
+// Available log levels. Each level includes the output of the levels before.
+const (
+	LogSilent LogLevel = iota + 1
+	LogError
+	LogInfo
+	LogDebug
+)
+
+// Logf logs a message with the given prefix, if the log level of the settings includes the level of the message.
+func (s *Settings) logf(level LogLevel, prefix, format string, v ...any) {
+	if s.GetLogLevel() >= level {
+		log.Printf(prefix+format, v...)
+	}
+}
+
+// Errorf logs errors, e.g. rejected requests and failed deliveries.
+func (s *Settings) errorf(format string, v ...any) {
+	s.logf(LogError, "[E] ", format, v...)
+}
+
+// Errorf logs errors with the current settings.
+func (es *eventSource) errorf(format string, v ...any) {
+	es.currentSettings().errorf(format, v...)
+}
+
+// Infof logs the lifecycle of the service and its channels.
+func (es *eventSource) infof(format string, v ...any) {
+	es.currentSettings().logf(LogInfo, "[I] ", format, v...)
+}
+
+// Debugf logs events happening for single consumers and messages, which are noisy at scale.
+func (es *eventSource) debugf(format string, v ...any) {
+	es.currentSettings().logf(LogDebug, "[D] ", format, v...)
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"time"
+)
+
+// MirrorConfig describes an upstream event stream, whose events are relayed to the consumers of a local channel.
+// The URL is the stream of any EventSource compatible server, e.g. 'http://primary.example.com/orders'.
+type MirrorConfig struct {
+	URL     string
+	Channel string
+}
+
+// StartMirrors connects to the upstream streams of the MirrorSources. Invalid configurations are logged and skipped.
+// It's only called on startup, the mirrored channels are kept as they are for the lifetime of the service.
+func (es *eventSource) startMirrors() {
+	es.mirrors = make(map[string]bool)
+	for _, mc := range es.currentSettings().MirrorSources {
+		if len(mc.URL) == 0 || !validChannelName(mc.Channel) || es.isGlobalChannel(mc.Channel) {
+			es.errorf("Invalid mirror of '%s' to channel '%s' ignored\n", mc.URL, mc.Channel)
+			continue
+		}
+		es.mirrors[mc.Channel] = true
+		go es.mirror(mc)
+	}
+}
+
+// Mirror relays the events of an upstream stream to the consumers of a local channel until the service is stopped.
+// The client resumes lost streams by itself, failed connections are retried after its reconnect delay.
+func (es *eventSource) mirror(mc MirrorConfig) {
+	client := NewClient()
+	go func() {
+		<-es.done
+		client.Close()
+	}()
+
+	for {
+		events, err := client.Connect(mc.URL)
+		if err != nil {
+			es.errorf("Unable to mirror '%s' to channel '%s'. %s\n", mc.URL, mc.Channel, err)
+		} else {
+			es.infof("Mirroring '%s' to channel '%s'\n", mc.URL, mc.Channel)
+			for e := range events {
+				if err := es.SendEvent(e, mc.Channel); err != nil && err != ErrStopped {
+					es.errorf("Unable to relay mirrored event to channel '%s'. %s\n", mc.Channel, err)
+				}
+			}
+			if err := client.Err(); err != nil {
+				es.errorf("Mirroring '%s' to channel '%s' ended. %s\n", mc.URL, mc.Channel, err)
+			}
+		}
+
+		select {
+		case <-es.done:
+			return
+		case <-time.After(client.reconnectDelay()):
+		}
+	}
+}
+
+// Mirrored checks whether a channel relays the events of an upstream stream, which makes it read-only.
+func (es *eventSource) mirrored(channel string) bool {
+	return es.mirrors[channel]
+}
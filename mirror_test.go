@@ -0,0 +1,48 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	upstream := setupEventSource(t, nil)
+	defer upstream.closeEventSource()
+
+	replica := setupEventSource(t, &Settings{
+		MirrorSources: []MirrorConfig{
+			{URL: upstream.testServer.URL + "/orders", Channel: "replica"},
+			{URL: upstream.testServer.URL + "/invalid", Channel: "all"},
+		},
+	})
+	defer replica.closeEventSource()
+
+	for deadline := time.Now().Add(2 * time.Second); upstream.eventSource.ConsumerCount("orders") == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout while waiting for the mirror to connect")
+		}
+	}
+
+	conn, _ := replica.joinChannel(t, "replica")
+	defer conn.Close()
+
+	upstream.eventSource.SendMessage(buildMessageData(ModeAll), "orders")
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	// Mirrored channels are read-only
+	resp, err := http.Post(replica.testServer.URL+"/replica", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to send POST request", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("Expected status code 409 for publishing to a mirrored channel, got", resp.StatusCode)
+	}
+	expectNoResponse(t, conn)
+}
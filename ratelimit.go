@@ -0,0 +1,50 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"time"
+)
+
+// RateLimiter is a token bucket, which limits the events sent to a consumer per second.
+// Bursts of up to one second worth of events pass at once. It's only used by the dispatcher, so it isn't synchronized.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter builds and returns a rateLimiter for the given events per second.
+// Without a limit, nil is returned, which allows all events.
+func newRateLimiter(eventsPerSecond int) *rateLimiter {
+	if eventsPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(eventsPerSecond),
+		tokens: float64(eventsPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes the tokens for the given number of events and returns whether the events may be sent.
+// Batches exceeding the rate pass once the bucket is full and are paid off afterwards.
+func (rl *rateLimiter) allow(events int, now time.Time) bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+
+	if rl.tokens < min(float64(events), rl.rate) {
+		return false
+	}
+	rl.tokens -= float64(events)
+	return true
+}
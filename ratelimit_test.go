@@ -0,0 +1,52 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(4)
+	now := rl.last
+
+	// A burst of one second worth of events passes
+	for i := 0; i < 4; i++ {
+		if !rl.allow(1, now) {
+			t.Fatal("Expected event", i, "of the burst to pass")
+		}
+	}
+	if rl.allow(1, now) {
+		t.Error("Expected the event exceeding the rate to be limited")
+	}
+
+	// Tokens are refilled over time
+	now = now.Add(250 * time.Millisecond)
+	if !rl.allow(1, now) || rl.allow(1, now) {
+		t.Error("Expected a single event to pass after a quarter of a second")
+	}
+
+	// Batches exceeding the rate pass once the bucket is full
+	now = now.Add(time.Second)
+	if !rl.allow(6, now) {
+		t.Error("Expected a large batch to pass with a full bucket")
+	}
+	if rl.allow(1, now.Add(500*time.Millisecond)) {
+		t.Error("Expected the large batch to be paid off first")
+	}
+
+	if rl := newRateLimiter(0); !rl.allow(1000, now) {
+		t.Error("Expected no limit without a rate")
+	}
+}
+
+func BenchmarkRateLimiter(b *testing.B) {
+	rl := newRateLimiter(1000)
+	now := time.Now()
+	for i := 0; i < b.N; i++ {
+		rl.allow(1, now.Add(time.Duration(i)*time.Millisecond))
+	}
+}
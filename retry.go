@@ -0,0 +1,72 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Reconnection time of browsers, which is the base of the adaptive retry without a DefaultRetry.
+const browserRetry = 3 * time.Second
+
+// AdaptiveRetry returns the reconnection time for the given number of consumers.
+// It grows by the DefaultRetry for each AdaptiveRetryStep consumers and is limited by the MaxRetry.
+func (s *Settings) adaptiveRetry(consumerCount int) time.Duration {
+	base := s.GetDefaultRetry()
+	if base <= 0 {
+		base = browserRetry
+	}
+
+	retry := base + base*time.Duration(consumerCount/s.GetAdaptiveRetryStep())
+	if maxRetry := s.GetMaxRetry(); retry > maxRetry {
+		return maxRetry
+	}
+	return retry
+}
+
+// Retry returns the reconnection time, which is advertised to consumers.
+// It's the latest adaptive retry, if an AdaptiveRetryInterval is set up, otherwise the DefaultRetry.
+func (es *eventSource) retry() time.Duration {
+	if retry := atomic.LoadInt64(&es.adaptedRetry); retry > 0 && es.currentSettings().GetAdaptiveRetryInterval() > 0 {
+		return time.Duration(retry)
+	}
+	return es.currentSettings().GetDefaultRetry()
+}
+
+// AdaptRetry adjusts the reconnection time to the current number of consumers and advertises it to the connected consumers,
+// so clients reconnect less aggressively while the service is under load.
+// It's advertised whenever it changes and periodically while it exceeds its base, as retry lines may be dropped by consumers which don't keep up.
+// In-process and WebSocket consumers don't reconnect via 'retry' fields, so they are skipped.
+func (es *eventSource) adaptRetry() {
+	settings := es.currentSettings()
+	retry := settings.adaptiveRetry(es.totalConsumers())
+	base := settings.adaptiveRetry(0)
+	previous := time.Duration(atomic.SwapInt64(&es.adaptedRetry, int64(retry)))
+	if previous == 0 {
+		previous = base
+	}
+	if retry == previous && retry == base {
+		return
+	}
+
+	if retry != previous {
+		es.infof("Advertising a reconnection time of %s to %d consumers\n", retry, es.totalConsumers())
+	}
+
+	em := &eventMessage{raw: []byte(fmt.Sprintf("retry: %d\n\n", retry.Milliseconds()))}
+	for _, channelConsumers := range es.consumers {
+		for _, cr := range channelConsumers {
+			if cr.expired.Load() || cr.local || cr.webSocket {
+				continue
+			}
+			select {
+			case cr.inbox <- em:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveRetry(t *testing.T) {
+	settings := &Settings{DefaultRetry: time.Second, AdaptiveRetryStep: 10, MaxRetry: 5 * time.Second}
+	for consumerCount, expected := range map[int]time.Duration{
+		0:    time.Second,
+		9:    time.Second,
+		10:   2 * time.Second,
+		25:   3 * time.Second,
+		1000: 5 * time.Second,
+	} {
+		if retry := settings.adaptiveRetry(consumerCount); retry != expected {
+			t.Errorf("Expected %s for %d consumers, got %s", expected, consumerCount, retry)
+		}
+	}
+
+	// Without a DefaultRetry, the reconnection time of browsers is the base
+	if retry := (&Settings{}).adaptiveRetry(0); retry != 3*time.Second {
+		t.Error("Expected 3 seconds, got", retry)
+	}
+}
+
+func TestAdaptRetry(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		DefaultRetry:          time.Second,
+		AdaptiveRetryInterval: 50 * time.Millisecond,
+		AdaptiveRetryStep:     1,
+	})
+	defer es.closeEventSource()
+
+	conn, resp := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "retry: 1000\n\n") && !strings.Contains(string(resp), "retry: 2000\n\n") {
+		t.Error("Expected the DefaultRetry to be advertised on connect, got", string(resp))
+	}
+
+	// Under load, a larger reconnection time is advertised to the connected consumers
+	conn2, _ := es.joinChannel(t, "default")
+	defer conn2.Close()
+
+	readUntil(t, conn, nil, "retry: 3000\n\n")
+
+	// New consumers get the adapted reconnection time right away
+	conn3, resp := es.joinChannel(t, "default")
+	defer conn3.Close()
+
+	if !strings.Contains(string(resp), "retry: 3000\n\n") && !strings.Contains(string(resp), "retry: 4000\n\n") {
+		t.Error("Expected the adapted reconnection time to be advertised on connect, got", string(resp))
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors of scheduled messages.
+var (
+	errInvalidDeliverAt = fmt.Errorf("%w: invalid deliver_at, expecting an RFC 3339 time or unix milliseconds", ErrParse)
+	errDeliverAtInBatch = fmt.Errorf("%w: deliver_at isn't supported for events of a batch", ErrParse)
+	errScheduleTooFar   = errors.New("deliver_at exceeds the MaxScheduleDelay")
+	errTooManyScheduled = errors.New("too many scheduled messages")
+)
+
+// DeliverAt stores the time a message is scheduled for. A zero time means that it's delivered immediately.
+type deliverAt struct {
+	time.Time
+}
+
+// UnmarshalJSON decodes a time given as RFC 3339 string, e.g. "2024-05-01T12:00:00Z", or as unix time in milliseconds.
+func (dt *deliverAt) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		dt.Time = time.Time{}
+		return nil
+	}
+
+	var milliseconds int64
+	if err := json.Unmarshal(data, &milliseconds); err == nil {
+		dt.Time = time.UnixMilli(milliseconds)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return errInvalidDeliverAt
+	}
+
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return errInvalidDeliverAt
+	}
+	dt.Time = t
+	return nil
+}
+
+// Deferred checks whether a message is scheduled for a later delivery. Batches are always delivered immediately.
+func (em *eventMessage) deferred() bool {
+	return em.batch == nil && time.Until(em.DeliverAt.Time) > 0
+}
+
+// CheckSchedule checks whether the delivery time of a message is within the MaxScheduleDelay.
+func (s *Settings) checkSchedule(em *eventMessage) error {
+	if em.deferred() && time.Until(em.DeliverAt.Time) > s.GetMaxScheduleDelay() {
+		return errScheduleTooFar
+	}
+	return nil
+}
+
+// Scheduled stores a message, which is held by the dispatcher until its delivery time.
+type scheduled struct {
+	message *eventMessage
+	timer   *time.Timer
+}
+
+// ScheduleMessage holds a message until its delivery time, when it's handed back to the dispatcher.
+// If MaxScheduledMessages are held already, the message is dropped.
+func (es *eventSource) scheduleMessage(em *eventMessage) {
+	if len(es.scheduled) >= es.currentSettings().GetMaxScheduledMessages() {
+		es.errorf("Message to channel '%s' dropped, %d messages are scheduled already\n", em.Channel, len(es.scheduled))
+		es.droppedCount++
+		return
+	}
+
+	es.debugf("Message to channel '%s' scheduled for %s\n", em.Channel, em.DeliverAt.Format(time.RFC3339))
+	s := &scheduled{message: em}
+	s.timer = time.AfterFunc(time.Until(em.DeliverAt.Time), func() {
+		select {
+		case es.scheduledRouter <- s:
+		case <-es.done:
+		}
+	})
+	es.scheduled[s] = true
+}
+
+// DeliverScheduled routes a scheduled message, unless it was discarded in the meantime.
+func (es *eventSource) deliverScheduled(s *scheduled) {
+	if !es.scheduled[s] {
+		return
+	}
+	delete(es.scheduled, s)
+	s.message.DeliverAt = deliverAt{}
+	es.routeMessage(s.message)
+}
+
+// DiscardScheduled discards the scheduled messages of a channel, or of all channels if the channel is empty.
+func (es *eventSource) discardScheduled(channel string) {
+	for s := range es.scheduled {
+		if len(channel) == 0 || s.message.Channel == channel {
+			s.timer.Stop()
+			delete(es.scheduled, s)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliverAtUnmarshal(t *testing.T) {
+	for data, expected := range map[string]time.Time{
+		`{"deliver_at":"2024-05-01T12:00:00Z"}`: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		`{"deliver_at":1714564800000}`:          time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		`{"deliver_at":null}`:                   {},
+		`{}`:                                    {},
+	} {
+		em, err := newEventMessage(strings.NewReader(data), "default")
+		if err != nil {
+			t.Errorf("Unable to decode %s. %s", data, err)
+			continue
+		}
+		if !em.DeliverAt.Equal(expected) {
+			t.Errorf("Expected %s for %s, got %s", expected, data, em.DeliverAt)
+		}
+	}
+
+	for _, data := range []string{`{"deliver_at":"tomorrow"}`, `{"deliver_at":true}`} {
+		if _, err := newEventMessage(strings.NewReader(data), "default"); !errors.Is(err, errInvalidDeliverAt) {
+			t.Errorf("Expected errInvalidDeliverAt for %s, got %v", data, err)
+		}
+	}
+}
+
+func TestScheduledDelivery(t *testing.T) {
+	es := setupEventSource(t, nil)
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+	defer conn.Close()
+
+	publish := func(channel, data string, deliverAt time.Time) {
+		body := fmt.Sprintf(`{"data":"%s","deliver_at":%d}`, data, deliverAt.UnixMilli())
+		resp, err := http.Post(es.testServer.URL+"/"+channel, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+	}
+
+	// Events scheduled for the past are delivered immediately
+	publish("default", "past", time.Now().Add(-time.Hour))
+	expectResponse(t, conn, "data: past\n\n")
+
+	// Events scheduled for the future are held until their delivery time
+	publish("default", "reminder", time.Now().Add(400*time.Millisecond))
+	expectNoResponse(t, conn)
+	readUntil(t, conn, nil, "data: reminder\n\n")
+
+	// Closing a channel discards its scheduled events
+	publish("other", "discarded", time.Now().Add(300*time.Millisecond))
+	if err := es.eventSource.Close("other"); err != nil {
+		t.Fatal("Unable to close channel", err)
+	}
+
+	events, unsubscribe := es.eventSource.Subscribe("other")
+	defer unsubscribe()
+
+	select {
+	case e := <-events:
+		t.Error("Expected scheduled events of closed channels to be discarded, got", e)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestScheduleLimits(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		MaxScheduledMessages: 1,
+		MaxScheduleDelay:     time.Hour,
+	})
+	defer es.closeEventSource()
+
+	publish := func(contentType, body string) int {
+		resp, err := http.Post(es.testServer.URL+"/default", contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	inMinutes := time.Now().Add(time.Minute).UnixMilli()
+	for _, test := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/json", fmt.Sprintf(`{"data":"too far","deliver_at":%d}`, time.Now().Add(2*time.Hour).UnixMilli()), http.StatusBadRequest},
+		{"application/x-ndjson", fmt.Sprintf(`{"data":"batch","deliver_at":%d}`, inMinutes), http.StatusBadRequest},
+		{"application/json", fmt.Sprintf(`{"data":"first","deliver_at":%d}`, inMinutes), http.StatusCreated},
+		{"application/json", fmt.Sprintf(`{"data":"second","deliver_at":%d}`, inMinutes), http.StatusTooManyRequests},
+		{"application/json", `{"data":"immediate"}`, http.StatusCreated},
+	} {
+		if status := publish(test.contentType, test.body); status != test.status {
+			t.Errorf("Expected status %d for %s, got %d", test.status, test.body, status)
+		}
+	}
+}
@@ -5,31 +5,185 @@
 package eventsource
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Default settings.
 const (
-	defaultTimeout         = 2 * time.Second
-	defaultAuthToken       = ""
-	defaultHost            = "127.0.0.1"
-	defaultPort            = 8080
-	defaultCorsAllowOrigin = "127.0.0.1"
-	defaultCorsAllowMethod = "GET"
+	defaultTimeout           = 2 * time.Second
+	defaultAuthToken         = ""
+	defaultHost              = "127.0.0.1"
+	defaultPort              = 8080
+	defaultCorsAllowOrigin   = "127.0.0.1"
+	defaultCorsAllowMethod   = "GET"
+	defaultCorsAllowHeaders  = "Content-Type, Auth-Token"
+	defaultMaxConsumers      = 0
+	defaultGlobalChannelName = "all"
+	defaultAuthFailureStatus = http.StatusForbidden
+	defaultPublishStatus     = http.StatusCreated
+	defaultTCPKeepAlive      = 15 * time.Second
+	defaultLogLevel          = LogDebug
+	defaultShutdownRetry     = 5 * time.Second
+	defaultLineEnding        = "\n"
+	defaultLongPollTimeout   = 30 * time.Second
+	defaultBackpressure      = 0.75
+	defaultGracePeriod       = 10 * time.Second
+	defaultMaxPaused         = 1000
+	defaultRetryConsumers    = 1000
+	defaultMaxRetry          = time.Minute
+	defaultErrorFormat       = ErrorFormatText
+	defaultTrustedProxies    = 1
+	defaultMaxScheduled      = 10000
+	defaultMaxScheduleDelay  = 24 * time.Hour
+)
+
+// ErrorFormat sets the format of error responses, e.g. for unknown routes and failed authentications.
+type ErrorFormat string
+
+// Available error formats. Plain text errors are sent as they are, JSON errors as {"error": "..."}.
+const (
+	ErrorFormatText ErrorFormat = "text"
+	ErrorFormatJSON ErrorFormat = "json"
 )
 
 // Settings stores all essential settings.
 type Settings struct {
-	Timeout         time.Duration
-	AuthToken       string
-	Host            string
-	Port            uint
-	CorsAllowOrigin string
-	CorsAllowMethod []string
+	// Deprecated: Timeout is an alias of WriteTimeout, which takes precedence if both are set.
+	Timeout                       time.Duration
+	WriteTimeout                  time.Duration
+	AuthToken                     string
+	Host                          string
+	Port                          uint
+	CorsAllowOrigin               string
+	CorsAllowOrigins              []string
+	CorsAllowCredentials          bool
+	CorsAllowMethod               []string
+	CorsAllowHeaders              []string
+	MaxConsumersTotal             int
+	OnConnectMessage              func(channel string) *Event
+	GlobalChannelName             string
+	DisableGlobalChannel          bool
+	OnError                       func(channel, remoteAddr string, err error)
+	FlushInterval                 time.Duration
+	OmitAccelBuffering            bool
+	BasePath                      string
+	IdleTimeout                   time.Duration
+	EnableCompression             bool
+	MessageInterceptor            func(channel string, e *Event) (*Event, bool)
+	ReplayWindow                  time.Duration
+	ReplayMode                    ReplayMode
+	ReplayKey                     func(e *Event) string
+	MaxReplayMemoryBytes          int
+	ErrorFormat                   ErrorFormat
+	AutoAssignIDs                 bool
+	PreregisteredChannels         []string
+	SigningKey                    string
+	UnixSocket                    string
+	RejectUnknownChannels         bool
+	MaxConnectionsPerIP           int
+	AuthFailureStatus             int
+	AuthFailureMessage            string
+	ChannelCloseMessage           func(channel string) *Event
+	ForwardURL                    string
+	ForwardURLs                   map[string]string
+	CloseEmptyChannels            bool
+	PublishSuccessStatus          int
+	TCPKeepAlive                  time.Duration
+	DefaultRetry                  time.Duration
+	MaxDataBytes                  int
+	Middleware                    []func(http.Handler) http.Handler
+	Tracer                        Tracer
+	StrictAccept                  bool
+	LogLevel                      LogLevel
+	TrustProxyHeaders             bool
+	TrustedProxyCount             int
+	DedupWindow                   time.Duration
+	AccessLog                     io.Writer
+	FieldMapping                  map[string]string
+	ShutdownRetryAfter            time.Duration
+	NamespaceSeparator            string
+	NamespaceAuthTokens           map[string]string
+	LineEnding                    string
+	MaxConnectionLifetime         time.Duration
+	EnableLongPoll                bool
+	EnableWebSocket               bool
+	LongPollTimeout               time.Duration
+	DisallowUnknownFields         bool
+	BackpressureThreshold         float64
+	AllowedChannels               []string
+	InjectTimestamp               bool
+	MirrorSources                 []MirrorConfig
+	ChannelDefaultEvent           map[string]string
+	HandleSignals                 bool
+	ShutdownGracePeriod           time.Duration
+	MaxPausedMessages             int
+	AdaptiveRetryInterval         time.Duration
+	AdaptiveRetryStep             int
+	MaxRetry                      time.Duration
+	MaxScheduledMessages          int
+	MaxScheduleDelay              time.Duration
+	MaxEventsPerSecondPerConsumer int
+}
+
+// SettingsFromEnv builds and returns Settings based on environment variables.
+// Unset variables fall back to the default settings, malformed values cause an error.
+//
+//	EVENTSOURCE_HOST          Host, e.g. "0.0.0.0"
+//	EVENTSOURCE_PORT          Port, e.g. "8080"
+//	EVENTSOURCE_AUTH_TOKEN    AuthToken
+//	EVENTSOURCE_TIMEOUT       Timeout as duration, e.g. "30s", or in seconds, e.g. "30"
+//	EVENTSOURCE_CORS_ORIGIN   CorsAllowOrigin
+//	EVENTSOURCE_CORS_METHODS  CorsAllowMethod as comma separated list, e.g. "GET, POST"
+func SettingsFromEnv() (*Settings, error) {
+	settings := &Settings{
+		Host:            strings.TrimSpace(os.Getenv("EVENTSOURCE_HOST")),
+		AuthToken:       os.Getenv("EVENTSOURCE_AUTH_TOKEN"),
+		CorsAllowOrigin: strings.TrimSpace(os.Getenv("EVENTSOURCE_CORS_ORIGIN")),
+	}
+
+	if port := strings.TrimSpace(os.Getenv("EVENTSOURCE_PORT")); len(port) > 0 {
+		value, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || value == 0 {
+			return nil, fmt.Errorf("eventsource: invalid EVENTSOURCE_PORT '%s'", port)
+		}
+		settings.Port = uint(value)
+	}
+
+	if timeout := strings.TrimSpace(os.Getenv("EVENTSOURCE_TIMEOUT")); len(timeout) > 0 {
+		value, err := time.ParseDuration(timeout)
+		if err != nil {
+			seconds, secondsErr := strconv.ParseUint(timeout, 10, 32)
+			if secondsErr != nil {
+				return nil, fmt.Errorf("eventsource: invalid EVENTSOURCE_TIMEOUT '%s'", timeout)
+			}
+			value = time.Duration(seconds) * time.Second
+		}
+		if value <= 0 {
+			return nil, fmt.Errorf("eventsource: invalid EVENTSOURCE_TIMEOUT '%s'", timeout)
+		}
+		settings.Timeout = value
+	}
+
+	if methods := os.Getenv("EVENTSOURCE_CORS_METHODS"); len(strings.TrimSpace(methods)) > 0 {
+		for _, method := range strings.Split(methods, ",") {
+			if method = strings.ToUpper(strings.TrimSpace(method)); len(method) > 0 {
+				settings.CorsAllowMethod = append(settings.CorsAllowMethod, method)
+			}
+		}
+	}
+
+	return settings, nil
 }
 
 // GetTimeout returns the timeout for consumers.
+//
+// Deprecated: Use GetWriteTimeout, which respects both, WriteTimeout and Timeout.
 func (s *Settings) GetTimeout() time.Duration {
 	if s == nil || s.Timeout <= 0*time.Second {
 		return defaultTimeout
@@ -37,6 +191,15 @@ func (s *Settings) GetTimeout() time.Duration {
 	return s.Timeout
 }
 
+// GetWriteTimeout returns the deadline of a single write to a consumer. Consumers whose write exceeds it are disconnected.
+// If no WriteTimeout is set, the deprecated Timeout is used, which defaults to 2 seconds.
+func (s *Settings) GetWriteTimeout() time.Duration {
+	if s == nil || s.WriteTimeout <= 0 {
+		return s.GetTimeout()
+	}
+	return s.WriteTimeout
+}
+
 // GetAuthToken returns the authenticatoin token.
 func (s *Settings) GetAuthToken() string {
 	if s == nil || len(s.AuthToken) <= 0 {
@@ -69,6 +232,58 @@ func (s *Settings) GetCorsAllowOrigin() string {
 	return s.CorsAllowOrigin
 }
 
+// GetCorsAllowOrigins returns the list of allowed origins.
+func (s *Settings) GetCorsAllowOrigins() []string {
+	if s == nil {
+		return nil
+	}
+	return s.CorsAllowOrigins
+}
+
+// CorsOrigin returns the Access-Control-Allow-Origin for a request of the given origin.
+// If a list of allowed origins is set up, the origin is echoed back when it's in the list,
+// otherwise an empty string is returned and the header should be omitted.
+// Without a list, the single CorsAllowOrigin is used.
+func (s *Settings) corsOrigin(origin string) string {
+	allowedOrigins := s.GetCorsAllowOrigins()
+	if len(allowedOrigins) == 0 {
+		return s.GetCorsAllowOrigin()
+	}
+
+	for _, allowedOrigin := range allowedOrigins {
+		if allowedOrigin == "*" {
+			return "*"
+		}
+		if len(origin) > 0 && allowedOrigin == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// CorsAllowCredentials checks whether Access-Control-Allow-Credentials should be sent for the given allowed origin.
+// Browsers refuse credentials in combination with the wildcard origin, so credentials are never allowed for '*'.
+func (s *Settings) corsAllowCredentials(allowOrigin string) bool {
+	return s != nil && s.CorsAllowCredentials && allowOrigin != "*"
+}
+
+// SetCorsOriginHeaders sets the Access-Control-Allow-Origin and Access-Control-Allow-Credentials headers for a request of the given origin.
+// If the allowed origin depends on the request, 'Vary: Origin' is added, so caches don't serve responses to the wrong origin.
+func (s *Settings) setCorsOriginHeaders(header http.Header, origin string) {
+	allowOrigin := s.corsOrigin(origin)
+	if len(allowOrigin) > 0 {
+		header.Set("Access-Control-Allow-Origin", allowOrigin)
+	}
+
+	if len(s.GetCorsAllowOrigins()) > 0 {
+		header.Add("Vary", "Origin")
+	}
+
+	if s.corsAllowCredentials(allowOrigin) {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
 // GetCorsAllowMethod returns the Access-Control-Allow-Method.
 func (s *Settings) GetCorsAllowMethod() string {
 	if s == nil || len(s.CorsAllowMethod) == 0 {
@@ -76,3 +291,353 @@ func (s *Settings) GetCorsAllowMethod() string {
 	}
 	return strings.Join(s.CorsAllowMethod, ", ")
 }
+
+// GetCorsAllowHeaders returns the Access-Control-Allow-Headers.
+func (s *Settings) GetCorsAllowHeaders() string {
+	if s == nil || len(s.CorsAllowHeaders) == 0 {
+		return defaultCorsAllowHeaders
+	}
+	return strings.Join(s.CorsAllowHeaders, ", ")
+}
+
+// GetMaxConsumersTotal returns the maximum amount of consumers across all channels.
+// A value of 0 means that the amount of consumers is unlimited.
+func (s *Settings) GetMaxConsumersTotal() int {
+	if s == nil || s.MaxConsumersTotal <= 0 {
+		return defaultMaxConsumers
+	}
+	return s.MaxConsumersTotal
+}
+
+// GetGlobalChannelName returns the name of the reserved channel used for global notifications.
+// Names which don't match the channel route pattern are replaced by the default name.
+func (s *Settings) GetGlobalChannelName() string {
+	if s == nil || !validChannelName(s.GlobalChannelName) {
+		return defaultGlobalChannelName
+	}
+	return s.GlobalChannelName
+}
+
+// GetFlushInterval returns the interval in which coalesced messages are written to consumers.
+// A value of 0 means that messages are written immediately.
+func (s *Settings) GetFlushInterval() time.Duration {
+	if s == nil || s.FlushInterval <= 0 {
+		return 0
+	}
+	return s.FlushInterval
+}
+
+// GetBasePath returns the path below which all routes are registered.
+// Paths which don't start with a slash or end with a slash are ignored.
+func (s *Settings) GetBasePath() string {
+	if s == nil || !validBasePath(s.BasePath) {
+		return ""
+	}
+	return s.BasePath
+}
+
+// GetIdleTimeout returns the duration after which consumers without successful writes are removed.
+// A value of 0 means that idle consumers are never removed.
+func (s *Settings) GetIdleTimeout() time.Duration {
+	if s == nil || s.IdleTimeout <= 0 {
+		return 0
+	}
+	return s.IdleTimeout
+}
+
+// GetMaxConnectionLifetime returns the duration after which consumers are disconnected to make them reconnect.
+// A value of 0 means that connections are kept open as long as possible.
+func (s *Settings) GetMaxConnectionLifetime() time.Duration {
+	if s == nil || s.MaxConnectionLifetime <= 0 {
+		return 0
+	}
+	return s.MaxConnectionLifetime
+}
+
+// GetReplayMode returns which messages are kept for replaying them to reconnecting consumers.
+// Invalid replay modes fall back to ReplayHistory.
+func (s *Settings) GetReplayMode() ReplayMode {
+	if s == nil || s.ReplayMode != ReplayLastValue {
+		return ReplayHistory
+	}
+	return s.ReplayMode
+}
+
+// ReplayKey returns the key of a message in the ReplayLastValue mode.
+// Without a ReplayKey callback, messages are keyed by their event name.
+func (s *Settings) replayKey(em *eventMessage) string {
+	if s != nil && s.ReplayKey != nil {
+		return s.ReplayKey(em.event())
+	}
+	return eventType(em.Event)
+}
+
+// GetMaxReplayMemoryBytes returns the maximum size of the messages kept for replaying across all channels.
+// A value of 0 means that the size is only limited by the replay window.
+func (s *Settings) GetMaxReplayMemoryBytes() int {
+	if s == nil || s.MaxReplayMemoryBytes <= 0 {
+		return 0
+	}
+	return s.MaxReplayMemoryBytes
+}
+
+// GetReplayWindow returns the duration for which messages are kept for replaying them to reconnecting consumers.
+// A value of 0 means that no messages are kept.
+func (s *Settings) GetReplayWindow() time.Duration {
+	if s == nil || s.ReplayWindow <= 0 {
+		return 0
+	}
+	return s.ReplayWindow
+}
+
+// GetMaxConnectionsPerIP returns the maximum amount of consumers connected from a single IP address.
+// A value of 0 means that the amount of consumers per IP address is unlimited.
+func (s *Settings) GetMaxConnectionsPerIP() int {
+	if s == nil || s.MaxConnectionsPerIP <= 0 {
+		return 0
+	}
+	return s.MaxConnectionsPerIP
+}
+
+// GetAuthFailureStatus returns the status code sent when the authentication fails.
+// Only 401 Unauthorized and 403 Forbidden are supported, any other status falls back to 403.
+func (s *Settings) GetAuthFailureStatus() int {
+	if s == nil || (s.AuthFailureStatus != http.StatusUnauthorized && s.AuthFailureStatus != http.StatusForbidden) {
+		return defaultAuthFailureStatus
+	}
+	return s.AuthFailureStatus
+}
+
+// GetForwardURL returns the URL, which published events of a channel are forwarded to.
+// A URL of the channel in ForwardURLs takes precedence over ForwardURL. An empty URL disables the forwarding.
+func (s *Settings) GetForwardURL(channel string) string {
+	if s == nil {
+		return ""
+	}
+	if url, ok := s.ForwardURLs[channel]; ok {
+		return url
+	}
+	return s.ForwardURL
+}
+
+// GetPublishSuccessStatus returns the status code of successful publish requests.
+// Only 2xx status codes are supported, any other status falls back to 201 Created.
+func (s *Settings) GetPublishSuccessStatus() int {
+	if s == nil || s.PublishSuccessStatus < 200 || s.PublishSuccessStatus > 299 {
+		return defaultPublishStatus
+	}
+	return s.PublishSuccessStatus
+}
+
+// GetTCPKeepAlive returns the keep-alive period of TCP connections, which detects vanished consumers.
+// A negative value disables TCP keep-alives.
+func (s *Settings) GetTCPKeepAlive() time.Duration {
+	if s == nil || s.TCPKeepAlive == 0 {
+		return defaultTCPKeepAlive
+	}
+	return s.TCPKeepAlive
+}
+
+// GetDefaultRetry returns the reconnection time, which is advertised to consumers right after connecting.
+// A value of 0 means that no reconnection time is advertised and clients use their own default.
+func (s *Settings) GetDefaultRetry() time.Duration {
+	if s == nil || s.DefaultRetry <= 0 {
+		return 0
+	}
+	return s.DefaultRetry
+}
+
+// GetMaxDataBytes returns the maximum size of the data of a single message in bytes.
+// A value of 0 means that the size is unlimited.
+func (s *Settings) GetMaxDataBytes() int {
+	if s == nil || s.MaxDataBytes <= 0 {
+		return 0
+	}
+	return s.MaxDataBytes
+}
+
+// GetLogLevel returns the verbosity of the log output.
+// By default, everything is logged, including the joins and expiries of single consumers.
+func (s *Settings) GetLogLevel() LogLevel {
+	if s == nil || s.LogLevel < LogSilent || s.LogLevel > LogDebug {
+		return defaultLogLevel
+	}
+	return s.LogLevel
+}
+
+// GetDedupWindow returns the time span, in which re-published events with the same ID are dropped.
+// A value of 0 means that duplicates aren't detected.
+func (s *Settings) GetDedupWindow() time.Duration {
+	if s == nil || s.DedupWindow <= 0 {
+		return 0
+	}
+	return s.DedupWindow
+}
+
+// GetShutdownRetryAfter returns the time after which clients should retry requests, which were declined
+// because the service has been stopped. It's sent as Retry-After header in whole seconds.
+func (s *Settings) GetShutdownRetryAfter() time.Duration {
+	if s == nil || s.ShutdownRetryAfter <= 0 {
+		return defaultShutdownRetry
+	}
+	return s.ShutdownRetryAfter
+}
+
+// GetNamespaceSeparator returns the separator between the namespace and the name of a channel, e.g. '_' for 'tenant1_orders'.
+// Only '-' and '_' are valid separators, otherwise channels have no namespace. A '/' is refused, as channel names are a single
+// path segment: 'tenant1/stats' and 'tenant1/poll' already address the stats and the long polling of channel 'tenant1',
+// so a channel 'tenant1/stats' couldn't be told apart. Namespaces like 'tenant1/orders' are written as 'tenant1_orders'.
+func (s *Settings) GetNamespaceSeparator() string {
+	if s == nil || (s.NamespaceSeparator != "-" && s.NamespaceSeparator != "_") {
+		return ""
+	}
+	return s.NamespaceSeparator
+}
+
+// Namespace returns the namespace of a channel, which is the part before the first separator.
+// Channels without separator have no namespace.
+func (s *Settings) namespace(channel string) string {
+	separator := s.GetNamespaceSeparator()
+	if len(separator) == 0 {
+		return ""
+	}
+	namespace, _, found := strings.Cut(channel, separator)
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
+// GetNamespaceAuthToken returns the authentication token of the namespace of a channel.
+// An empty token means that the channel is protected by the AuthToken only.
+func (s *Settings) GetNamespaceAuthToken(channel string) string {
+	namespace := s.namespace(channel)
+	if len(namespace) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(s.NamespaceAuthTokens[namespace])
+}
+
+// GetLineEnding returns the line ending, which frames the events sent to consumers.
+// Event streams allow '\n', '\r\n' and '\r', any other value falls back to '\n'.
+func (s *Settings) GetLineEnding() string {
+	if s == nil || (s.LineEnding != "\r\n" && s.LineEnding != "\r") {
+		return defaultLineEnding
+	}
+	return s.LineEnding
+}
+
+// GetLongPollTimeout returns the duration for which long polling requests wait for a message.
+func (s *Settings) GetLongPollTimeout() time.Duration {
+	if s == nil || s.LongPollTimeout <= 0 {
+		return defaultLongPollTimeout
+	}
+	return s.LongPollTimeout
+}
+
+// JSONDecoding returns how strictly published JSON is decoded.
+func (s *Settings) jsonDecoding() jsonDecoding {
+	if s == nil {
+		return jsonDecoding{}
+	}
+	return jsonDecoding{disallowUnknownFields: s.DisallowUnknownFields}
+}
+
+// GetBackpressureThreshold returns the share of a consumer's inbox, which needs to be filled to count the consumer as lagging.
+// Values outside of (0, 1] fall back to the default.
+func (s *Settings) GetBackpressureThreshold() float64 {
+	if s == nil || s.BackpressureThreshold <= 0 || s.BackpressureThreshold > 1 {
+		return defaultBackpressure
+	}
+	return s.BackpressureThreshold
+}
+
+// GetMaxEventsPerSecondPerConsumer returns the maximum number of events per second sent to each consumer connected via HTTP.
+// A value of 0 means that events are sent as fast as possible.
+func (s *Settings) GetMaxEventsPerSecondPerConsumer() int {
+	if s == nil || s.MaxEventsPerSecondPerConsumer <= 0 {
+		return 0
+	}
+	return s.MaxEventsPerSecondPerConsumer
+}
+
+// GetChannelDefaultEvent returns the event name of messages published to a channel without an event name.
+func (s *Settings) GetChannelDefaultEvent(channel string) string {
+	if s == nil {
+		return ""
+	}
+	return s.ChannelDefaultEvent[channel]
+}
+
+// GetShutdownGracePeriod returns the duration, which consumers get to disconnect when the service is shut down on a signal.
+func (s *Settings) GetShutdownGracePeriod() time.Duration {
+	if s == nil || s.ShutdownGracePeriod <= 0 {
+		return defaultGracePeriod
+	}
+	return s.ShutdownGracePeriod
+}
+
+// GetTrustedProxyCount returns the number of trusted proxies in front of the service, whose entries of X-Forwarded-For are skipped.
+func (s *Settings) GetTrustedProxyCount() int {
+	if s == nil || s.TrustedProxyCount <= 0 {
+		return defaultTrustedProxies
+	}
+	return s.TrustedProxyCount
+}
+
+// GetMaxPausedMessages returns the maximum number of messages, which are held per paused channel.
+func (s *Settings) GetMaxPausedMessages() int {
+	if s == nil || s.MaxPausedMessages <= 0 {
+		return defaultMaxPaused
+	}
+	return s.MaxPausedMessages
+}
+
+// GetAdaptiveRetryInterval returns the interval in which the advertised reconnection time is adjusted to the load.
+// A value of 0 means that the DefaultRetry is advertised unchanged.
+func (s *Settings) GetAdaptiveRetryInterval() time.Duration {
+	if s == nil || s.AdaptiveRetryInterval <= 0 {
+		return 0
+	}
+	return s.AdaptiveRetryInterval
+}
+
+// GetAdaptiveRetryStep returns the number of consumers, for which the adaptive retry grows by the DefaultRetry.
+func (s *Settings) GetAdaptiveRetryStep() int {
+	if s == nil || s.AdaptiveRetryStep <= 0 {
+		return defaultRetryConsumers
+	}
+	return s.AdaptiveRetryStep
+}
+
+// GetMaxRetry returns the upper limit of the adaptive retry.
+func (s *Settings) GetMaxRetry() time.Duration {
+	if s == nil || s.MaxRetry <= 0 {
+		return defaultMaxRetry
+	}
+	return s.MaxRetry
+}
+
+// GetMaxScheduledMessages returns the maximum number of messages, which are held for a later delivery across all channels.
+func (s *Settings) GetMaxScheduledMessages() int {
+	if s == nil || s.MaxScheduledMessages <= 0 {
+		return defaultMaxScheduled
+	}
+	return s.MaxScheduledMessages
+}
+
+// GetMaxScheduleDelay returns how far ahead messages may be scheduled.
+func (s *Settings) GetMaxScheduleDelay() time.Duration {
+	if s == nil || s.MaxScheduleDelay <= 0 {
+		return defaultMaxScheduleDelay
+	}
+	return s.MaxScheduleDelay
+}
+
+// GetErrorFormat returns the format of error responses. Invalid formats fall back to plain text.
+func (s *Settings) GetErrorFormat() ErrorFormat {
+	if s == nil || s.ErrorFormat != ErrorFormatJSON {
+		return defaultErrorFormat
+	}
+	return s.ErrorFormat
+}
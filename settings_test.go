@@ -5,6 +5,7 @@
 package eventsource
 
 import (
+	"net/http"
 	"testing"
 	"time"
 )
@@ -16,6 +17,10 @@ func TestDefaultSettings(t *testing.T) {
 		t.Error("Expected 2 seconds, got", timeout)
 	}
 
+	if writeTimeout := ds.GetWriteTimeout(); writeTimeout != 2*time.Second {
+		t.Error("Expected 2 seconds, got", writeTimeout)
+	}
+
 	if authToken := ds.GetAuthToken(); authToken != "" {
 		t.Error("Expected empty AuthToken, got ", authToken)
 	}
@@ -35,16 +40,136 @@ func TestDefaultSettings(t *testing.T) {
 	if corsAllowMethod := ds.GetCorsAllowMethod(); corsAllowMethod != "GET" {
 		t.Error("Expected GET, got", corsAllowMethod)
 	}
+
+	if corsAllowHeaders := ds.GetCorsAllowHeaders(); corsAllowHeaders != "Content-Type, Auth-Token" {
+		t.Error("Expected 'Content-Type, Auth-Token', got", corsAllowHeaders)
+	}
+
+	if maxConsumersTotal := ds.GetMaxConsumersTotal(); maxConsumersTotal != 0 {
+		t.Error("Expected 0, got", maxConsumersTotal)
+	}
+
+	if globalChannelName := ds.GetGlobalChannelName(); globalChannelName != "all" {
+		t.Error("Expected 'all', got", globalChannelName)
+	}
+
+	if flushInterval := ds.GetFlushInterval(); flushInterval != 0 {
+		t.Error("Expected 0, got", flushInterval)
+	}
+
+	if basePath := ds.GetBasePath(); basePath != "" {
+		t.Error("Expected empty base path, got", basePath)
+	}
+
+	if idleTimeout := ds.GetIdleTimeout(); idleTimeout != 0 {
+		t.Error("Expected 0, got", idleTimeout)
+	}
+
+	if replayWindow := ds.GetReplayWindow(); replayWindow != 0 {
+		t.Error("Expected 0, got", replayWindow)
+	}
+
+	if maxConnections := ds.GetMaxConnectionsPerIP(); maxConnections != 0 {
+		t.Error("Expected 0, got", maxConnections)
+	}
+
+	if authFailureStatus := ds.GetAuthFailureStatus(); authFailureStatus != http.StatusForbidden {
+		t.Error("Expected 403, got", authFailureStatus)
+	}
+
+	if publishStatus := ds.GetPublishSuccessStatus(); publishStatus != http.StatusCreated {
+		t.Error("Expected 201, got", publishStatus)
+	}
+
+	if tcpKeepAlive := ds.GetTCPKeepAlive(); tcpKeepAlive != 15*time.Second {
+		t.Error("Expected 15 seconds, got", tcpKeepAlive)
+	}
+
+	if defaultRetry := ds.GetDefaultRetry(); defaultRetry != 0 {
+		t.Error("Expected 0, got", defaultRetry)
+	}
+
+	if logLevel := ds.GetLogLevel(); logLevel != LogDebug {
+		t.Error("Expected LogDebug, got", logLevel)
+	}
+
+	if shutdownRetryAfter := ds.GetShutdownRetryAfter(); shutdownRetryAfter != 5*time.Second {
+		t.Error("Expected 5 seconds, got", shutdownRetryAfter)
+	}
+
+	if maxConnectionLifetime := ds.GetMaxConnectionLifetime(); maxConnectionLifetime != 0 {
+		t.Error("Expected 0, got", maxConnectionLifetime)
+	}
+
+	if longPollTimeout := ds.GetLongPollTimeout(); longPollTimeout != 30*time.Second {
+		t.Error("Expected 30 seconds, got", longPollTimeout)
+	}
+
+	if backpressureThreshold := ds.GetBackpressureThreshold(); backpressureThreshold != 0.75 {
+		t.Error("Expected 0.75, got", backpressureThreshold)
+	}
+
+	if maxEventsPerSecond := ds.GetMaxEventsPerSecondPerConsumer(); maxEventsPerSecond != 0 {
+		t.Error("Expected 0, got", maxEventsPerSecond)
+	}
+
+	if shutdownGracePeriod := ds.GetShutdownGracePeriod(); shutdownGracePeriod != 10*time.Second {
+		t.Error("Expected 10 seconds, got", shutdownGracePeriod)
+	}
+
+	if replayMode := ds.GetReplayMode(); replayMode != ReplayHistory {
+		t.Error("Expected ReplayHistory, got", replayMode)
+	}
+
+	if adaptiveRetryInterval := ds.GetAdaptiveRetryInterval(); adaptiveRetryInterval != 0 {
+		t.Error("Expected 0, got", adaptiveRetryInterval)
+	}
+
+	if maxRetry := ds.GetMaxRetry(); maxRetry != time.Minute {
+		t.Error("Expected 1 minute, got", maxRetry)
+	}
+
+	if maxScheduledMessages := ds.GetMaxScheduledMessages(); maxScheduledMessages != 10000 {
+		t.Error("Expected 10000, got", maxScheduledMessages)
+	}
+
+	if maxScheduleDelay := ds.GetMaxScheduleDelay(); maxScheduleDelay != 24*time.Hour {
+		t.Error("Expected 24 hours, got", maxScheduleDelay)
+	}
+
+	if trustedProxyCount := ds.GetTrustedProxyCount(); trustedProxyCount != 1 {
+		t.Error("Expected 1, got", trustedProxyCount)
+	}
+
+	if errorFormat := ds.GetErrorFormat(); errorFormat != ErrorFormatText {
+		t.Error("Expected ErrorFormatText, got", errorFormat)
+	}
+
+	if lineEnding := ds.GetLineEnding(); lineEnding != "\n" {
+		t.Errorf("Expected LF, got %q", lineEnding)
+	}
 }
 
 func TestCustomSettings(t *testing.T) {
 	cs := &Settings{
-		Timeout:         3 * time.Second,
-		AuthToken:       "TOKEN",
-		Host:            "192.168.1.1",
-		Port:            3000,
-		CorsAllowOrigin: "*",
-		CorsAllowMethod: []string{"GET", "POST", "DELETE"},
+		Timeout:              3 * time.Second,
+		AuthToken:            "TOKEN",
+		Host:                 "192.168.1.1",
+		Port:                 3000,
+		CorsAllowOrigin:      "*",
+		CorsAllowMethod:      []string{"GET", "POST", "DELETE"},
+		CorsAllowHeaders:     []string{"Content-Type", "Auth-Token", "X-Requested-With"},
+		MaxConsumersTotal:    100,
+		GlobalChannelName:    "everyone",
+		FlushInterval:        100 * time.Millisecond,
+		BasePath:             "/events",
+		IdleTimeout:          time.Minute,
+		ReplayWindow:         30 * time.Second,
+		MaxConnectionsPerIP:  5,
+		AuthFailureStatus:    http.StatusUnauthorized,
+		PublishSuccessStatus: http.StatusAccepted,
+		TCPKeepAlive:         time.Minute,
+		LogLevel:             LogError,
 	}
 
 	if timeout := cs.GetTimeout(); timeout != 3*time.Second {
@@ -70,4 +195,279 @@ func TestCustomSettings(t *testing.T) {
 	if corsAllowMethod := cs.GetCorsAllowMethod(); corsAllowMethod != "GET, POST, DELETE" {
 		t.Error("Expected 'GET, POST, DELETE', got", corsAllowMethod)
 	}
+
+	if corsAllowHeaders := cs.GetCorsAllowHeaders(); corsAllowHeaders != "Content-Type, Auth-Token, X-Requested-With" {
+		t.Error("Expected 'Content-Type, Auth-Token, X-Requested-With', got", corsAllowHeaders)
+	}
+
+	if maxConsumersTotal := cs.GetMaxConsumersTotal(); maxConsumersTotal != 100 {
+		t.Error("Expected 100, got", maxConsumersTotal)
+	}
+
+	if globalChannelName := cs.GetGlobalChannelName(); globalChannelName != "everyone" {
+		t.Error("Expected 'everyone', got", globalChannelName)
+	}
+
+	if flushInterval := cs.GetFlushInterval(); flushInterval != 100*time.Millisecond {
+		t.Error("Expected 100 milliseconds, got", flushInterval)
+	}
+
+	if basePath := cs.GetBasePath(); basePath != "/events" {
+		t.Error("Expected '/events', got", basePath)
+	}
+
+	if idleTimeout := cs.GetIdleTimeout(); idleTimeout != time.Minute {
+		t.Error("Expected 1 minute, got", idleTimeout)
+	}
+
+	if replayWindow := cs.GetReplayWindow(); replayWindow != 30*time.Second {
+		t.Error("Expected 30 seconds, got", replayWindow)
+	}
+
+	if maxConnections := cs.GetMaxConnectionsPerIP(); maxConnections != 5 {
+		t.Error("Expected 5, got", maxConnections)
+	}
+
+	if authFailureStatus := cs.GetAuthFailureStatus(); authFailureStatus != http.StatusUnauthorized {
+		t.Error("Expected 401, got", authFailureStatus)
+	}
+
+	if publishStatus := cs.GetPublishSuccessStatus(); publishStatus != http.StatusAccepted {
+		t.Error("Expected 202, got", publishStatus)
+	}
+
+	if tcpKeepAlive := cs.GetTCPKeepAlive(); tcpKeepAlive != time.Minute {
+		t.Error("Expected 1 minute, got", tcpKeepAlive)
+	}
+
+	if logLevel := cs.GetLogLevel(); logLevel != LogError {
+		t.Error("Expected LogError, got", logLevel)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// The deprecated Timeout is used as write timeout
+	s := &Settings{Timeout: 3 * time.Second}
+	if writeTimeout := s.GetWriteTimeout(); writeTimeout != 3*time.Second {
+		t.Error("Expected 3 seconds, got", writeTimeout)
+	}
+
+	// WriteTimeout takes precedence over Timeout
+	s.WriteTimeout = 500 * time.Millisecond
+	if writeTimeout := s.GetWriteTimeout(); writeTimeout != 500*time.Millisecond {
+		t.Error("Expected 500 milliseconds, got", writeTimeout)
+	}
+
+	s = &Settings{WriteTimeout: time.Second}
+	if writeTimeout := s.GetWriteTimeout(); writeTimeout != time.Second {
+		t.Error("Expected 1 second, got", writeTimeout)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	s := &Settings{NamespaceSeparator: "_"}
+	for channel, expected := range map[string]string{
+		"tenant1_orders":    "tenant1",
+		"tenant1_orders_eu": "tenant1",
+		"tenant1":           "",
+		"tenant1-orders":    "",
+		"_orders":           "",
+	} {
+		if namespace := s.namespace(channel); namespace != expected {
+			t.Errorf("Expected namespace '%s' of '%s', got '%s'", expected, channel, namespace)
+		}
+	}
+
+	// Slashes aren't valid in channel names, so they can't separate namespaces
+	s = &Settings{NamespaceSeparator: "/"}
+	if separator := s.GetNamespaceSeparator(); separator != "" {
+		t.Error("Expected an invalid separator to disable namespaces, got", separator)
+	}
+}
+
+func TestInvalidGlobalChannelName(t *testing.T) {
+	s := &Settings{GlobalChannelName: "Not Valid"}
+
+	if globalChannelName := s.GetGlobalChannelName(); globalChannelName != "all" {
+		t.Error("Expected 'all' for an invalid name, got", globalChannelName)
+	}
+}
+
+func TestInvalidAuthFailureStatus(t *testing.T) {
+	s := &Settings{AuthFailureStatus: http.StatusNotFound}
+
+	if authFailureStatus := s.GetAuthFailureStatus(); authFailureStatus != http.StatusForbidden {
+		t.Error("Expected 403 for an unsupported status, got", authFailureStatus)
+	}
+}
+
+func TestInvalidBasePath(t *testing.T) {
+	for _, basePath := range []string{"events", "/events/", "/"} {
+		s := &Settings{BasePath: basePath}
+		if validBasePath := s.GetBasePath(); validBasePath != "" {
+			t.Errorf("Expected empty base path for '%s', got '%s'", basePath, validBasePath)
+		}
+	}
+}
+
+func TestCorsOrigin(t *testing.T) {
+	// Single origin is used regardless of the request origin
+	s := &Settings{CorsAllowOrigin: "http://example.com"}
+	if origin := s.corsOrigin("http://example.org"); origin != "http://example.com" {
+		t.Error("Expected 'http://example.com', got", origin)
+	}
+
+	// Origins in the list are echoed back
+	s = &Settings{CorsAllowOrigins: []string{"http://example.com", "http://example.org"}}
+	if origin := s.corsOrigin("http://example.org"); origin != "http://example.org" {
+		t.Error("Expected 'http://example.org', got", origin)
+	}
+
+	// Origins not in the list are omitted
+	if origin := s.corsOrigin("http://example.net"); origin != "" {
+		t.Error("Expected empty origin, got", origin)
+	}
+
+	// Wildcard allows every origin
+	s = &Settings{CorsAllowOrigins: []string{"*"}}
+	if origin := s.corsOrigin("http://example.net"); origin != "*" {
+		t.Error("Expected '*', got", origin)
+	}
+}
+
+func TestCorsOriginHeaders(t *testing.T) {
+	// Echoed origins vary by request
+	s := &Settings{CorsAllowOrigins: []string{"http://example.com"}, CorsAllowCredentials: true}
+	header := http.Header{}
+	s.setCorsOriginHeaders(header, "http://example.com")
+
+	if vary := header.Get("Vary"); vary != "Origin" {
+		t.Error("Expected 'Vary: Origin', got", vary)
+	}
+
+	if allowCredentials := header.Get("Access-Control-Allow-Credentials"); allowCredentials != "true" {
+		t.Error("Expected Access-Control-Allow-Credentials 'true', got", allowCredentials)
+	}
+
+	// A single, fixed origin doesn't vary
+	s = &Settings{CorsAllowOrigin: "http://example.com"}
+	header = http.Header{}
+	s.setCorsOriginHeaders(header, "http://example.org")
+
+	if vary := header.Get("Vary"); vary != "" {
+		t.Error("Expected no Vary header, got", vary)
+	}
+
+	// Credentials are refused for the wildcard origin
+	for _, s := range []*Settings{
+		{CorsAllowOrigin: "*", CorsAllowCredentials: true},
+		{CorsAllowOrigins: []string{"*"}, CorsAllowCredentials: true},
+	} {
+		header = http.Header{}
+		s.setCorsOriginHeaders(header, "http://example.org")
+
+		if allowOrigin := header.Get("Access-Control-Allow-Origin"); allowOrigin != "*" {
+			t.Error("Expected Access-Control-Allow-Origin '*', got", allowOrigin)
+		}
+
+		if allowCredentials := header.Get("Access-Control-Allow-Credentials"); allowCredentials != "" {
+			t.Error("Expected no Access-Control-Allow-Credentials for '*', got", allowCredentials)
+		}
+	}
+}
+
+func TestSettingsFromEnv(t *testing.T) {
+	t.Setenv("EVENTSOURCE_HOST", "0.0.0.0")
+	t.Setenv("EVENTSOURCE_PORT", "3000")
+	t.Setenv("EVENTSOURCE_AUTH_TOKEN", "secret")
+	t.Setenv("EVENTSOURCE_TIMEOUT", "30s")
+	t.Setenv("EVENTSOURCE_CORS_ORIGIN", "*")
+	t.Setenv("EVENTSOURCE_CORS_METHODS", "get, POST")
+
+	es, err := SettingsFromEnv()
+	if err != nil {
+		t.Fatal("Unable to read settings from environment", err)
+	}
+
+	if host := es.GetHost(); host != "0.0.0.0" {
+		t.Error("Expected '0.0.0.0', got", host)
+	}
+
+	if port := es.GetPort(); port != 3000 {
+		t.Error("Expected 3000, got", port)
+	}
+
+	if authToken := es.GetAuthToken(); authToken != "secret" {
+		t.Error("Expected 'secret', got", authToken)
+	}
+
+	if timeout := es.GetTimeout(); timeout != 30*time.Second {
+		t.Error("Expected 30 seconds, got", timeout)
+	}
+
+	if corsAllowOrigin := es.GetCorsAllowOrigin(); corsAllowOrigin != "*" {
+		t.Error("Expected '*', got", corsAllowOrigin)
+	}
+
+	if corsAllowMethod := es.GetCorsAllowMethod(); corsAllowMethod != "GET, POST" {
+		t.Error("Expected 'GET, POST', got", corsAllowMethod)
+	}
+
+	// Timeouts are accepted in seconds as well
+	t.Setenv("EVENTSOURCE_TIMEOUT", "5")
+	if es, err := SettingsFromEnv(); err != nil || es.GetTimeout() != 5*time.Second {
+		t.Error("Expected 5 seconds, got", es, err)
+	}
+}
+
+func TestSettingsFromEnvDefaults(t *testing.T) {
+	for _, key := range []string{"EVENTSOURCE_HOST", "EVENTSOURCE_PORT", "EVENTSOURCE_AUTH_TOKEN", "EVENTSOURCE_TIMEOUT", "EVENTSOURCE_CORS_ORIGIN", "EVENTSOURCE_CORS_METHODS"} {
+		t.Setenv(key, "")
+	}
+
+	es, err := SettingsFromEnv()
+	if err != nil {
+		t.Fatal("Unable to read settings from environment", err)
+	}
+
+	if host := es.GetHost(); host != defaultHost {
+		t.Error("Expected", defaultHost, "got", host)
+	}
+
+	if port := es.GetPort(); port != defaultPort {
+		t.Error("Expected", defaultPort, "got", port)
+	}
+
+	if timeout := es.GetTimeout(); timeout != defaultTimeout {
+		t.Error("Expected", defaultTimeout, "got", timeout)
+	}
+
+	if corsAllowMethod := es.GetCorsAllowMethod(); corsAllowMethod != defaultCorsAllowMethod {
+		t.Error("Expected", defaultCorsAllowMethod, "got", corsAllowMethod)
+	}
+}
+
+func TestMalformedSettingsFromEnv(t *testing.T) {
+	malformed := map[string][]string{
+		"EVENTSOURCE_PORT":    {"http", "-1", "70000", "0"},
+		"EVENTSOURCE_TIMEOUT": {"soon", "-5s", "0"},
+	}
+
+	for key, values := range malformed {
+		for _, value := range values {
+			t.Setenv(key, value)
+			if _, err := SettingsFromEnv(); err == nil {
+				t.Errorf("Expected an error for %s='%s'", key, value)
+			}
+		}
+		t.Setenv(key, "")
+	}
+}
+
+func TestLineEndingSettings(t *testing.T) {
+	for lineEnding, expected := range map[string]string{"\r\n": "\r\n", "\r": "\r", "\n": "\n", "\n\r": "\n", "<br>": "\n"} {
+		if got := (&Settings{LineEnding: lineEnding}).GetLineEnding(); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, lineEnding, got)
+		}
+	}
 }
@@ -0,0 +1,87 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"context"
+)
+
+// Names of the spans started by EventSource.
+const (
+	publishSpanName   = "eventsource.publish"
+	subscribeSpanName = "eventsource.subscribe"
+)
+
+// Tracer starts spans for publishing and subscribing.
+// It's a minimal interface, so EventSource doesn't depend on a tracing library.
+// An OpenTelemetry trace.Tracer is easily adapted by wrapping its Start method and the returned trace.Span.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single operation traced by a Tracer.
+type Span interface {
+	SetAttribute(key string, value any)
+	AddEvent(name string)
+	RecordError(err error)
+	End()
+}
+
+// NoopSpan is used when no Tracer is set up. It doesn't record anything and doesn't allocate.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) AddEvent(name string)               {}
+func (noopSpan) RecordError(err error)              {}
+func (noopSpan) End()                               {}
+
+// StartSpan starts a span with the Tracer, if one is set up, otherwise a noopSpan is returned.
+func (es *eventSource) startSpan(ctx context.Context, name string) Span {
+	tracer := es.currentSettings().Tracer
+	if tracer == nil {
+		return noopSpan{}
+	}
+	_, span := tracer.Start(ctx, name)
+	return span
+}
+
+// Tracing checks whether a Tracer is set up.
+// While tracing, publishing waits until a message is delivered, so its span covers the delivery.
+func (es *eventSource) tracing() bool {
+	return es.currentSettings().Tracer != nil
+}
+
+// StartPublishSpan starts the span of publishing a message to a channel.
+func (es *eventSource) startPublishSpan(ctx context.Context, channel string) Span {
+	span := es.startSpan(ctx, publishSpanName)
+	if _, ok := span.(noopSpan); !ok {
+		span.SetAttribute("eventsource.channel", channelOrDefault(channel))
+	}
+	return span
+}
+
+// EndPublishSpan tags the span of publishing with the result of the delivery and ends it.
+func endPublishSpan(span Span, dl *delivery, err error) {
+	if _, ok := span.(noopSpan); ok {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	} else if dl != nil {
+		span.SetAttribute("eventsource.consumers", dl.consumerCount)
+		span.SetAttribute("eventsource.event_id", dl.id)
+	}
+	span.End()
+}
+
+// StartSubscribeSpan starts the span of a consumer, which lasts from subscribing until unsubscribing.
+func (es *eventSource) startSubscribeSpan(ctx context.Context, cr *consumer) Span {
+	span := es.startSpan(ctx, subscribeSpanName)
+	if _, ok := span.(noopSpan); !ok {
+		span.SetAttribute("eventsource.channel", cr.channel)
+		span.SetAttribute("eventsource.remote_addr", cr.remoteAddr)
+	}
+	return span
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tracer recording all started spans
+type recordingTracer struct {
+	mutex sync.Mutex
+	spans []*recordedSpan
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	span := &recordedSpan{tracer: rt, name: name, attributes: map[string]any{}}
+	rt.spans = append(rt.spans, span)
+	return ctx, span
+}
+
+// Helper for looking up the first ended span of the given name
+func (rt *recordingTracer) endedSpan(t *testing.T, name string) recordedSpan {
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+		rt.mutex.Lock()
+		for _, span := range rt.spans {
+			if span.name == name && span.ended {
+				copied := *span
+				rt.mutex.Unlock()
+				return copied
+			}
+		}
+		rt.mutex.Unlock()
+	}
+	t.Fatal("Timeout while waiting for the span", name)
+	return recordedSpan{}
+}
+
+type recordedSpan struct {
+	tracer     *recordingTracer
+	name       string
+	attributes map[string]any
+	events     []string
+	err        error
+	ended      bool
+}
+
+func (rs *recordedSpan) SetAttribute(key string, value any) {
+	rs.tracer.mutex.Lock()
+	defer rs.tracer.mutex.Unlock()
+	rs.attributes[key] = value
+}
+
+func (rs *recordedSpan) AddEvent(name string) {
+	rs.tracer.mutex.Lock()
+	defer rs.tracer.mutex.Unlock()
+	rs.events = append(rs.events, name)
+}
+
+func (rs *recordedSpan) RecordError(err error) {
+	rs.tracer.mutex.Lock()
+	defer rs.tracer.mutex.Unlock()
+	rs.err = err
+}
+
+func (rs *recordedSpan) End() {
+	rs.tracer.mutex.Lock()
+	defer rs.tracer.mutex.Unlock()
+	rs.ended = true
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	es := setupEventSource(t, &Settings{Tracer: tracer})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default")
+
+	resp, err := http.Post(es.testServer.URL+"/default", "application/json", buildMessageData(ModeAll))
+	if err != nil {
+		t.Fatal("Unable to publish message", err)
+	}
+	resp.Body.Close()
+	expectResponse(t, conn, "id: 1\nevent: foo\ndata: bar\n\n")
+
+	publish := tracer.endedSpan(t, publishSpanName)
+	if publish.attributes["eventsource.channel"] != "default" {
+		t.Error("Expected the publish span to be tagged with the channel, got", publish.attributes)
+	}
+	if publish.attributes["eventsource.consumers"] != 1 {
+		t.Error("Expected the publish span to be tagged with 1 consumer, got", publish.attributes)
+	}
+	if publish.attributes["eventsource.event_id"] != uint(1) {
+		t.Error("Expected the publish span to be tagged with the event ID, got", publish.attributes)
+	}
+
+	conn.Close()
+
+	subscribe := tracer.endedSpan(t, subscribeSpanName)
+	if subscribe.attributes["eventsource.channel"] != "default" {
+		t.Error("Expected the subscribe span to be tagged with the channel, got", subscribe.attributes)
+	}
+	if len(subscribe.events) != 2 || subscribe.events[0] != "subscribed" || subscribe.events[1] != "unsubscribed" {
+		t.Error("Expected the subscribe span to record the lifecycle, got", subscribe.events)
+	}
+}
+
+func TestTracerRecordsErrors(t *testing.T) {
+	tracer := &recordingTracer{}
+	es := setupEventSource(t, &Settings{Tracer: tracer, RejectUnknownChannels: true})
+	defer es.closeEventSource()
+
+	if err := es.eventSource.SendMessage(buildMessageData(ModeAll), "unknown"); err != errUnknownChannel {
+		t.Error("Expected the message to be rejected, got", err)
+	}
+
+	if publish := tracer.endedSpan(t, publishSpanName); publish.err != errUnknownChannel {
+		t.Error("Expected the publish span to record the error, got", publish.err)
+	}
+}
+
+func TestNoopSpanAllocations(t *testing.T) {
+	es := New(nil).(*eventSource)
+	defer es.Stop()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		span := es.startPublishSpan(context.Background(), "default")
+		endPublishSpan(span, &delivery{consumerCount: 1000, id: 1000}, nil)
+	})
+	if allocs != 0 {
+		t.Error("Expected no allocations without a Tracer, got", allocs)
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GUID appended to the Sec-WebSocket-Key, as specified by RFC 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of WebSocket frames.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// Maximum payload size of control frames, as specified by RFC 6455.
+const maxControlPayload = 125
+
+// Maximum payload size, which is encoded in the 7 bit payload length of a frame header.
+// Larger payloads use an extended payload length of 16 or 64 bits.
+const maxShortPayload = 125
+
+// Errors of WebSocket upgrades.
+var (
+	errInvalidHandshake  = errors.New("invalid WebSocket handshake")
+	errOriginNotAllowed  = errors.New("origin not allowed")
+	errHijackUnsupported = errors.New("connection can't be taken over")
+	errInvalidFrame      = errors.New("invalid WebSocket frame")
+)
+
+// IsWebSocketUpgrade checks whether a request asks for an upgrade to the WebSocket protocol.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") && headerContainsToken(req.Header, "Upgrade", "websocket")
+}
+
+// HeaderContainsToken checks whether a comma separated header contains the given token, ignoring case.
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateWebSocketUpgrade checks the handshake of a WebSocket upgrade, before the consumer gets registered.
+// Browsers don't apply CORS to WebSockets, so the origin is checked against the allowed origins instead.
+func (s *Settings) validateWebSocketUpgrade(req *http.Request) error {
+	if len(req.Header.Get("Sec-WebSocket-Key")) == 0 || req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return errInvalidHandshake
+	}
+	if origin := req.Header.Get("Origin"); len(origin) > 0 {
+		if allowOrigin := s.corsOrigin(origin); allowOrigin != "*" && allowOrigin != origin {
+			return errOriginNotAllowed
+		}
+	}
+	return nil
+}
+
+// WebSocketAccept returns the Sec-WebSocket-Accept for the Sec-WebSocket-Key of a handshake.
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// WebSocket is a connection which writes each write as a text frame to a WebSocket.
+// Frames of the client are only read to answer pings and to detect disconnects, their payload is discarded.
+type webSocket struct {
+	conn      net.Conn
+	rw        *bufio.ReadWriter
+	mu        sync.Mutex
+	closeOnce sync.Once
+}
+
+// AcceptWebSocket takes over the connection of a request and completes the WebSocket handshake.
+func acceptWebSocket(rw http.ResponseWriter, req *http.Request, header http.Header) (*webSocket, error) {
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return nil, errHijackUnsupported
+	}
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\n")
+	brw.WriteString("Connection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocket{conn: conn, rw: brw}, nil
+}
+
+// Write sends data as a single text frame.
+func (ws *webSocket) Write(data []byte) (int, error) {
+	if err := ws.writeFrame(opText, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (ws *webSocket) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
+
+// Close sends a close frame and closes the underlying connection. Repeated calls are ignored.
+func (ws *webSocket) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		ws.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		ws.writeFrame(opClose, nil)
+		err = ws.conn.Close()
+	})
+	return err
+}
+
+// WriteFrame writes a single, unmasked frame. Servers never mask their frames.
+// The first error of writing the header, the payload or flushing them is returned.
+func (ws *webSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length <= maxShortPayload:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// ReadFrames reads the frames of the client until it closes the connection or the connection fails,
+// and closes the returned channel afterwards. Pings are answered with pongs.
+func (ws *webSocket) readFrames() <-chan struct{} {
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		for {
+			opcode, payload, err := ws.readFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case opClose:
+				return
+			case opPing:
+				if ws.writeFrame(opPong, payload) != nil {
+					return
+				}
+			}
+		}
+	}()
+	return disconnected
+}
+
+// ReadFrame reads a single frame of the client. Payloads of control frames are unmasked and returned,
+// payloads of data frames are discarded.
+func (ws *webSocket) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.rw, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.rw, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	var mask [4]byte
+	if header[1]&0x80 != 0 {
+		if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if opcode < opClose {
+		_, err := io.CopyN(io.Discard, ws.rw, int64(length))
+		return opcode, nil, err
+	}
+	if length > maxControlPayload {
+		return 0, nil, errInvalidFrame
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// StreamWebSocket sets up the consumer for receiving events via a WebSocket, which the connection of the request is upgraded to.
+// Each event is sent as a JSON encoded text frame, replayed messages and the OnConnectMessage come first, like for event streams.
+// It blocks and processes incoming messages until the consumer is removed.
+func (cr *consumer) streamWebSocket(rw http.ResponseWriter, req *http.Request) error {
+	header := http.Header{}
+	header.Set("X-Consumer-ID", cr.id)
+
+	ws, err := acceptWebSocket(rw, req, header)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	cr.connection = ws
+	cr.disconnected = ws.readFrames()
+
+	if onConnectMessage := cr.es.currentSettings().OnConnectMessage; onConnectMessage != nil {
+		if e := onConnectMessage(cr.channel); e != nil && !cr.send(eventMessageFromEvent(e, cr.channel)) {
+			return nil
+		}
+	}
+
+	for _, em := range cr.replay {
+		if em = cr.filter(em); em != nil && !cr.send(em) {
+			return nil
+		}
+	}
+	cr.replay = nil
+
+	idle := cr.startIdleTimer()
+	defer cr.stopIdleTimer()
+
+	var lifetime <-chan time.Time
+	if maxConnectionLifetime := cr.es.currentSettings().GetMaxConnectionLifetime(); maxConnectionLifetime > 0 {
+		lifetimeTimer := time.NewTimer(maxConnectionLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+
+	cr.inboxDispatcher(idle, lifetime)
+
+	return nil
+}
+
+// EncodeWebSocketEvent returns the text frame payload of an event sent via a WebSocket.
+func encodeWebSocketEvent(e *Event) []byte {
+	data, _ := json.Marshal(e)
+	return data
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Matthias Kalb, Railsmechanic. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package eventsource
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var webSocketHeaders = []string{
+	"Connection: Upgrade",
+	"Upgrade: websocket",
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==",
+	"Sec-WebSocket-Version: 13",
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example of RFC 6455
+	if accept := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("Expected 's3pPLMBiTxaQ9kYGzzhZRbK+xOo=', got", accept)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		EnableWebSocket: true,
+	})
+	defer es.closeEventSource()
+
+	conn, resp := es.joinChannel(t, "default", webSocketHeaders...)
+	defer conn.Close()
+
+	if !strings.HasPrefix(string(resp), "HTTP/1.1 101 Switching Protocols") {
+		t.Fatal("Expected WebSocket upgrade, got", string(resp))
+	}
+	if !strings.Contains(string(resp), "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=") {
+		t.Error("Expected Sec-WebSocket-Accept header, got", string(resp))
+	}
+
+	es.eventSource.SendMessage(buildMessageData(ModeAll), "default")
+
+	payload := `{"id":1,"event":"foo","data":"bar","comment":null,"ttl":0}`
+	expectResponse(t, conn, "\x81"+string(rune(len(payload)))+payload)
+
+	// A close frame of the client disconnects the consumer
+	if _, err := conn.Write([]byte{0x88, 0x80, 0, 0, 0, 0}); err != nil {
+		t.Fatal("Unable to send close frame", err)
+	}
+	expectResponse(t, conn, "\x88\x00")
+
+	if consumerCount := es.eventSource.ConsumerCount("default"); consumerCount != 0 {
+		t.Error("Expected 0 consumers after closing the WebSocket, got", consumerCount)
+	}
+}
+
+func TestWebSocketRejected(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		EnableWebSocket:  true,
+		CorsAllowOrigins: []string{"http://example.com"},
+	})
+	defer es.closeEventSource()
+
+	for headers, status := range map[string]int{
+		"Connection: Upgrade\nUpgrade: websocket":                           http.StatusBadRequest,
+		strings.Join(webSocketHeaders, "\n") + "\nOrigin: http://evil.test": http.StatusForbidden,
+	} {
+		conn, resp := es.joinChannel(t, "default", headers)
+		conn.Close()
+
+		if !strings.HasPrefix(string(resp), fmt.Sprintf("HTTP/1.1 %d", status)) {
+			t.Errorf("Expected status %d for '%s', got %s", status, headers, resp)
+		}
+	}
+
+	// Without EnableWebSocket, upgrades are served as event streams
+	es.eventSource.UpdateSettings(&Settings{})
+	conn, resp := es.joinChannel(t, "default", webSocketHeaders...)
+	defer conn.Close()
+
+	if !strings.Contains(string(resp), "text/event-stream") {
+		t.Error("Expected event stream without EnableWebSocket, got", string(resp))
+	}
+}
+
+func TestWebSocketRawMessage(t *testing.T) {
+	es := setupEventSource(t, &Settings{
+		EnableWebSocket: true,
+	})
+	defer es.closeEventSource()
+
+	conn, _ := es.joinChannel(t, "default", webSocketHeaders...)
+	defer conn.Close()
+
+	// Raw messages are sent as their parsed events, raw messages without data aren't sent at all
+	for _, raw := range []string{"retry: 1000\n\n", "id: 7\nevent: foo\ndata: bar\n\n"} {
+		resp, err := http.Post(es.testServer.URL+"/default", "text/event-stream", strings.NewReader(raw))
+		if err != nil {
+			t.Fatal("Unable to send POST request", err)
+		}
+		resp.Body.Close()
+	}
+
+	payload := `{"id":7,"event":"foo","data":"bar","comment":null,"ttl":0}`
+	expectResponse(t, conn, "\x81"+string(rune(len(payload)))+payload)
+	expectNoResponse(t, conn)
+}